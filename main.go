@@ -4,47 +4,104 @@ import (
     "errors"
     mRand "math/rand"
 	"bytes"
+	"context"
+	"database/sql"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"encoding/hex"
 	"fmt"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/csrf"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/gofiber/template/html/v2"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/hkdf"
 	"github.com/sendgrid/sendgrid-go"
     "github.com/sendgrid/sendgrid-go/helpers/mail"
 	"github.com/robfig/cron/v3"
+	"flag"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	netMail "net/mail"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"text/template"
 	"time"
+	"unicode"
 )
 
 const (
 	doDevSetupDB   = false 
-	schemaTemplate = `
+	schemaResetSQL = `
         TRUNCATE TABLE room CASCADE;
         TRUNCATE TABLE participant CASCADE;
 
+        DROP TABLE IF EXISTS email_request;
+        DROP TABLE IF EXISTS lockout_event;
+        DROP TABLE IF EXISTS password_failure;
+        DROP TABLE IF EXISTS webhook_delivery;
+        DROP TABLE IF EXISTS webhook;
+        DROP TABLE IF EXISTS room_export;
+        DROP TABLE IF EXISTS invite;
+        DROP TABLE IF EXISTS sent_reminder;
+        DROP TABLE IF EXISTS assignment;
         DROP TABLE IF EXISTS participant;
+        DROP TABLE IF EXISTS room_admin;
         DROP TABLE IF EXISTS room;
-
+        DROP TABLE IF EXISTS session_store;
+        DROP TABLE IF EXISTS audit_event;
+    `
+	schemaTemplate = `
         CREATE TABLE IF NOT EXISTS room (
             id SERIAL PRIMARY KEY,
             name VARCHAR(255) UNIQUE,
             join_password VARCHAR(255) NOT NULL,
             admin_password VARCHAR(255) NOT NULL,
+            admin_email VARCHAR(255) NOT NULL DEFAULT '',
+            visibility VARCHAR(16) NOT NULL DEFAULT 'public',
+            slug VARCHAR(32) NOT NULL DEFAULT '',
+            require_approval BOOL NOT NULL DEFAULT FALSE,
+            max_participants INTEGER NOT NULL DEFAULT 0,
+            chat_platform VARCHAR(16) NOT NULL DEFAULT '',
+            chat_webhook_url VARCHAR(2048) NOT NULL DEFAULT '',
+            chat_bot_token VARCHAR(512) NOT NULL DEFAULT '',
 			draw_completed BOOL NOT NULL DEFAULT FALSE,
             deadline TIMESTAMP DEFAULT '{{.DefaultDeadline}}',
+            exchange_date TIMESTAMP,
+            purged_at TIMESTAMP,
+            purged_participant_count INTEGER NOT NULL DEFAULT 0,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        -- room.admin_password is the creator's password as first set; room_admin holds the current ones
+        CREATE TABLE IF NOT EXISTS room_admin (
+            id SERIAL PRIMARY KEY,
+            room_id INTEGER REFERENCES room(id),
+            email VARCHAR(255) NOT NULL DEFAULT '',
+            admin_password VARCHAR(255) NOT NULL DEFAULT '',
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
         );
 
@@ -52,35 +109,318 @@ const (
             id SERIAL PRIMARY KEY,
             room_id INTEGER REFERENCES room(id),
             email VARCHAR(255),
+            email_hash VARCHAR(64) NOT NULL DEFAULT '',
             name VARCHAR(255),
             participant_password VARCHAR(255) NOT NULL,
+            exclusion_group VARCHAR(255) NOT NULL DEFAULT '',
+            wishlist TEXT NOT NULL DEFAULT '',
+            status VARCHAR(16) NOT NULL DEFAULT 'approved',
+            erased_at TIMESTAMP,
+            magic_link_used_at TIMESTAMP,
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
             UNIQUE (room_id, email),
             UNIQUE (room_id, name)
         );
+
+        CREATE TABLE IF NOT EXISTS assignment (
+            id SERIAL PRIMARY KEY,
+            room_id INTEGER REFERENCES room(id),
+            participant_id INTEGER REFERENCES participant(id),
+            giftee_id INTEGER REFERENCES participant(id),
+            notified_at TIMESTAMP,
+            sent_at TIMESTAMP,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            UNIQUE (room_id, participant_id)
+        );
+
+        CREATE TABLE IF NOT EXISTS sent_reminder (
+            room_id INTEGER REFERENCES room(id),
+            kind VARCHAR(32) NOT NULL,
+            participant_id INTEGER NOT NULL DEFAULT 0,
+            sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (room_id, kind, participant_id)
+        );
+
+        CREATE TABLE IF NOT EXISTS invite (
+            id SERIAL PRIMARY KEY,
+            room_id INTEGER REFERENCES room(id),
+            email VARCHAR(255) NOT NULL DEFAULT '',
+            max_uses INTEGER NOT NULL DEFAULT 1,
+            uses INTEGER NOT NULL DEFAULT 0,
+            expires_at TIMESTAMP NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS room_export (
+            id SERIAL PRIMARY KEY,
+            room_id INTEGER REFERENCES room(id),
+            format VARCHAR(16) NOT NULL,
+            include_assignments BOOL NOT NULL DEFAULT FALSE,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS webhook (
+            id SERIAL PRIMARY KEY,
+            room_id INTEGER REFERENCES room(id),
+            url VARCHAR(2048) NOT NULL,
+            secret VARCHAR(255) NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS webhook_delivery (
+            id SERIAL PRIMARY KEY,
+            webhook_id INTEGER REFERENCES webhook(id) ON DELETE CASCADE,
+            event VARCHAR(64) NOT NULL,
+            payload TEXT NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            delivered BOOL NOT NULL DEFAULT FALSE,
+            last_status_code INTEGER NOT NULL DEFAULT 0,
+            last_error TEXT NOT NULL DEFAULT '',
+            next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE TABLE IF NOT EXISTS password_failure (
+            id SERIAL PRIMARY KEY,
+            room_id INTEGER REFERENCES room(id),
+            scope VARCHAR(16) NOT NULL,
+            ip_hash VARCHAR(64) NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS password_failure_room_scope_idx ON password_failure (room_id, scope, created_at);
+
+        CREATE TABLE IF NOT EXISTS lockout_event (
+            id SERIAL PRIMARY KEY,
+            room_id INTEGER REFERENCES room(id),
+            scope VARCHAR(16) NOT NULL,
+            ip_hash VARCHAR(64) NOT NULL DEFAULT '',
+            failures INTEGER NOT NULL,
+            locked_until TIMESTAMP NOT NULL,
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+
+        -- The latest emailed link per room, kind and address, so one address is not flooded with links
+        CREATE TABLE IF NOT EXISTS email_request (
+            room_id INTEGER REFERENCES room(id),
+            kind VARCHAR(16) NOT NULL,
+            email_hash VARCHAR(64) NOT NULL,
+            requested_at TIMESTAMP NOT NULL,
+            PRIMARY KEY (room_id, kind, email_hash)
+        );
+
+        -- room_id deliberately has no foreign key so the trail outlives purged rooms; 0 marks instance-wide events
+        CREATE TABLE IF NOT EXISTS audit_event (
+            id SERIAL PRIMARY KEY,
+            room_id INTEGER NOT NULL DEFAULT 0,
+            actor_type VARCHAR(16) NOT NULL,
+            action VARCHAR(64) NOT NULL,
+            ip_hash VARCHAR(64) NOT NULL DEFAULT '',
+            details TEXT NOT NULL DEFAULT '{}',
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS audit_event_room_idx ON audit_event (room_id, created_at);
+
+        CREATE OR REPLACE FUNCTION audit_event_append_only() RETURNS trigger AS $$
+        BEGIN
+            RAISE EXCEPTION 'audit_event is append-only';
+        END;
+        $$ LANGUAGE plpgsql;
+
+        DROP TRIGGER IF EXISTS audit_event_append_only ON audit_event;
+        CREATE TRIGGER audit_event_append_only BEFORE UPDATE OR DELETE ON audit_event
+            FOR EACH ROW EXECUTE PROCEDURE audit_event_append_only();
+
+        CREATE TABLE IF NOT EXISTS session_store (
+            key VARCHAR(64) PRIMARY KEY,
+            data BYTEA NOT NULL,
+            expires_at TIMESTAMP
+        );
+    `
+	sessionStoragePostgres = "postgres"
+	sessionStorageMemory   = "memory"
+	sessionCleanupInterval = "@every 15m"
+	retentionPurgeInterval = "@every 1h"
+	readinessTimeout       = 2 * time.Second
+	requestIDContextKey    = "requestid"
+	csrfFormField          = "_csrf"
+	csrfContextKey         = "CSRFToken"
+
+	passwordScopeJoin        = "join"
+	passwordScopeAdmin       = "admin"
+	passwordScopeParticipant = "participant"
+
+	actorVisitor     = "visitor"
+	actorParticipant = "participant"
+	actorAdmin       = "admin"
+	actorScheduler   = "scheduler"
+	actorCLI         = "cli"
+	actorSystem      = "system"
+
+	// Failed password attempts are counted per room, scope and client IP over bruteForceWindow. There is
+	// deliberately no room-wide lockout, which would let anyone lock a room's password for everyone.
+	bruteForceWindow          = 15 * time.Minute
+	bruteForceFreeAttempts    = 3
+	bruteForceLockoutAttempts = 10
+	bruteForceLockoutDuration = 15 * time.Minute
+
+	// One live participant per address and room. It needs email_hash filled in, so migrate adds it after
+	// indexing emails; see dbAddParticipantEmailUniqueIndex
+	participantEmailUniqueIndex    = "participant_email_hash_key"
+	participantEmailUniqueIndexSQL = `
+        CREATE UNIQUE INDEX IF NOT EXISTS participant_email_hash_key ON participant (room_id, email_hash)
+        WHERE erased_at IS NULL AND email_hash <> '';
+    `
+
+	// The UNIQUE (room_id, name) constraint of the participant table, as Postgres names it
+	participantNameUniqueConstraint = "participant_room_id_name_key"
+
+	// Brings databases created by earlier versions of schemaTemplate up to date
+	migrationsSQL = `
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS admin_email VARCHAR(255) NOT NULL DEFAULT '';
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS visibility VARCHAR(16) NOT NULL DEFAULT 'public';
+        -- Rooms without a slug get one from dbMigrateDatabaseSchema, which has a secure random source
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS slug VARCHAR(32) NOT NULL DEFAULT '';
+        CREATE UNIQUE INDEX IF NOT EXISTS room_slug_idx ON room (slug) WHERE slug <> '';
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS chat_platform VARCHAR(16) NOT NULL DEFAULT '';
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS chat_webhook_url VARCHAR(2048) NOT NULL DEFAULT '';
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS chat_bot_token VARCHAR(512) NOT NULL DEFAULT '';
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS exchange_date TIMESTAMP;
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS purged_at TIMESTAMP;
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS purged_participant_count INTEGER NOT NULL DEFAULT 0;
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS require_approval BOOL NOT NULL DEFAULT FALSE;
+        ALTER TABLE room ADD COLUMN IF NOT EXISTS max_participants INTEGER NOT NULL DEFAULT 0;
+
+        ALTER TABLE participant ADD COLUMN IF NOT EXISTS exclusion_group VARCHAR(255) NOT NULL DEFAULT '';
+        ALTER TABLE participant ADD COLUMN IF NOT EXISTS wishlist TEXT NOT NULL DEFAULT '';
+        ALTER TABLE participant ADD COLUMN IF NOT EXISTS erased_at TIMESTAMP;
+        ALTER TABLE participant ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'approved';
+        ALTER TABLE participant ADD COLUMN IF NOT EXISTS magic_link_used_at TIMESTAMP;
+        -- Filled in by the migrate command, which has the encryption key
+        ALTER TABLE participant ADD COLUMN IF NOT EXISTS email_hash VARCHAR(64) NOT NULL DEFAULT '';
+        CREATE INDEX IF NOT EXISTS participant_email_hash_idx ON participant (room_id, email_hash);
+
+        -- Assignments drawn before notifications were tracked were already sent; the default marks them once
+        ALTER TABLE assignment ADD COLUMN IF NOT EXISTS notified_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+        ALTER TABLE assignment ALTER COLUMN notified_at DROP DEFAULT;
+        -- Sends claimed before confirmations were tracked count as delivered
+        ALTER TABLE assignment ADD COLUMN IF NOT EXISTS sent_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+        ALTER TABLE assignment ALTER COLUMN sent_at DROP DEFAULT;
+
+        -- Rooms created before co-admins keep their shared admin password as the first admin
+        INSERT INTO room_admin (room_id, email, admin_password, created_at)
+        SELECT r.id, r.admin_email, r.admin_password, r.created_at
+        FROM room r
+        WHERE NOT EXISTS (SELECT 1 FROM room_admin a WHERE a.room_id = r.id);
     `
 )
 
+const (
+	reminderKindAdminDeadline = "admin_deadline"
+	reminderKindGiverExchange = "giver_exchange"
+	// Not a reminder, but recorded in the same ledger so the event fires once
+	reminderKindRegistrationClosed = "registration_closed"
+	// The scheduler retries a failed draw every run; this keeps its audit entry to the first failure
+	reminderKindDrawFailed = "draw_failed"
+
+	defaultInviteExpiryDays = 7
+
+	roomVisibilityPublic   = "public"
+	roomVisibilityUnlisted = "unlisted"
+	roomVisibilityPrivate  = "private"
+
+	// Only approved participants are listed, counted and drawn
+	participantStatusApproved   = "approved"
+	participantStatusPending    = "pending"
+	participantStatusWaitlisted = "waitlisted"
+	participantStatusRejected   = "rejected"
+
+	indexPageSize = 20
+
+	maxAssignAttempts     = 1000
+	setPasswordExpiryDays = 14
+	magicLinkExpiry       = 15 * time.Minute
+	// Admin reset links are short-lived; co-organizer invitations use setPasswordExpiryDays
+	adminPasswordResetExpiry = time.Hour
+	// One address is sent at most one link of each kind per room within emailRequestCooldown
+	emailRequestCooldown   = 5 * time.Minute
+	emailRequestAdminReset = "admin_reset"
+	emailRequestMagicLink  = "magic_link"
+
+	webhookEventParticipantJoined  = "participant.joined"
+	webhookEventParticipantLeft    = "participant.left"
+	webhookEventRegistrationClosed = "registration.closed"
+	webhookEventDrawCompleted      = "draw.completed"
+	webhookEventReminderDue        = "reminder.due"
+	webhookMaxAttempts             = 6
+	webhookDeliveryBatchSize       = 20
+	webhookTimeout                 = 10 * time.Second
+
+	metricsRoomCountInterval = time.Minute
+
+	// An assignment claimed this long ago without a confirmed send was cut short mid-send and is sent again
+	assignmentClaimTimeout = 15 * time.Minute
+
+	chatPlatformSlack      = "slack"
+	chatPlatformMattermost = "mattermost"
+	chatPlatformDiscord    = "discord"
+	slackAPIURL            = "https://slack.com/api"
+)
+
+var chatCountdownDays = []int{7, 3, 1}
+
 /*
    ##### Models
 */
 type Room struct {
-	ID            int       `db:"id"`
-	Name          string    `db:"name"`
-	JoinPassword  string    `db:"join_password"`
-	AdminPassword string    `db:"admin_password"`
-	DrawCompleted bool      `db:"draw_completed"`
-	Deadline      time.Time `db:"deadline"`
-	CreatedAt     time.Time `db:"created_at"`
+	ID            int    `db:"id"`
+	Name          string `db:"name"`
+	JoinPassword  string `db:"join_password"`
+	AdminPassword string `db:"admin_password"`
+	AdminEmail    string `db:"admin_email"`
+	Visibility    string `db:"visibility"`
+	// Unguessable name for the room's link; unlisted rooms can only be found through it
+	Slug string `db:"slug"`
+	// New joiners wait for an admin when set; MaxParticipants of 0 means no limit
+	RequireApproval bool         `db:"require_approval"`
+	MaxParticipants int          `db:"max_participants"`
+	ChatPlatform    string       `db:"chat_platform"`
+	ChatWebhook     string       `db:"chat_webhook_url"`
+	ChatBotToken    string       `db:"chat_bot_token"`
+	DrawCompleted   bool         `db:"draw_completed"`
+	Deadline        time.Time    `db:"deadline"`
+	ExchangeDate    sql.NullTime `db:"exchange_date"`
+	PurgedAt        sql.NullTime `db:"purged_at"`
+	// Approved participants at the retention purge, kept so room statistics survive the participants;
+	// pending, waitlisted and rejected joiners never took part and are not counted
+	PurgedParticipantCount int       `db:"purged_participant_count"`
+	CreatedAt              time.Time `db:"created_at"`
 }
 
 type Participant struct {
-	ID                  int       `db:"id"`
-	RoomID              int       `db:"room_id"`
-	Email               string    `db:"email"`
-	Name                string    `db:"name"`
-	ParticipantPassword string    `db:"participant_password"`
-	CreatedAt           time.Time `db:"created_at"`
+	ID                  int          `db:"id"`
+	RoomID              int          `db:"room_id"`
+	Email               string       `db:"email"`
+	EmailHash           string       `db:"email_hash"`
+	Name                string       `db:"name"`
+	ParticipantPassword string       `db:"participant_password"`
+	ExclusionGroup      string       `db:"exclusion_group"`
+	Wishlist            string       `db:"wishlist"`
+	Status              string       `db:"status"`
+	ErasedAt            sql.NullTime `db:"erased_at"`
+	MagicLinkUsedAt     sql.NullTime `db:"magic_link_used_at"`
+	CreatedAt           time.Time    `db:"created_at"`
+}
+
+// RoomAdmin is one organizer of a room. Email is empty for rooms that predate co-admins, and
+// AdminPassword is empty until an invited co-organizer sets it.
+type RoomAdmin struct {
+	ID            int       `db:"id"`
+	RoomID        int       `db:"room_id"`
+	Email         string    `db:"email"`
+	AdminPassword string    `db:"admin_password"`
+	CreatedAt     time.Time `db:"created_at"`
 }
 
 type RoomWithParticipantCount struct {
@@ -89,40 +429,523 @@ type RoomWithParticipantCount struct {
 }
 
 type CreateRoomFormData struct {
-	RoomName      string `form:"roomName"`
-	AdminPassword string `form:"adminPassword"`
-	JoinPassword  string `form:"joinPassword"`
-	Deadline      string `form:"deadline"`
+	RoomName        string `form:"roomName" json:"roomName"`
+	AdminPassword   string `form:"adminPassword" json:"adminPassword"`
+	JoinPassword    string `form:"joinPassword" json:"joinPassword"`
+	AdminEmail      string `form:"adminEmail" json:"adminEmail"`
+	Visibility      string `form:"visibility" json:"visibility"`
+	Deadline        string `form:"deadline" json:"deadline"`
+	ExchangeDate    string `form:"exchangeDate" json:"exchangeDate"`
+	RequireApproval bool   `form:"requireApproval" json:"requireApproval"`
+	MaxParticipants int    `form:"maxParticipants" json:"maxParticipants"`
 }
 
 type CreateParticipantFormData struct {
-	Email               string `form:"email"`
-	Name                string `form:"name"`
-	ParticipantPassword string `form:"participantPassword"`
+	Email               string `form:"email" json:"email"`
+	Name                string `form:"name" json:"name"`
+	ParticipantPassword string `form:"participantPassword" json:"participantPassword"`
+	ExclusionGroup      string `form:"exclusionGroup" json:"exclusionGroup"`
+	Wishlist            string `form:"wishlist" json:"wishlist"`
+}
+
+type ImportRow struct {
+	Line           int
+	Name           string
+	Email          string
+	ExclusionGroup string
+	Wishlist       string
+	Errors         []string
 }
 
 type Assignment struct {
 	Participant      Participant
+	GifteeID         int
 	GifteeName       string
+	NotifiedAt       sql.NullTime
+	SentAt           sql.NullTime
+}
+
+type Invite struct {
+	ID        int       `db:"id"`
+	RoomID    int       `db:"room_id"`
+	Email     string    `db:"email"`
+	MaxUses   int       `db:"max_uses"`
+	Uses      int       `db:"uses"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type InviteWithURL struct {
+	Invite
+	URL string
+}
+
+type CreateInviteFormData struct {
+	MaxUses       int `form:"maxUses" json:"maxUses"`
+	ExpiresInDays int `form:"expiresInDays" json:"expiresInDays"`
+}
+
+type RoomExportRecord struct {
+	ID                 int       `db:"id"`
+	RoomID             int       `db:"room_id"`
+	Format             string    `db:"format"`
+	IncludeAssignments bool      `db:"include_assignments"`
+	CreatedAt          time.Time `db:"created_at"`
+}
+
+type ExportedParticipant struct {
+	Name           string    `json:"name"`
+	Email          string    `json:"email"`
+	ExclusionGroup string    `json:"exclusionGroup,omitempty"`
+	Wishlist       string    `json:"wishlist,omitempty"`
+	JoinedAt       time.Time `json:"joinedAt"`
+	GifteeName     string    `json:"gifteeName,omitempty"`
+}
+
+type RoomExport struct {
+	RoomName           string                `json:"roomName"`
+	Deadline           time.Time             `json:"deadline"`
+	ExchangeDate       *time.Time            `json:"exchangeDate,omitempty"`
+	ExportedAt         time.Time             `json:"exportedAt"`
+	IncludeAssignments bool                  `json:"includeAssignments"`
+	Participants       []ExportedParticipant `json:"participants"`
+}
+
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type APIRoom struct {
+	ID               int        `json:"id"`
+	Name             string     `json:"name"`
+	Visibility       string     `json:"visibility"`
+	Slug             string     `json:"slug"`
+	Deadline         time.Time  `json:"deadline"`
+	ExchangeDate     *time.Time `json:"exchangeDate,omitempty"`
+	DrawCompleted    bool       `json:"drawCompleted"`
+	RequireApproval  bool       `json:"requireApproval"`
+	MaxParticipants  int        `json:"maxParticipants"`
+	ParticipantCount int        `json:"participantCount"`
+}
+
+type APIRoomList struct {
+	Rooms   []APIRoom `json:"rooms"`
+	Page    int       `json:"page"`
+	HasNext bool      `json:"hasNext"`
+}
+
+type APIParticipant struct {
+	ID       int       `json:"id"`
+	Name     string    `json:"name"`
+	Wishlist string    `json:"wishlist,omitempty"`
+	Status   string    `json:"status"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+type APIInvite struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email,omitempty"`
+	MaxUses   int       `json:"maxUses"`
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	URL       string    `json:"url"`
+}
+
+type APIAuditEvent struct {
+	ID        int                    `json:"id"`
+	ActorType string                 `json:"actorType"`
+	Action    string                 `json:"action"`
+	IPHash    string                 `json:"ipHash,omitempty"`
+	Details   map[string]interface{} `json:"details"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+// ParticipantDataExport is everything held about one participant, for their own download.
+type ParticipantDataExport struct {
+	RoomName       string                `json:"roomName"`
+	Name           string                `json:"name"`
+	Email          string                `json:"email"`
+	ExclusionGroup string                `json:"exclusionGroup"`
+	Wishlist       string                `json:"wishlist"`
+	JoinedAt       time.Time             `json:"joinedAt"`
+	Status         string                `json:"status"`
+	GifteeName     string                `json:"gifteeName,omitempty"`
+	RemindersSent  []ParticipantReminder `json:"remindersSent"`
+	Activity       []APIAuditEvent       `json:"activity"`
+	ExportedAt     time.Time             `json:"exportedAt"`
+}
+
+type ParticipantReminder struct {
+	Kind   string    `db:"kind" json:"kind"`
+	SentAt time.Time `db:"sent_at" json:"sentAt"`
+}
+
+type APIErasureResponse struct {
+	Anonymized bool `json:"anonymized"`
+}
+
+type APIProfileRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type APIMagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type APIMagicLinkSessionRequest struct {
+	Token string `json:"token"`
+}
+
+type APIPasswordChangeRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type APIAssignment struct {
+	GifteeName     string     `json:"gifteeName"`
+	GifteeWishlist string     `json:"gifteeWishlist,omitempty"`
+	ExchangeDate   *time.Time `json:"exchangeDate,omitempty"`
+}
+
+type APIRoomAccessRequest struct {
+	JoinPassword string `json:"joinPassword"`
+	// Required for unlisted rooms: the last part of the room's link
+	Slug string `json:"slug,omitempty"`
+}
+
+type APIAdminSessionRequest struct {
+	Email         string `json:"email,omitempty"`
+	AdminPassword string `json:"adminPassword"`
+}
+
+type APIRoomAdmin struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email,omitempty"`
+	Pending   bool      `json:"pending"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type APIRoomAdminRequest struct {
+	Email string `json:"email"`
+}
+
+type APIParticipantSessionRequest struct {
+	Name                string `json:"name"`
+	ParticipantPassword string `json:"participantPassword"`
+}
+
+type APIVisibilityRequest struct {
+	Visibility string `json:"visibility"`
+}
+
+type APIRegistrationRequest struct {
+	RequireApproval bool `json:"requireApproval"`
+	MaxParticipants int  `json:"maxParticipants"`
+}
+
+type APIInvitationsRequest struct {
+	Emails        []string `json:"emails"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+type APIInvitationsResponse struct {
+	Sent int `json:"sent"`
+}
+
+// APIOperation describes one /api/v1 endpoint; the same table registers the routes and generates the OpenAPI document.
+type APIOperation struct {
+	Method        string
+	Path          string
+	Summary       string
+	Auth          string
+	Request       interface{}
+	Response      interface{}
+	SuccessStatus int
+	Handler       fiber.Handler
+}
+
+type Webhook struct {
+	ID        int       `db:"id"`
+	RoomID    int       `db:"room_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID             int       `db:"id"`
+	WebhookID      int       `db:"webhook_id"`
+	Event          string    `db:"event"`
+	Payload        string    `db:"payload"`
+	Attempts       int       `db:"attempts"`
+	Delivered      bool      `db:"delivered"`
+	LastStatusCode int       `db:"last_status_code"`
+	LastError      string    `db:"last_error"`
+	NextAttemptAt  time.Time `db:"next_attempt_at"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+type WebhookEvent struct {
+	Event      string                 `json:"event"`
+	RoomID     int                    `json:"roomId"`
+	OccurredAt time.Time              `json:"occurredAt"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// WebhookDispatcher queues room events for every webhook of the room and delivers them with retries.
+type WebhookDispatcher struct {
+	db            *sqlx.DB
+	encryptionKey []byte
+	client        *http.Client
+}
+
+type WebhookWithSecret struct {
+	Webhook
+	PlainSecret string
+}
+
+// Notifier fans room events out to the channels configured for the room: email, chat and webhooks.
+type Notifier struct {
+	db            *sqlx.DB
+	encryptionKey []byte
+	email         EmailConfig
+	client        *http.Client
+	slackAPIURL   string
+	webhooks      *WebhookDispatcher
+
+	sendAssignmentEmail func(EmailConfig, Assignment) error
+}
+
+// ChatSettingsFormData leaves the saved bot token alone when BotToken is blank, unless ClearBotToken is set.
+type ChatSettingsFormData struct {
+	Platform      string `form:"chatPlatform"`
+	WebhookURL    string `form:"chatWebhookURL"`
+	BotToken      string `form:"chatBotToken"`
+	ClearBotToken bool   `form:"clearChatBotToken"`
+}
+
+type ReminderConfig struct {
+	AdminDaysBeforeDeadline int
+	GiverDaysBeforeExchange int
+	AdminTemplateID         string
+	GiverTemplateID         string
+}
+
+// RetentionConfig controls when the scheduler purges personal data from finished rooms.
+type RetentionConfig struct {
+	// Zero keeps personal data forever
+	DaysAfterExchange int
+}
+
+// RetentionCandidate is a room whose personal data is past the retention period.
+type RetentionCandidate struct {
+	ID               int       `db:"id"`
+	Name             string    `db:"name"`
+	ExchangeDate     time.Time `db:"exchange_date"`
+	ParticipantCount int       `db:"participant_count"`
+	AssignmentCount  int       `db:"assignment_count"`
+	InviteCount      int       `db:"invite_count"`
+}
+
+type EmailConfig struct {
+	APIKey                      string
+	From                        string
+	AssignmentTemplateID        string
+	InviteTemplateID            string
+	SetPasswordTemplateID       string
+	AdminPasswordTemplateID     string
+	ParticipantLeftTemplateID   string
+	MagicLinkTemplateID         string
+	ParticipantStatusTemplateID string
+	// Counts emails sent and failed; set by runServe rather than parsed from the configuration
+	metrics *Metrics
+}
+
+type SessionConfig struct {
+	Storage      string
+	Expiration   time.Duration
+	CookieSecure bool
+}
+
+// PostgresSessionStorage implements fiber.Storage on the session_store table so sessions survive restarts and are shared between instances.
+type PostgresSessionStorage struct {
+	db *sqlx.DB
+}
+
+// PasswordFailureStats summarises one client's recent failed attempts against one password of a room.
+type PasswordFailureStats struct {
+	IPFailures int          `db:"ip_failures"`
+	IPLatest   sql.NullTime `db:"ip_latest"`
+}
+
+// LockoutEvent records a client being locked out of a room password. Events from before lockouts were
+// per client have an empty IPHash and applied to everyone.
+type LockoutEvent struct {
+	ID          int       `db:"id"`
+	RoomID      int       `db:"room_id"`
+	Scope       string    `db:"scope"`
+	IPHash      string    `db:"ip_hash"`
+	Failures    int       `db:"failures"`
+	LockedUntil time.Time `db:"locked_until"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// PasswordGuard throttles password checks after repeated failures from the same client or against the same room.
+type PasswordGuard struct {
+	db        *sqlx.DB
+	ipHashKey []byte
+	audit     *Auditor
+}
+
+// AuditEvent is one append-only audit_event row. Details is a JSON object that must never name who drew whom.
+type AuditEvent struct {
+	ID        int       `db:"id"`
+	RoomID    int       `db:"room_id"`
+	ActorType string    `db:"actor_type"`
+	Action    string    `db:"action"`
+	IPHash    string    `db:"ip_hash"`
+	Details   string    `db:"details"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Auditor writes audit events; a nil Auditor records nothing.
+type Auditor struct {
+	db        *sqlx.DB
+	ipHashKey []byte
+}
+
+// Logger writes leveled JSON log lines with PII redacted; With derives a logger carrying extra fields.
+type Logger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+// logSink is the destination and level shared by a logger and everything derived from it.
+type logSink struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level int
+}
+
+// backgroundTasks tracks fire-and-forget work, such as chat posts and webhook deliveries, so shutdown can wait for it.
+type backgroundTasks struct {
+	wg sync.WaitGroup
+}
+
+// Metrics holds the counters and gauges served on /metrics in the Prometheus text format. A nil registry,
+// as used by the CLI commands and tests, drops every update.
+type Metrics struct {
+	mu     sync.Mutex
+	values map[string]map[string]float64
+}
+
+type metricFamily struct {
+	Name string
+	Type string
+	Help string
+}
+
+// LockoutError is returned instead of checking a password while the client has to wait.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("too many failed attempts, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Config is every setting the binary reads, loaded and validated once at startup.
+type Config struct {
+	Port            string
+	LogLevel        int
+	ProxyHeader     string
+	MetricsToken    string
+	DatabaseURL     string
+	EncryptionKey   []byte
+	DefaultDeadline string
+	ShutdownTimeout time.Duration
+	Email           EmailConfig
+	Reminders       ReminderConfig
+	Retention       RetentionConfig
+	Session         SessionConfig
+}
+
+// ConfigError lists every problem found while validating the configuration.
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
 }
 
 /*
    ##### Data Access Layer
 */
 func dbSetupDatabaseSchema(db *sqlx.DB, config map[string]string) {
+	db.MustExec(schemaResetSQL)
+	db.MustExec(renderSchema(config))
+	db.MustExec(participantEmailUniqueIndexSQL)
+}
+
+// dbMigrateDatabaseSchema creates missing tables and columns without touching existing data.
+func dbMigrateDatabaseSchema(db *sqlx.DB, config map[string]string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(renderSchema(config)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(migrationsSQL); err != nil {
+		return err
+	}
+	if err := dbBackfillRoomSlugs(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// dbBackfillRoomSlugs gives rooms created before slugs existed their unguessable link.
+func dbBackfillRoomSlugs(tx *sqlx.Tx) error {
+	var roomIds []int
+	if err := tx.Select(&roomIds, `SELECT id FROM room WHERE slug = '' FOR UPDATE`); err != nil {
+		return err
+	}
+
+	for _, roomId := range roomIds {
+		slug, err := generateRoomSlug()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE room SET slug = $2 WHERE id = $1`, roomId, slug); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func renderSchema(config map[string]string) string {
 	tmpl, err := template.New("schema").Parse(schemaTemplate)
 	if err != nil {
-		log.Fatalf("Error parsing schema template: %v", err)
+		logger.Fatal("Error parsing schema template", "error", err)
 	}
 
 	var schemaBuffer bytes.Buffer
 	err = tmpl.Execute(&schemaBuffer, config)
 	if err != nil {
-		log.Fatalf("Error executing schema template: %v", err)
+		logger.Fatal("Error executing schema template", "error", err)
 	}
 
-	schema := schemaBuffer.String()
-	db.MustExec(schema)
+	return schemaBuffer.String()
 }
 
 func dbGetAllRooms(db *sqlx.DB) ([]RoomWithParticipantCount, error) {
@@ -130,7 +953,7 @@ func dbGetAllRooms(db *sqlx.DB) ([]RoomWithParticipantCount, error) {
 	query := `
     SELECT r.*, COUNT(p.id) as participant_count
     FROM room r
-    LEFT JOIN participant p ON r.id = p.room_id
+    LEFT JOIN participant p ON r.id = p.room_id AND p.status = 'approved'
     GROUP BY r.id
 	ORDER BY r.created_at DESC
     `
@@ -138,6 +961,32 @@ func dbGetAllRooms(db *sqlx.DB) ([]RoomWithParticipantCount, error) {
 	return rooms, err
 }
 
+func dbGetPublicRooms(db *sqlx.DB, limit int, offset int) ([]RoomWithParticipantCount, error) {
+	var rooms []RoomWithParticipantCount
+	query := `
+    SELECT r.*, COUNT(p.id) as participant_count
+    FROM room r
+    LEFT JOIN participant p ON r.id = p.room_id AND p.status = 'approved'
+    WHERE r.visibility = $1
+    GROUP BY r.id
+	ORDER BY r.created_at DESC
+    LIMIT $2 OFFSET $3
+    `
+	err := db.Select(&rooms, query, roomVisibilityPublic, limit, offset)
+	return rooms, err
+}
+
+func dbCountPublicRooms(db *sqlx.DB) (int, error) {
+	var count int
+	query := `
+    SELECT COUNT(*)
+    FROM room
+    WHERE visibility = $1
+    `
+	err := db.Get(&count, query, roomVisibilityPublic)
+	return count, err
+}
+
 func dbGetOneRoom(db *sqlx.DB, roomId int) (Room, error) {
 	var room Room
 	query := `
@@ -149,6 +998,17 @@ func dbGetOneRoom(db *sqlx.DB, roomId int) (Room, error) {
 	return room, err
 }
 
+func dbGetRoomBySlug(db *sqlx.DB, slug string) (Room, error) {
+	var room Room
+	query := `
+    SELECT *
+    FROM room
+    WHERE room.slug = $1 AND room.slug <> ''
+    `
+	err := db.Get(&room, query, slug)
+	return room, err
+}
+
 func dbGetParticipantsForRoom(db *sqlx.DB, roomId int) ([]Participant, error) {
 	var participants []Participant
 	query := `
@@ -160,57 +1020,236 @@ func dbGetParticipantsForRoom(db *sqlx.DB, roomId int) ([]Participant, error) {
 	return participants, err
 }
 
-func dbCreateNewRoom(db *sqlx.DB, data CreateRoomFormData) (int, error) {
-	hashedAdminPassword, err := hashString(data.AdminPassword)
-	if err != nil {
-		return -1, err
-	}
-
+// dbGetApprovedParticipantsForRoom lists the participants who take part in the draw.
+func dbGetApprovedParticipantsForRoom(db *sqlx.DB, roomId int) ([]Participant, error) {
+	var participants []Participant
+	query := `
+    SELECT *
+    FROM participant
+    WHERE participant.room_id = $1 AND participant.status = 'approved'
+    ORDER BY participant.id
+    `
+	err := db.Select(&participants, query, roomId)
+	return participants, err
+}
+
+// dbGetJoinRequestsForRoom lists participants waiting for approval or a free place, oldest first.
+func dbGetJoinRequestsForRoom(db *sqlx.DB, roomId int) ([]Participant, error) {
+	var participants []Participant
+	query := `
+    SELECT *
+    FROM participant
+    WHERE participant.room_id = $1 AND participant.status IN ('pending', 'waitlisted')
+    ORDER BY participant.created_at, participant.id
+    `
+	err := db.Select(&participants, query, roomId)
+	return participants, err
+}
+
+// isUniqueViolation reports whether err is Postgres rejecting a duplicate on the named constraint or index.
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
+func dbCreateNewRoom(db *sqlx.DB, data CreateRoomFormData, encryptionKey []byte) (int, error) {
+	hashedAdminPassword, err := hashString(data.AdminPassword)
+	if err != nil {
+		return -1, err
+	}
+
 	hashedJoinPassword, err := hashString(data.JoinPassword)
 	if err != nil {
 		return -1, err
 	}
 
 	deadline, err := time.Parse("2006-01-02T15:04", data.Deadline)
+	if err != nil {
+		return -1, errInvalidDeadline
+	}
+
+	var exchangeDate sql.NullTime
+	if data.ExchangeDate != "" {
+		exchangeDate.Time, err = time.Parse("2006-01-02T15:04", data.ExchangeDate)
+		if err != nil {
+			return -1, errInvalidExchangeDate
+		}
+		exchangeDate.Valid = true
+	}
+
+	if data.Visibility == "" {
+		data.Visibility = roomVisibilityPublic
+	}
+	if !isValidRoomVisibility(data.Visibility) {
+		return -1, errInvalidVisibility
+	}
+	if data.MaxParticipants < 0 {
+		return -1, errInvalidCapacity
+	}
+
+	var encryptedAdminEmail string
+	if data.AdminEmail != "" {
+		encryptedAdminEmail, err = encryptAES(encryptionKey, data.AdminEmail)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	slug, err := generateRoomSlug()
 	if err != nil {
 		return -1, err
 	}
 
-	query := `INSERT INTO room (name, join_password, admin_password, deadline) VALUES ($1, $2, $3, $4) RETURNING id`
+	query := `
+    INSERT INTO
+    room (
+        name,
+        join_password,
+        admin_password,
+        admin_email,
+        visibility,
+        deadline,
+        exchange_date,
+        require_approval,
+        max_participants,
+        slug
+    )
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+    RETURNING id
+    `
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
 
 	var roomId int
-	err = db.QueryRow(query, data.RoomName, hashedJoinPassword, hashedAdminPassword, deadline).Scan(&roomId)
+	err = tx.QueryRow(query, data.RoomName, hashedJoinPassword, hashedAdminPassword, encryptedAdminEmail, data.Visibility, deadline, exchangeDate, data.RequireApproval, data.MaxParticipants, slug).Scan(&roomId)
+	if isUniqueViolation(err, "room_name_key") {
+		return -1, errRoomNameTaken
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO room_admin (room_id, email, admin_password) VALUES ($1, $2, $3)`, roomId, encryptedAdminEmail, hashedAdminPassword)
 	if err != nil {
 		return -1, err
 	}
 
-	return roomId, nil
+	return roomId, tx.Commit()
 }
 
-func dbCreateNewParticipant(db *sqlx.DB, data CreateParticipantFormData, roomId int, encryptionKey []byte) (int, error) {
-	hashedParticipantPassword, err := hashString(data.ParticipantPassword)
+// dbCreateNewParticipant adds a joiner with the status the room's rules give them: pending when it needs
+// approval, waitlisted when it is full or others are already waiting, approved otherwise. The room row is
+// locked so concurrent joins cannot overfill it.
+func dbCreateNewParticipant(db *sqlx.DB, data CreateParticipantFormData, roomId int, encryptionKey []byte) (int, string, error) {
+	prepared, err := prepareParticipant(data, encryptionKey)
 	if err != nil {
-		return -1, err
+		return -1, "", err
 	}
 
-	encryptedEmail, err := encryptAES(encryptionKey, data.Email)
+	tx, err := db.Beginx()
 	if err != nil {
-		return -1, err
+		return -1, "", err
+	}
+	defer tx.Rollback()
+
+	var room struct {
+		RequireApproval bool `db:"require_approval"`
+		MaxParticipants int  `db:"max_participants"`
+	}
+	if err := tx.Get(&room, `SELECT require_approval, max_participants FROM room WHERE id = $1 FOR UPDATE`, roomId); err != nil {
+		return -1, "", err
+	}
+
+	var counts struct {
+		Approved   int `db:"approved"`
+		Waitlisted int `db:"waitlisted"`
+	}
+	query := `
+	SELECT COUNT(*) FILTER (WHERE status = 'approved') AS approved,
+		COUNT(*) FILTER (WHERE status = 'waitlisted') AS waitlisted
+	FROM participant
+	WHERE room_id = $1
+	`
+	if err := tx.Get(&counts, query, roomId); err != nil {
+		return -1, "", err
 	}
+	status := joinStatus(room.RequireApproval, room.MaxParticipants, counts.Approved, counts.Waitlisted)
 
+	participantId, err := dbInsertParticipant(tx, prepared, roomId, status)
+	if err != nil {
+		return -1, "", err
+	}
+
+	return participantId, status, tx.Commit()
+}
+
+// joinStatus decides where a new joiner goes: pending when the organizer approves joiners, waitlisted when
+// the room is full or others are already waiting, so nobody jumps the queue, and approved otherwise. A
+// maxParticipants of 0 means no limit.
+func joinStatus(requireApproval bool, maxParticipants int, approved int, waitlisted int) string {
+	if requireApproval {
+		return participantStatusPending
+	}
+	if maxParticipants > 0 && (approved >= maxParticipants || waitlisted > 0) {
+		return participantStatusWaitlisted
+	}
+	return participantStatusApproved
+}
+
+// preparedParticipant is a new participant with their password hashed and email encrypted, done before
+// any transaction opens so bcrypt never runs while rows are locked.
+type preparedParticipant struct {
+	CreateParticipantFormData
+	HashedPassword string
+	EncryptedEmail string
+	EmailHash      string
+}
+
+// prepareParticipant hashes and encrypts a new participant's secrets. An empty password is stored as an
+// empty hash, which no password matches, for participants who set theirs through an emailed link.
+func prepareParticipant(data CreateParticipantFormData, encryptionKey []byte) (preparedParticipant, error) {
+	prepared := preparedParticipant{CreateParticipantFormData: data, EmailHash: emailIndex(encryptionKey, data.Email)}
+
+	var err error
+	if data.ParticipantPassword != "" {
+		prepared.HashedPassword, err = hashString(data.ParticipantPassword)
+		if err != nil {
+			return prepared, err
+		}
+	}
+
+	prepared.EncryptedEmail, err = encryptAES(encryptionKey, data.Email)
+	return prepared, err
+}
+
+func dbInsertParticipant(q sqlx.Queryer, data preparedParticipant, roomId int, status string) (int, error) {
 	var participantId int
 	query := `
     INSERT INTO 
     participant (
         room_id,
         email,
+        email_hash,
         name,
-        participant_password
+        participant_password,
+        exclusion_group,
+        wishlist,
+        status
     )
-    VALUES ($1, $2, $3, $4)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
     RETURNING id
     `
-	err = db.QueryRow(query, roomId, encryptedEmail, data.Name, hashedParticipantPassword).Scan(&participantId)
+	err := q.QueryRowx(query, roomId, data.EncryptedEmail, data.EmailHash, data.Name, data.HashedPassword, data.ExclusionGroup, data.Wishlist, status).Scan(&participantId)
+	if isUniqueViolation(err, participantEmailUniqueIndex) {
+		return -1, errEmailTaken
+	}
+	if isUniqueViolation(err, participantNameUniqueConstraint) {
+		return -1, errNameTaken
+	}
 	if err != nil {
 		return -1, err
 	}
@@ -218,456 +1257,7864 @@ func dbCreateNewParticipant(db *sqlx.DB, data CreateParticipantFormData, roomId
 	return participantId, nil
 }
 
-func dbGetJoinPasswordForRoom(db *sqlx.DB, roomId int) (string, error) {
-	var storedPasswordHash string
+// dbImportParticipants creates all participants in a single transaction, returning their IDs in order.
+func dbImportParticipants(db *sqlx.DB, participants []CreateParticipantFormData, roomId int, encryptionKey []byte) ([]int, error) {
+	prepared := make([]preparedParticipant, len(participants))
+	for i, data := range participants {
+		var err error
+		prepared[i], err = prepareParticipant(data, encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("participant %s: %w", data.Name, err)
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	participantIds := make([]int, len(participants))
+	for i, data := range prepared {
+		// Imports are the organizer's own choice, so they skip approval and the capacity limit
+		participantIds[i], err = dbInsertParticipant(tx, data, roomId, participantStatusApproved)
+		if err != nil {
+			return nil, fmt.Errorf("participant %s: %w", data.Name, err)
+		}
+	}
+
+	return participantIds, tx.Commit()
+}
+
+func dbGetOneParticipant(db *sqlx.DB, participantId int) (Participant, error) {
+	var participant Participant
 	query := `
-    SELECT join_password
-    FROM room
+    SELECT *
+    FROM participant
     WHERE id = $1
     `
+	err := db.Get(&participant, query, participantId)
+	return participant, err
+}
 
-	err := db.Get(&storedPasswordHash, query, roomId)
+func dbSetParticipantPassword(db *sqlx.DB, participantId int, password string) error {
+	hashedParticipantPassword, err := hashString(password)
 	if err != nil {
-		return "", nil
+		return err
+	}
+
+	query := `
+	UPDATE participant
+	SET participant_password = $2
+	WHERE id = $1
+	`
+
+	_, err = db.Exec(query, participantId, hashedParticipantPassword)
+	return err
+}
+
+func dbGetAdminsForRoom(db *sqlx.DB, roomId int) ([]RoomAdmin, error) {
+	var admins []RoomAdmin
+	query := `
+    SELECT *
+    FROM room_admin
+    WHERE room_id = $1
+    ORDER BY id
+    `
+
+	err := db.Select(&admins, query, roomId)
+	return admins, err
+}
+
+func dbGetOneRoomAdmin(db *sqlx.DB, adminId int) (RoomAdmin, error) {
+	var admin RoomAdmin
+	query := `
+    SELECT *
+    FROM room_admin
+    WHERE id = $1
+    `
+
+	err := db.Get(&admin, query, adminId)
+	return admin, err
+}
+
+// dbCreateRoomAdmin adds an organizer without a password; they choose one from the emailed link.
+func dbCreateRoomAdmin(db *sqlx.DB, roomId int, email string, encryptionKey []byte) (RoomAdmin, error) {
+	encryptedEmail, err := encryptAES(encryptionKey, email)
+	if err != nil {
+		return RoomAdmin{}, err
+	}
+
+	var admin RoomAdmin
+	query := `
+    INSERT INTO room_admin (room_id, email)
+    VALUES ($1, $2)
+    RETURNING *
+    `
+
+	err = db.Get(&admin, query, roomId, encryptedEmail)
+	return admin, err
+}
+
+func dbSetAdminPassword(db *sqlx.DB, adminId int, password string) error {
+	hashedAdminPassword, err := hashString(password)
+	if err != nil {
+		return err
 	}
 
-	return storedPasswordHash, nil
+	query := `
+	UPDATE room_admin
+	SET admin_password = $2
+	WHERE id = $1
+	`
+
+	_, err = db.Exec(query, adminId, hashedAdminPassword)
+	return err
 }
 
-func dbSetRoomToDrawCompleted(db *sqlx.DB, roomId int) error {
+func dbSetRoomVisibility(db *sqlx.DB, roomId int, visibility string) error {
 	query := `
 	UPDATE room
-	SET draw_completed = TRUE
+	SET visibility = $2
 	WHERE id = $1
 	`
 
-	_, err := db.Exec(query, roomId)
+	_, err := db.Exec(query, roomId, visibility)
 
 	return err
 }
 
-/*
-   ##### Handlers
-*/
-func handleGetIndex(db *sqlx.DB) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		rooms, err := dbGetAllRooms(db)
+func dbSetRoomChatSettings(db *sqlx.DB, roomId int, platform string, encryptedWebhookURL string, encryptedBotToken string) error {
+	query := `
+	UPDATE room
+	SET chat_platform = $2, chat_webhook_url = $3, chat_bot_token = $4
+	WHERE id = $1
+	`
+
+	_, err := db.Exec(query, roomId, platform, encryptedWebhookURL, encryptedBotToken)
+
+	return err
+}
+
+// dbSaveDraw stores the assignments and marks the room drawn in one transaction. It returns false and saves
+// nothing when the room was already drawn, so a draw is persisted exactly once however many runs attempt it.
+func dbSaveDraw(db *sqlx.DB, roomId int, assignments []Assignment) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var drawn bool
+	if err := tx.Get(&drawn, `SELECT draw_completed FROM room WHERE id = $1 FOR UPDATE`, roomId); err != nil {
+		return false, err
+	}
+	if drawn {
+		return false, nil
+	}
+
+	query := `
+	INSERT INTO assignment (room_id, participant_id, giftee_id)
+	VALUES ($1, $2, $3)
+	`
 
+	for _, assignment := range assignments {
+		_, err = tx.Exec(query, roomId, assignment.Participant.ID, assignment.GifteeID)
 		if err != nil {
-			log.Println("Error fetching rooms:", err)
-			return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+			return false, err
 		}
+	}
 
-		return c.Render("index", fiber.Map{
-			"Title": "Titkowos Mikuwulás Főoldal",
-			"Rooms": rooms,
-		})
+	if _, err := tx.Exec(`UPDATE room SET draw_completed = TRUE WHERE id = $1`, roomId); err != nil {
+		return false, err
 	}
+
+	return true, tx.Commit()
 }
 
-func handleGetCreateRoom(defaultDeadline string) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		return c.Render("create-room", fiber.Map{
-			"DefaultDeadline": defaultDeadline,
+// dbClaimAssignmentNotification marks an assignment as being sent, returning false if another run already did.
+// A claim older than assignmentClaimTimeout whose send was never confirmed can be claimed again.
+func dbClaimAssignmentNotification(db *sqlx.DB, roomId int, participantId int, now time.Time) (bool, error) {
+	query := `
+	UPDATE assignment
+	SET notified_at = $3, sent_at = NULL
+	WHERE room_id = $1 AND participant_id = $2
+	AND (notified_at IS NULL OR (sent_at IS NULL AND notified_at < $4))
+	`
+
+	result, err := db.Exec(query, roomId, participantId, now, now.Add(-assignmentClaimTimeout))
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// dbReleaseAssignmentNotification undoes a claim whose send failed so the next run retries it.
+func dbReleaseAssignmentNotification(db *sqlx.DB, roomId int, participantId int) error {
+	query := `
+	UPDATE assignment
+	SET notified_at = NULL
+	WHERE room_id = $1 AND participant_id = $2
+	`
+
+	_, err := db.Exec(query, roomId, participantId)
+	return err
+}
+
+// dbConfirmAssignmentNotification records that a claimed assignment was delivered.
+func dbConfirmAssignmentNotification(db *sqlx.DB, roomId int, participantId int, now time.Time) error {
+	query := `
+	UPDATE assignment
+	SET sent_at = $3
+	WHERE room_id = $1 AND participant_id = $2
+	`
+
+	_, err := db.Exec(query, roomId, participantId, now)
+	return err
+}
+
+// dbHasUnnotifiedAssignments reports whether the room has assignments never claimed, or claimed and left unsent, see assignmentNeedsSending.
+func dbHasUnnotifiedAssignments(db *sqlx.DB, roomId int, now time.Time) (bool, error) {
+	var pending bool
+	query := `
+	SELECT EXISTS (
+		SELECT 1 FROM assignment
+		WHERE room_id = $1
+		AND (notified_at IS NULL OR (sent_at IS NULL AND notified_at < $2))
+	)
+	`
+	err := db.Get(&pending, query, roomId, now.Add(-assignmentClaimTimeout))
+	return pending, err
+}
+
+func dbGetAssignmentsForRoom(db *sqlx.DB, roomId int) ([]Assignment, error) {
+	participants, err := dbGetParticipantsForRoom(db, roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs []struct {
+		ParticipantID int          `db:"participant_id"`
+		GifteeID      int          `db:"giftee_id"`
+		NotifiedAt    sql.NullTime `db:"notified_at"`
+		SentAt        sql.NullTime `db:"sent_at"`
+	}
+	query := `
+	SELECT participant_id, giftee_id, notified_at, sent_at
+	FROM assignment
+	WHERE room_id = $1
+	`
+	err = db.Select(&pairs, query, roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	participantsById := make(map[int]Participant, len(participants))
+	for _, p := range participants {
+		participantsById[p.ID] = p
+	}
+
+	assignments := make([]Assignment, 0, len(pairs))
+	for _, pair := range pairs {
+		assignments = append(assignments, Assignment{
+			Participant: participantsById[pair.ParticipantID],
+			GifteeID:    pair.GifteeID,
+			GifteeName:  participantsById[pair.GifteeID].Name,
+			NotifiedAt:  pair.NotifiedAt,
+			SentAt:      pair.SentAt,
 		})
 	}
-}
 
-func handlePostCreateRoom(db *sqlx.DB) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		var data CreateRoomFormData
-		if err := c.BodyParser(&data); err != nil {
-			log.Println("Error parsing form:", err)
-			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Error parsing form data: %s", err))
-		}
+	return assignments, nil
+}
+
+// dbClaimReminder records a reminder as sent, returning false if it already was.
+func dbClaimReminder(db *sqlx.DB, roomId int, kind string, participantId int) (bool, error) {
+	query := `
+	INSERT INTO sent_reminder (room_id, kind, participant_id)
+	VALUES ($1, $2, $3)
+	ON CONFLICT DO NOTHING
+	`
+
+	result, err := db.Exec(query, roomId, kind, participantId)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func dbReleaseReminder(db *sqlx.DB, roomId int, kind string, participantId int) error {
+	query := `
+	DELETE FROM sent_reminder
+	WHERE room_id = $1 AND kind = $2 AND participant_id = $3
+	`
+
+	_, err := db.Exec(query, roomId, kind, participantId)
+	return err
+}
+
+func dbCreateInvite(db *sqlx.DB, roomId int, email string, maxUses int, expiresAt time.Time, encryptionKey []byte) (Invite, error) {
+	var invite Invite
+
+	var encryptedEmail string
+	if email != "" {
+		var err error
+		encryptedEmail, err = encryptAES(encryptionKey, email)
+		if err != nil {
+			return invite, err
+		}
+	}
+
+	query := `
+	INSERT INTO invite (room_id, email, max_uses, expires_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING *
+	`
+
+	err := db.Get(&invite, query, roomId, encryptedEmail, maxUses, expiresAt)
+	return invite, err
+}
+
+func dbGetInvitesForRoom(db *sqlx.DB, roomId int) ([]Invite, error) {
+	var invites []Invite
+	query := `
+	SELECT *
+	FROM invite
+	WHERE room_id = $1
+	ORDER BY created_at DESC
+	`
+	err := db.Select(&invites, query, roomId)
+	return invites, err
+}
+
+func dbGetOneInvite(db *sqlx.DB, inviteId int) (Invite, error) {
+	var invite Invite
+	query := `
+	SELECT *
+	FROM invite
+	WHERE id = $1
+	`
+	err := db.Get(&invite, query, inviteId)
+	return invite, err
+}
+
+// dbConsumeInvite uses up one invite use, returning false if the invite is expired or exhausted.
+func dbConsumeInvite(db *sqlx.DB, inviteId int, now time.Time) (bool, error) {
+	query := `
+	UPDATE invite
+	SET uses = uses + 1
+	WHERE id = $1 AND uses < max_uses AND expires_at > $2
+	`
+
+	result, err := db.Exec(query, inviteId, now)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+func dbReleaseInvite(db *sqlx.DB, inviteId int) error {
+	query := `
+	UPDATE invite
+	SET uses = uses - 1
+	WHERE id = $1 AND uses > 0
+	`
+
+	_, err := db.Exec(query, inviteId)
+	return err
+}
+
+func dbCreateRoomExportRecord(db *sqlx.DB, roomId int, format string, includeAssignments bool) error {
+	query := `
+	INSERT INTO room_export (room_id, format, include_assignments)
+	VALUES ($1, $2, $3)
+	`
+
+	_, err := db.Exec(query, roomId, format, includeAssignments)
+	return err
+}
+
+func dbGetRoomExportRecords(db *sqlx.DB, roomId int) ([]RoomExportRecord, error) {
+	var records []RoomExportRecord
+	query := `
+	SELECT *
+	FROM room_export
+	WHERE room_id = $1
+	ORDER BY created_at DESC
+	`
+	err := db.Select(&records, query, roomId)
+	return records, err
+}
+
+func dbCreateWebhook(db *sqlx.DB, roomId int, url string, encryptedSecret string) (int, error) {
+	var webhookId int
+	query := `
+	INSERT INTO webhook (room_id, url, secret)
+	VALUES ($1, $2, $3)
+	RETURNING id
+	`
+	err := db.QueryRow(query, roomId, url, encryptedSecret).Scan(&webhookId)
+	return webhookId, err
+}
+
+func dbGetWebhooksForRoom(db *sqlx.DB, roomId int) ([]Webhook, error) {
+	var webhooks []Webhook
+	query := `
+	SELECT *
+	FROM webhook
+	WHERE room_id = $1
+	ORDER BY created_at
+	`
+	err := db.Select(&webhooks, query, roomId)
+	return webhooks, err
+}
+
+func dbGetOneWebhook(db *sqlx.DB, webhookId int) (Webhook, error) {
+	var webhook Webhook
+	query := `
+	SELECT *
+	FROM webhook
+	WHERE id = $1
+	`
+	err := db.Get(&webhook, query, webhookId)
+	return webhook, err
+}
+
+func dbDeleteWebhook(db *sqlx.DB, roomId int, webhookId int) error {
+	query := `
+	DELETE FROM webhook
+	WHERE id = $1 AND room_id = $2
+	`
+	_, err := db.Exec(query, webhookId, roomId)
+	return err
+}
+
+// dbQueueWebhookDeliveries creates a pending delivery of the event for every webhook of the room.
+func dbQueueWebhookDeliveries(db *sqlx.DB, roomId int, event string, payload string, now time.Time) error {
+	query := `
+	INSERT INTO webhook_delivery (webhook_id, event, payload, next_attempt_at)
+	SELECT id, $2, $3, $4
+	FROM webhook
+	WHERE room_id = $1
+	`
+	_, err := db.Exec(query, roomId, event, payload, now)
+	return err
+}
+
+// dbClaimDueWebhookDeliveries leases up to limit due deliveries so concurrent workers never send the same one.
+func dbClaimDueWebhookDeliveries(db *sqlx.DB, now time.Time, leaseUntil time.Time, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	query := `
+	UPDATE webhook_delivery
+	SET next_attempt_at = $2
+	WHERE id IN (
+		SELECT id
+		FROM webhook_delivery
+		WHERE delivered = FALSE AND attempts < $3 AND next_attempt_at <= $1
+		ORDER BY id
+		LIMIT $4
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING *
+	`
+	err := db.Select(&deliveries, query, now, leaseUntil, webhookMaxAttempts, limit)
+	return deliveries, err
+}
+
+func dbRecordWebhookAttempt(db *sqlx.DB, deliveryId int, delivered bool, statusCode int, lastError string, nextAttemptAt time.Time) error {
+	query := `
+	UPDATE webhook_delivery
+	SET attempts = attempts + 1,
+		delivered = $2,
+		last_status_code = $3,
+		last_error = $4,
+		next_attempt_at = $5
+	WHERE id = $1
+	`
+	_, err := db.Exec(query, deliveryId, delivered, statusCode, lastError, nextAttemptAt)
+	return err
+}
+
+func dbGetWebhookDeliveriesForRoom(db *sqlx.DB, roomId int, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	query := `
+	SELECT d.*
+	FROM webhook_delivery d
+	JOIN webhook w ON w.id = d.webhook_id
+	WHERE w.room_id = $1
+	ORDER BY d.created_at DESC
+	LIMIT $2
+	`
+	err := db.Select(&deliveries, query, roomId, limit)
+	return deliveries, err
+}
+
+// dbPurgeRoom deletes a room and everything that belongs to it.
+func dbPurgeRoom(db *sqlx.DB, roomId int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM webhook_delivery WHERE webhook_id IN (SELECT id FROM webhook WHERE room_id = $1)`,
+		`DELETE FROM webhook WHERE room_id = $1`,
+		`DELETE FROM password_failure WHERE room_id = $1`,
+		`DELETE FROM lockout_event WHERE room_id = $1`,
+		`DELETE FROM email_request WHERE room_id = $1`,
+		`DELETE FROM room_export WHERE room_id = $1`,
+		`DELETE FROM invite WHERE room_id = $1`,
+		`DELETE FROM sent_reminder WHERE room_id = $1`,
+		`DELETE FROM assignment WHERE room_id = $1`,
+		`DELETE FROM participant WHERE room_id = $1`,
+		`DELETE FROM room_admin WHERE room_id = $1`,
+		`DELETE FROM room WHERE id = $1`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, roomId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// dbCountRoomsByState counts rooms as open, awaiting_draw (deadline passed), drawn or purged.
+func dbCountRoomsByState(db *sqlx.DB, now time.Time) (map[string]int, error) {
+	var rows []struct {
+		State string `db:"state"`
+		Count int    `db:"count"`
+	}
+	query := `
+	SELECT
+		CASE
+			WHEN purged_at IS NOT NULL THEN 'purged'
+			WHEN draw_completed THEN 'drawn'
+			WHEN deadline < $1 THEN 'awaiting_draw'
+			ELSE 'open'
+		END AS state,
+		COUNT(*) AS count
+	FROM room
+	GROUP BY state
+	`
+	if err := db.Select(&rows, query, now); err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{"open": 0, "awaiting_draw": 0, "drawn": 0, "purged": 0}
+	for _, row := range rows {
+		counts[row.State] = row.Count
+	}
+	return counts, nil
+}
+
+// dbGetRoomsDueForRetention lists unpurged rooms whose exchange, or deadline when no exchange date was set, is before the cutoff.
+func dbGetRoomsDueForRetention(db *sqlx.DB, cutoff time.Time) ([]RetentionCandidate, error) {
+	var candidates []RetentionCandidate
+	query := `
+	SELECT r.id, r.name, COALESCE(r.exchange_date, r.deadline) AS exchange_date,
+		(SELECT COUNT(*) FROM participant p WHERE p.room_id = r.id) AS participant_count,
+		(SELECT COUNT(*) FROM assignment a WHERE a.room_id = r.id) AS assignment_count,
+		(SELECT COUNT(*) FROM invite i WHERE i.room_id = r.id) AS invite_count
+	FROM room r
+	WHERE r.purged_at IS NULL AND COALESCE(r.exchange_date, r.deadline) < $1
+	ORDER BY r.id
+	`
+	err := db.Select(&candidates, query, cutoff)
+	return candidates, err
+}
+
+// dbPurgeRoomPersonalData deletes participants, assignments and everything pointing at them, keeping the room
+// row with its participant count. Webhook deliveries go too, since their payloads name participants; the
+// webhooks themselves stay. Admin emails are blanked; audit events hold no personal data and stay.
+func dbPurgeRoomPersonalData(db *sqlx.DB, roomId int, now time.Time) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE room
+	SET purged_at = $2, admin_email = '',
+		purged_participant_count = (SELECT COUNT(*) FROM participant WHERE room_id = $1 AND status = 'approved')
+	WHERE id = $1 AND purged_at IS NULL
+	`
+	result, err := tx.Exec(query, roomId, now)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		// Already purged by another run
+		return err
+	}
+
+	queries := []string{
+		`DELETE FROM webhook_delivery WHERE webhook_id IN (SELECT id FROM webhook WHERE room_id = $1)`,
+		`DELETE FROM password_failure WHERE room_id = $1`,
+		`DELETE FROM lockout_event WHERE room_id = $1`,
+		`DELETE FROM email_request WHERE room_id = $1`,
+		`DELETE FROM invite WHERE room_id = $1`,
+		`DELETE FROM sent_reminder WHERE room_id = $1`,
+		`DELETE FROM assignment WHERE room_id = $1`,
+		`DELETE FROM participant WHERE room_id = $1`,
+		`UPDATE room_admin SET email = '' WHERE room_id = $1`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, roomId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// encryptedColumns lists every column holding encryptAES ciphertext, as table and column pairs.
+var encryptedColumns = [][2]string{
+	{"room", "admin_email"},
+	{"room", "chat_webhook_url"},
+	{"room", "chat_bot_token"},
+	{"room_admin", "email"},
+	{"participant", "email"},
+	{"invite", "email"},
+	{"webhook", "secret"},
+}
+
+// dbRotateEncryptionKey re-encrypts every encrypted column from oldKey to newKey in one transaction.
+func dbRotateEncryptionKey(db *sqlx.DB, oldKey []byte, newKey []byte) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rotated := 0
+	for _, column := range encryptedColumns {
+		var rows []struct {
+			ID    int    `db:"id"`
+			Value string `db:"value"`
+		}
+		query := fmt.Sprintf(`SELECT id, %s AS value FROM %s WHERE %s <> '' FOR UPDATE`, column[1], column[0], column[1])
+		if err := tx.Select(&rows, query); err != nil {
+			return 0, err
+		}
+
+		update := fmt.Sprintf(`UPDATE %s SET %s = $2 WHERE id = $1`, column[0], column[1])
+		for _, row := range rows {
+			plaintext, err := decryptAES(oldKey, row.Value)
+			if err != nil {
+				return 0, fmt.Errorf("decrypting %s.%s of row %d: %w", column[0], column[1], row.ID, err)
+			}
+
+			ciphertext, err := encryptAES(newKey, plaintext)
+			if err != nil {
+				return 0, err
+			}
+
+			if _, err := tx.Exec(update, row.ID, ciphertext); err != nil {
+				return 0, err
+			}
+			rotated++
+		}
+	}
+
+	// The email index is keyed too, so lookups keep working under the new key
+	if _, err := dbRebuildEmailIndex(tx, newKey); err != nil {
+		return 0, err
+	}
+
+	return rotated, tx.Commit()
+}
+
+func (s *PostgresSessionStorage) Get(key string) ([]byte, error) {
+	var data []byte
+	query := `
+	SELECT data
+	FROM session_store
+	WHERE key = $1 AND (expires_at IS NULL OR expires_at > $2)
+	`
+
+	err := s.db.Get(&data, query, key, time.Now().UTC())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *PostgresSessionStorage) Set(key string, val []byte, exp time.Duration) error {
+	if key == "" || len(val) == 0 {
+		return nil
+	}
+
+	var expiresAt sql.NullTime
+	if exp > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().UTC().Add(exp), Valid: true}
+	}
+
+	query := `
+	INSERT INTO session_store (key, data, expires_at)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (key) DO UPDATE SET data = EXCLUDED.data, expires_at = EXCLUDED.expires_at
+	`
+
+	_, err := s.db.Exec(query, key, val, expiresAt)
+	return err
+}
+
+func (s *PostgresSessionStorage) Delete(key string) error {
+	_, err := s.db.Exec(`DELETE FROM session_store WHERE key = $1`, key)
+	return err
+}
+
+func (s *PostgresSessionStorage) Reset() error {
+	_, err := s.db.Exec(`DELETE FROM session_store`)
+	return err
+}
+
+// Close is a no-op because the connection pool is shared with the rest of the app.
+func (s *PostgresSessionStorage) Close() error {
+	return nil
+}
+
+func dbDeleteExpiredSessions(db *sqlx.DB, now time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM session_store WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// dbGetPasswordFailureStats counts the client's failures other than the attempt excludeId, which includes
+// attempts still being verified.
+func dbGetPasswordFailureStats(db *sqlx.DB, roomId int, scope string, ipHash string, since time.Time, excludeId int) (PasswordFailureStats, error) {
+	var stats PasswordFailureStats
+	query := `
+	SELECT COUNT(*) AS ip_failures, MAX(created_at) AS ip_latest
+	FROM password_failure
+	WHERE room_id = $1 AND scope = $2 AND ip_hash = $3 AND created_at > $4 AND id <> $5
+	`
+
+	err := db.Get(&stats, query, roomId, scope, ipHash, since, excludeId)
+	return stats, err
+}
+
+// dbRecordPasswordAttempt stores an attempt as a failure before its password is checked; see PasswordGuard.Check.
+func dbRecordPasswordAttempt(db *sqlx.DB, roomId int, scope string, ipHash string, now time.Time) (int, error) {
+	var attemptId int
+	query := `
+	INSERT INTO password_failure (room_id, scope, ip_hash, created_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id
+	`
+
+	err := db.QueryRow(query, roomId, scope, ipHash, now).Scan(&attemptId)
+	return attemptId, err
+}
+
+// dbDeletePasswordAttempt forgets an attempt that was throttled or could not be checked.
+func dbDeletePasswordAttempt(db *sqlx.DB, attemptId int) error {
+	_, err := db.Exec(`DELETE FROM password_failure WHERE id = $1`, attemptId)
+	return err
+}
+
+// dbClearPasswordFailures forgets a client's failures once it gets the password right.
+func dbClearPasswordFailures(db *sqlx.DB, roomId int, scope string, ipHash string) error {
+	query := `
+	DELETE FROM password_failure
+	WHERE room_id = $1 AND scope = $2 AND ip_hash = $3
+	`
+
+	_, err := db.Exec(query, roomId, scope, ipHash)
+	return err
+}
+
+func dbDeletePasswordFailuresBefore(db *sqlx.DB, before time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM password_failure WHERE created_at <= $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// dbClaimEmailRequest records that a link of this kind is being emailed to the address, returning false if one
+// already was within emailRequestCooldown.
+func dbClaimEmailRequest(db *sqlx.DB, roomId int, kind string, emailHash string, now time.Time) (bool, error) {
+	query := `
+	INSERT INTO email_request (room_id, kind, email_hash, requested_at)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (room_id, kind, email_hash) DO UPDATE SET requested_at = EXCLUDED.requested_at
+	WHERE email_request.requested_at <= $5
+	`
+
+	result, err := db.Exec(query, roomId, kind, emailHash, now, now.Add(-emailRequestCooldown))
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+func dbDeleteEmailRequestsBefore(db *sqlx.DB, before time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM email_request WHERE requested_at <= $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func dbCreateLockoutEvent(db *sqlx.DB, event LockoutEvent) error {
+	query := `
+	INSERT INTO lockout_event (room_id, scope, ip_hash, failures, locked_until, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	_, err := db.Exec(query, event.RoomID, event.Scope, event.IPHash, event.Failures, event.LockedUntil, event.CreatedAt)
+	return err
+}
+
+func dbGetLockoutEventsForRoom(db *sqlx.DB, roomId int, limit int) ([]LockoutEvent, error) {
+	var events []LockoutEvent
+	query := `
+	SELECT *
+	FROM lockout_event
+	WHERE room_id = $1
+	ORDER BY created_at DESC
+	LIMIT $2
+	`
+	err := db.Select(&events, query, roomId, limit)
+	return events, err
+}
+
+func dbCreateAuditEvent(db *sqlx.DB, event AuditEvent) error {
+	query := `
+	INSERT INTO audit_event (room_id, actor_type, action, ip_hash, details, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	_, err := db.Exec(query, event.RoomID, event.ActorType, event.Action, event.IPHash, event.Details, event.CreatedAt)
+	return err
+}
+
+// dbGetAuditEventsForRoom returns the newest events first; a limit of 0 returns all of them.
+func dbGetAuditEventsForRoom(db *sqlx.DB, roomId int, limit int) ([]AuditEvent, error) {
+	var events []AuditEvent
+	query := `
+	SELECT *
+	FROM audit_event
+	WHERE room_id = $1
+	ORDER BY created_at DESC, id DESC
+	LIMIT NULLIF($2, 0)
+	`
+	err := db.Select(&events, query, roomId, limit)
+	return events, err
+}
+
+func dbGetRemindersForParticipant(db *sqlx.DB, roomId int, participantId int) ([]ParticipantReminder, error) {
+	reminders := []ParticipantReminder{}
+	query := `
+	SELECT kind, sent_at
+	FROM sent_reminder
+	WHERE room_id = $1 AND participant_id = $2
+	ORDER BY sent_at
+	`
+	err := db.Select(&reminders, query, roomId, participantId)
+	return reminders, err
+}
+
+func dbGetAuditEventsForParticipant(db *sqlx.DB, roomId int, participantId int) ([]AuditEvent, error) {
+	var events []AuditEvent
+	query := `
+	SELECT *
+	FROM audit_event
+	WHERE room_id = $1 AND (details::jsonb ->> 'participantId') = $2::text
+	ORDER BY created_at, id
+	`
+	err := db.Select(&events, query, roomId, participantId)
+	return events, err
+}
+
+// dbEraseParticipant deletes a participant who is not part of a draw yet. Once they are in the
+// assignment cycle the row is anonymized instead, so everyone else keeps their giver and giftee.
+// Either way the invites in inviteIds, which were sent to the participant's address, are deleted, and so are
+// the webhook deliveries about them, whose payloads carry their name.
+func dbEraseParticipant(db *sqlx.DB, participantId int, anonymizedEmail string, inviteIds []int, now time.Time) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if len(inviteIds) > 0 {
+		if _, err := tx.Exec(`DELETE FROM invite WHERE id = ANY($1)`, pq.Array(inviteIds)); err != nil {
+			return false, err
+		}
+	}
+
+	// Lock the row so a draw running at the same time cannot slip an assignment in between
+	var roomId int
+	if err := tx.Get(&roomId, `SELECT room_id FROM participant WHERE id = $1 FOR UPDATE`, participantId); err != nil {
+		return false, err
+	}
+
+	deliveriesQuery := `
+	DELETE FROM webhook_delivery
+	WHERE webhook_id IN (SELECT id FROM webhook WHERE room_id = $1)
+	AND payload::jsonb -> 'data' ->> 'participantId' = $2
+	`
+	if _, err := tx.Exec(deliveriesQuery, roomId, strconv.Itoa(participantId)); err != nil {
+		return false, err
+	}
+
+	var drawn bool
+	query := `
+	SELECT EXISTS (
+		SELECT 1 FROM assignment WHERE participant_id = $1 OR giftee_id = $1
+	)
+	`
+	if err := tx.Get(&drawn, query, participantId); err != nil {
+		return false, err
+	}
+
+	if drawn {
+		query = `
+		UPDATE participant
+		SET email = $2, email_hash = '', name = $3, participant_password = '', exclusion_group = '', wishlist = '', erased_at = $4
+		WHERE id = $1
+		`
+		_, err = tx.Exec(query, participantId, anonymizedEmail, fmt.Sprintf("Former participant #%d", participantId), now)
+	} else {
+		if _, err := tx.Exec(`DELETE FROM sent_reminder WHERE room_id = $1 AND participant_id = $2`, roomId, participantId); err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(`DELETE FROM participant WHERE id = $1`, participantId)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return drawn, tx.Commit()
+}
+
+func dbUpdateParticipantProfile(db *sqlx.DB, participantId int, name string, encryptedEmail string, emailHash string) error {
+	query := `
+	UPDATE participant
+	SET name = $2, email = $3, email_hash = $4
+	WHERE id = $1
+	`
+
+	_, err := db.Exec(query, participantId, name, encryptedEmail, emailHash)
+	if isUniqueViolation(err, participantEmailUniqueIndex) {
+		return errEmailTaken
+	}
+	if isUniqueViolation(err, participantNameUniqueConstraint) {
+		return errNameTaken
+	}
+	return err
+}
+
+// dbUseMagicLink records a sign-in by link, returning false if the participant's last one is no longer lastUsedAt.
+func dbUseMagicLink(db *sqlx.DB, participantId int, lastUsedAt sql.NullTime, now time.Time) (bool, error) {
+	query := `
+	UPDATE participant
+	SET magic_link_used_at = $3
+	WHERE id = $1 AND magic_link_used_at IS NOT DISTINCT FROM $2
+	`
+
+	result, err := db.Exec(query, participantId, lastUsedAt, now)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// dbGetParticipantsByEmailHash finds the room's participants with the address behind an emailIndex hash.
+func dbGetParticipantsByEmailHash(db *sqlx.DB, roomId int, emailHash string) ([]Participant, error) {
+	var participants []Participant
+	query := `
+	SELECT *
+	FROM participant
+	WHERE room_id = $1 AND email_hash = $2 AND email_hash <> '' AND erased_at IS NULL
+	ORDER BY id
+	`
+
+	err := db.Select(&participants, query, roomId, emailHash)
+	return participants, err
+}
+
+// dbRebuildEmailIndex recomputes every participant's email_hash under the given key, which must be
+// the key their emails are encrypted with inside tx.
+func dbRebuildEmailIndex(tx *sqlx.Tx, encryptionKey []byte) (int, error) {
+	var rows []struct {
+		ID        int    `db:"id"`
+		Email     string `db:"email"`
+		EmailHash string `db:"email_hash"`
+	}
+	if err := tx.Select(&rows, `SELECT id, email, email_hash FROM participant WHERE email <> '' FOR UPDATE`); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, row := range rows {
+		email, err := decryptAES(encryptionKey, row.Email)
+		if err != nil {
+			return 0, fmt.Errorf("decrypting participant.email of row %d: %w", row.ID, err)
+		}
+
+		emailHash := emailIndex(encryptionKey, email)
+		if emailHash == row.EmailHash {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE participant SET email_hash = $2 WHERE id = $1`, row.ID, emailHash); err != nil {
+			return 0, err
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+// EmailDuplicate is a set of live participants of a room who share an address.
+type EmailDuplicate struct {
+	RoomID         int           `db:"room_id"`
+	ParticipantIDs pq.Int64Array `db:"participant_ids"`
+}
+
+// dbAddParticipantEmailUniqueIndex enforces one live participant per address and room, which needs
+// email_hash filled in. Participants who joined twice before it was enforced are returned instead, and the
+// index waits for a later migrate once they are resolved.
+func dbAddParticipantEmailUniqueIndex(tx *sqlx.Tx) ([]EmailDuplicate, error) {
+	var duplicates []EmailDuplicate
+	query := `
+	SELECT room_id, array_agg(id ORDER BY id) AS participant_ids
+	FROM participant
+	WHERE erased_at IS NULL AND email_hash <> ''
+	GROUP BY room_id, email_hash
+	HAVING COUNT(*) > 1
+	ORDER BY room_id
+	`
+	if err := tx.Select(&duplicates, query); err != nil {
+		return nil, err
+	}
+	if len(duplicates) > 0 {
+		return duplicates, nil
+	}
+
+	_, err := tx.Exec(participantEmailUniqueIndexSQL)
+	return nil, err
+}
+
+// dbApproveParticipant admits a pending or waitlisted participant, or puts them on the waitlist when the
+// room is full, returning their new status. It returns "" when they were not waiting or the room is drawn.
+func dbApproveParticipant(db *sqlx.DB, roomId int, participantId int) (string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var room struct {
+		DrawCompleted   bool `db:"draw_completed"`
+		MaxParticipants int  `db:"max_participants"`
+	}
+	if err := tx.Get(&room, `SELECT draw_completed, max_participants FROM room WHERE id = $1 FOR UPDATE`, roomId); err != nil {
+		return "", err
+	}
+	if room.DrawCompleted {
+		return "", nil
+	}
+
+	status := participantStatusApproved
+	if room.MaxParticipants > 0 {
+		var approved int
+		if err := tx.Get(&approved, `SELECT COUNT(*) FROM participant WHERE room_id = $1 AND status = 'approved'`, roomId); err != nil {
+			return "", err
+		}
+		if approved >= room.MaxParticipants {
+			status = participantStatusWaitlisted
+		}
+	}
+
+	query := `
+	UPDATE participant
+	SET status = $3
+	WHERE id = $1 AND room_id = $2 AND status IN ('pending', 'waitlisted') AND erased_at IS NULL
+	`
+	result, err := tx.Exec(query, participantId, roomId, status)
+	if err != nil {
+		return "", err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return "", err
+	}
+
+	return status, tx.Commit()
+}
+
+// dbRejectParticipant turns down a pending or waitlisted participant, returning false if they were not waiting.
+// The row stays, see verifyParticipantPassword.
+func dbRejectParticipant(db *sqlx.DB, roomId int, participantId int) (bool, error) {
+	query := `
+	UPDATE participant
+	SET status = 'rejected'
+	WHERE id = $1 AND room_id = $2 AND status IN ('pending', 'waitlisted') AND erased_at IS NULL
+	`
+	result, err := db.Exec(query, participantId, roomId)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// dbPromoteWaitlisted approves waitlisted participants, oldest first, while the room has free places and
+// has not been drawn, returning the IDs it promoted.
+func dbPromoteWaitlisted(db *sqlx.DB, roomId int) ([]int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var room struct {
+		DrawCompleted   bool `db:"draw_completed"`
+		MaxParticipants int  `db:"max_participants"`
+	}
+	if err := tx.Get(&room, `SELECT draw_completed, max_participants FROM room WHERE id = $1 FOR UPDATE`, roomId); err != nil {
+		return nil, err
+	}
+	if room.DrawCompleted {
+		return nil, nil
+	}
+
+	var approved int
+	if err := tx.Get(&approved, `SELECT COUNT(*) FROM participant WHERE room_id = $1 AND status = 'approved'`, roomId); err != nil {
+		return nil, err
+	}
+	var waitlisted []Participant
+	if err := tx.Select(&waitlisted, `SELECT * FROM participant WHERE room_id = $1 AND status = 'waitlisted'`, roomId); err != nil {
+		return nil, err
+	}
+
+	promoted := waitlistToPromote(waitlisted, room.MaxParticipants, approved)
+	if len(promoted) == 0 {
+		return nil, nil
+	}
+	query := `
+	UPDATE participant
+	SET status = 'approved'
+	WHERE id = ANY($1) AND status = 'waitlisted'
+	`
+	if _, err := tx.Exec(query, pq.Array(promoted)); err != nil {
+		return nil, err
+	}
+
+	return promoted, tx.Commit()
+}
+
+// waitlistToPromote picks the waitlisted participants that fit in the room's free places, in joining order.
+// A maxParticipants of 0 means no limit, so everyone is promoted.
+func waitlistToPromote(waitlisted []Participant, maxParticipants int, approved int) []int {
+	free := len(waitlisted)
+	if maxParticipants > 0 && maxParticipants-approved < free {
+		free = maxParticipants - approved
+	}
+	if free <= 0 {
+		return nil
+	}
+
+	ordered := append([]Participant(nil), waitlisted...)
+	sort.Slice(ordered, func(i, j int) bool {
+		if !ordered[i].CreatedAt.Equal(ordered[j].CreatedAt) {
+			return ordered[i].CreatedAt.Before(ordered[j].CreatedAt)
+		}
+		return ordered[i].ID < ordered[j].ID
+	})
+
+	promoted := make([]int, free)
+	for i := range promoted {
+		promoted[i] = ordered[i].ID
+	}
+	return promoted
+}
+
+func dbSetRoomRegistration(db *sqlx.DB, roomId int, requireApproval bool, maxParticipants int) error {
+	query := `
+	UPDATE room
+	SET require_approval = $2, max_participants = $3
+	WHERE id = $1
+	`
+
+	_, err := db.Exec(query, roomId, requireApproval, maxParticipants)
+	return err
+}
+
+// dbLeaveRoom deletes a participant while registration is still open. The room row is locked so a
+// draw cannot start in between; it returns false once the deadline has passed or the draw is done.
+func dbLeaveRoom(db *sqlx.DB, roomId int, participantId int, now time.Time) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var room struct {
+		DrawCompleted bool      `db:"draw_completed"`
+		Deadline      time.Time `db:"deadline"`
+	}
+	if err := tx.Get(&room, `SELECT draw_completed, deadline FROM room WHERE id = $1 FOR UPDATE`, roomId); err != nil {
+		return false, err
+	}
+	if room.DrawCompleted || !now.Before(room.Deadline) {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(`DELETE FROM sent_reminder WHERE room_id = $1 AND participant_id = $2`, roomId, participantId); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM participant WHERE id = $1 AND room_id = $2`, participantId, roomId); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+/*
+   ##### Business Logic
+*/
+var (
+	errInvalidPassword         = errors.New("invalid password")
+	errRoomNotJoinable         = errors.New("this room can only be entered through an invite link")
+	errInviteUnavailable       = errors.New("this invite link has expired or has already been used")
+	errInviteEmailMismatch     = errors.New("this invite link was sent to a different email address")
+	errNoAssignment            = errors.New("the draw has not happened yet")
+	errNotSignedIn             = errors.New("not signed in as a participant of this room")
+	errAdminExists             = errors.New("this email address is already an admin of the room")
+	errAdminEmailNotConfigured = errors.New("admin password emails are not configured")
+	errRegistrationClosed      = errors.New("registration for this room has closed")
+	errNameTaken               = errors.New("another participant already uses this name")
+	errEmailTaken              = errors.New("another participant already uses this email address")
+	errNameLocked              = errors.New("names cannot be changed once the draw has happened")
+	errNameRequired            = errors.New("name is required")
+	errInvalidEmail            = errors.New("invalid email address")
+	errPasswordRequired        = errors.New("password is required")
+	errMagicLinksDisabled      = errors.New("sign-in links are not enabled")
+	errInvalidCapacity         = errors.New("maximum participants cannot be negative")
+	errNotWaiting              = errors.New("this participant is not waiting for approval")
+	errInvalidDeadline         = errors.New("deadline must look like 2006-01-02T15:04")
+	errInvalidExchangeDate     = errors.New("exchange date must look like 2006-01-02T15:04")
+	errInvalidVisibility       = errors.New("visibility must be one of public, unlisted or private")
+	errRoomNameTaken           = errors.New("a room with this name already exists")
+)
+
+// verifyJoinPassword checks a room's join password, which private rooms never accept. Unlisted rooms
+// also need the slug from their link, so they cannot be found by counting through room IDs.
+func verifyJoinPassword(db *sqlx.DB, roomId int, slug string, joinPassword string) error {
+	room, err := dbGetOneRoom(db, roomId)
+	if err != nil {
+		return err
+	}
+
+	if room.Visibility == roomVisibilityPrivate {
+		return errRoomNotJoinable
+	}
+	if room.Visibility == roomVisibilityUnlisted && !hasRoomSlug(room, slug) {
+		return errInvalidPassword
+	}
+
+	if !checkStringHash(joinPassword, room.JoinPassword) {
+		return errInvalidPassword
+	}
+
+	return nil
+}
+
+// isRoomValidationError reports whether dbCreateNewRoom refused the room's settings rather than failed.
+func isRoomValidationError(err error) bool {
+	switch err {
+	case errInvalidDeadline, errInvalidExchangeDate, errInvalidVisibility, errInvalidCapacity:
+		return true
+	}
+	return false
+}
+
+func hasRoomSlug(room Room, slug string) bool {
+	return room.Slug != "" && subtle.ConstantTimeCompare([]byte(room.Slug), []byte(slug)) == 1
+}
+
+// verifyAdminPassword checks the password of the room's admin with this email. Without an email only admins who
+// have none are tried, which is how rooms set up with just an admin password sign in; everyone else must give
+// their email, so a guess costs one password hash check rather than one per admin.
+func verifyAdminPassword(db *sqlx.DB, encryptionKey []byte, roomId int, email string, adminPassword string) (RoomAdmin, error) {
+	admins, err := dbGetAdminsForRoom(db, roomId)
+	if err != nil {
+		return RoomAdmin{}, err
+	}
+
+	email = strings.TrimSpace(email)
+	for _, admin := range admins {
+		if admin.AdminPassword == "" {
+			continue
+		}
+
+		if email == "" {
+			if admin.Email != "" {
+				continue
+			}
+		} else {
+			matches, err := adminHasEmail(encryptionKey, admin, email)
+			if err != nil {
+				return RoomAdmin{}, err
+			}
+			if !matches {
+				continue
+			}
+		}
+
+		if checkStringHash(adminPassword, admin.AdminPassword) {
+			return admin, nil
+		}
+	}
+
+	return RoomAdmin{}, errInvalidPassword
+}
+
+func adminHasEmail(encryptionKey []byte, admin RoomAdmin, email string) (bool, error) {
+	if admin.Email == "" {
+		return false, nil
+	}
+
+	adminEmail, err := decryptAES(encryptionKey, admin.Email)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(adminEmail, strings.TrimSpace(email)), nil
+}
+
+// findRoomAdminByEmail returns the admin of the room with the given email, if there is one.
+func findRoomAdminByEmail(db *sqlx.DB, encryptionKey []byte, roomId int, email string) (RoomAdmin, bool, error) {
+	admins, err := dbGetAdminsForRoom(db, roomId)
+	if err != nil {
+		return RoomAdmin{}, false, err
+	}
+
+	for _, admin := range admins {
+		matches, err := adminHasEmail(encryptionKey, admin, email)
+		if err != nil {
+			return RoomAdmin{}, false, err
+		}
+		if matches {
+			return admin, true, nil
+		}
+	}
+
+	return RoomAdmin{}, false, nil
+}
+
+// getAdminsWithEmail returns the room's admins with decrypted emails.
+func getAdminsWithEmail(db *sqlx.DB, roomId int, encryptionKey []byte) ([]RoomAdmin, error) {
+	admins, err := dbGetAdminsForRoom(db, roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range admins {
+		if admins[i].Email != "" {
+			admins[i].Email, err = decryptAES(encryptionKey, admins[i].Email)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return admins, nil
+}
+
+// inviteRoomAdmin adds a co-organizer and emails them a link to choose their admin password.
+func inviteRoomAdmin(db *sqlx.DB, room Room, email string, baseURL string, encryptionKey []byte, emailConfig EmailConfig, logger *Logger) (RoomAdmin, error) {
+	if emailConfig.AdminPasswordTemplateID == "" {
+		return RoomAdmin{}, errAdminEmailNotConfigured
+	}
+
+	_, exists, err := findRoomAdminByEmail(db, encryptionKey, room.ID, email)
+	if err != nil {
+		return RoomAdmin{}, err
+	}
+	if exists {
+		return RoomAdmin{}, errAdminExists
+	}
+
+	admin, err := dbCreateRoomAdmin(db, room.ID, email, encryptionKey)
+	if err != nil {
+		return RoomAdmin{}, err
+	}
+
+	expiresAt := time.Now().UTC().Add(setPasswordExpiryDays * 24 * time.Hour)
+	err = sendAdminPasswordEmail(emailConfig, room, admin, email, baseURL, encryptionKey, expiresAt, true)
+	if err != nil {
+		// The admin stays; another admin can re-send by asking for a password reset on their behalf
+		logger.Error("Failed to send co-admin invitation", "roomId", room.ID, "adminId", admin.ID, "error", err)
+	}
+
+	logger.Info("Invited co-admin", "roomId", room.ID, "adminId", admin.ID)
+	return admin, nil
+}
+
+// requestAdminPasswordReset emails a reset link when the address belongs to an admin of the room.
+// It returns the admin ID, or 0 when nothing was sent; callers must not reveal which happened.
+func requestAdminPasswordReset(db *sqlx.DB, room Room, email string, baseURL string, encryptionKey []byte, emailConfig EmailConfig, logger *Logger) (int, error) {
+	if emailConfig.AdminPasswordTemplateID == "" {
+		return 0, errAdminEmailNotConfigured
+	}
+
+	// Claimed for every address, admin or not, so the cooldown tells nothing either
+	claimed, err := dbClaimEmailRequest(db, room.ID, emailRequestAdminReset, emailIndex(encryptionKey, email), time.Now().UTC())
+	if err != nil || !claimed {
+		return 0, err
+	}
+
+	admin, exists, err := findRoomAdminByEmail(db, encryptionKey, room.ID, email)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	expiresAt := time.Now().UTC().Add(adminPasswordResetExpiry)
+	err = sendAdminPasswordEmail(emailConfig, room, admin, email, baseURL, encryptionKey, expiresAt, false)
+	if err != nil {
+		return 0, err
+	}
+
+	logger.Info("Sent admin password reset", "roomId", room.ID, "adminId", admin.ID)
+	return admin.ID, nil
+}
+
+// startAdminPasswordReset runs requestAdminPasswordReset in the background, so the response time does not tell
+// whether the address belongs to an admin either.
+func startAdminPasswordReset(c *fiber.Ctx, db *sqlx.DB, room Room, email string, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) {
+	// Fiber reuses the request's memory once the handler returns
+	email, baseURL, ip := utils.CopyString(email), utils.CopyString(c.BaseURL()), utils.CopyString(c.IP())
+	reqLogger := requestLogger(c)
+	background.Go(func() {
+		adminId, err := requestAdminPasswordReset(db, room, email, baseURL, encryptionKey, emailConfig, reqLogger)
+		if err != nil {
+			reqLogger.Error("Error sending admin password reset", "roomId", room.ID, "error", err)
+		}
+		if adminId != 0 {
+			audit.RecordFromIP(ip, room.ID, actorAdmin, "admin.password_reset_requested", map[string]interface{}{"adminId": adminId})
+		}
+	})
+}
+
+func sendAdminPasswordEmail(emailConfig EmailConfig, room Room, admin RoomAdmin, email string, baseURL string, encryptionKey []byte, expiresAt time.Time, invited bool) error {
+	return sendTemplateEmail(emailConfig, email, email, emailConfig.AdminPasswordTemplateID, map[string]interface{}{
+		"RoomName":       room.Name,
+		"Invited":        invited,
+		"SetPasswordURL": fmt.Sprintf("%s/admin-password/%s", baseURL, adminPasswordToken(encryptionKey, admin, expiresAt)),
+		"ExpiresAt":      expiresAt.Format("2006-01-02 15:04"),
+	})
+}
+
+// verifyParticipantPassword looks up a participant of the room by name and checks their password. Pending,
+// waitlisted and rejected participants sign in too, to see where they stand. A rejected participant's row
+// deliberately stays, keeping their name and email taken so they cannot simply join again; erasing their data
+// from their page frees both.
+func verifyParticipantPassword(db *sqlx.DB, roomId int, name string, participantPassword string) (Participant, error) {
+	participants, err := dbGetParticipantsForRoom(db, roomId)
+	if err != nil {
+		return Participant{}, err
+	}
+
+	for _, participant := range participants {
+		if strings.EqualFold(participant.Name, name) && checkStringHash(participantPassword, participant.ParticipantPassword) {
+			return participant, nil
+		}
+	}
+
+	return Participant{}, errInvalidPassword
+}
+
+func newAuditor(db *sqlx.DB, encryptionKey []byte) *Auditor {
+	return &Auditor{db: db, ipHashKey: encryptionKey}
+}
+
+// Record appends an audit event for the room, hashing the client IP when there is a request.
+// Failures are logged rather than returned so auditing never breaks the action itself.
+func (a *Auditor) Record(c *fiber.Ctx, roomId int, actorType string, action string, details map[string]interface{}) {
+	if a == nil {
+		return
+	}
+
+	event := AuditEvent{RoomID: roomId, ActorType: actorType, Action: action, CreatedAt: time.Now().UTC()}
+	if c != nil {
+		event.IPHash = hashIP(a.ipHashKey, c.IP())
+	}
+	a.record(event, details)
+}
+
+// RecordFromIP is Record for work that outlives its request, given the client IP copied beforehand.
+func (a *Auditor) RecordFromIP(ip string, roomId int, actorType string, action string, details map[string]interface{}) {
+	if a == nil {
+		return
+	}
+
+	event := AuditEvent{RoomID: roomId, ActorType: actorType, Action: action, CreatedAt: time.Now().UTC()}
+	if ip != "" {
+		event.IPHash = hashIP(a.ipHashKey, ip)
+	}
+	a.record(event, details)
+}
+
+func (a *Auditor) record(event AuditEvent, details map[string]interface{}) {
+	if a == nil {
+		return
+	}
+
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		logger.Error("Error encoding audit details", "action", event.Action, "roomId", event.RoomID, "error", err)
+		return
+	}
+	event.Details = string(encoded)
+
+	if err := dbCreateAuditEvent(a.db, event); err != nil {
+		logger.Error("Error recording audit event", "action", event.Action, "roomId", event.RoomID, "error", err)
+	}
+}
+
+func newPasswordGuard(db *sqlx.DB, encryptionKey []byte, audit *Auditor) *PasswordGuard {
+	return &PasswordGuard{db: db, ipHashKey: encryptionKey, audit: audit}
+}
+
+// Check runs verify unless the client is currently throttled, recording failures and lockouts as they happen.
+// A nil guard checks the password without any throttling.
+//
+// The attempt is recorded as a failure before it is counted and verified, so concurrent guesses from one client
+// see each other and cannot all slip through under the limit; a correct password clears it again.
+func (g *PasswordGuard) Check(roomId int, scope string, ip string, verify func() error) error {
+	if g == nil {
+		return verify()
+	}
+
+	now := time.Now().UTC()
+	ipHash := hashIP(g.ipHashKey, ip)
+
+	attemptId, err := dbRecordPasswordAttempt(g.db, roomId, scope, ipHash, now)
+	if err != nil {
+		return err
+	}
+	forgetAttempt := func() {
+		if err := dbDeletePasswordAttempt(g.db, attemptId); err != nil {
+			logger.Error("Error deleting password attempt", "roomId", roomId, "error", err)
+		}
+	}
+
+	stats, err := dbGetPasswordFailureStats(g.db, roomId, scope, ipHash, now.Add(-bruteForceWindow), attemptId)
+	if err != nil {
+		forgetAttempt()
+		return err
+	}
+	if wait := bruteForceWait(stats, now); wait > 0 {
+		logger.Warn("Throttled password attempt", "scope", scope, "roomId", roomId)
+		forgetAttempt()
+		return &LockoutError{RetryAfter: wait}
+	}
+
+	err = verify()
+	if err == nil {
+		if err := dbClearPasswordFailures(g.db, roomId, scope, ipHash); err != nil {
+			logger.Error("Error clearing password failures", "roomId", roomId, "error", err)
+		}
+		return nil
+	}
+	if err != errInvalidPassword {
+		forgetAttempt()
+		return err
+	}
+
+	if stats.IPFailures+1 != bruteForceLockoutAttempts {
+		return errInvalidPassword
+	}
+
+	lockout := LockoutEvent{RoomID: roomId, Scope: scope, IPHash: ipHash, Failures: stats.IPFailures + 1, LockedUntil: now.Add(bruteForceLockoutDuration), CreatedAt: now}
+	logger.Warn("Locked out password attempts", "scope", scope, "roomId", roomId, "failures", lockout.Failures)
+	if err := dbCreateLockoutEvent(g.db, lockout); err != nil {
+		logger.Error("Error recording lockout", "roomId", roomId, "error", err)
+	}
+	g.audit.record(AuditEvent{RoomID: roomId, ActorType: actorSystem, Action: "password.locked_out", IPHash: ipHash, CreatedAt: now}, map[string]interface{}{
+		"scope":       scope,
+		"failures":    lockout.Failures,
+		"lockedUntil": lockout.LockedUntil,
+	})
+	return errInvalidPassword
+}
+
+// bruteForceDelay is how long a client waits after its latest failure: nothing for the first few,
+// then doubling from one second, until it is locked out entirely.
+func bruteForceDelay(failures int) time.Duration {
+	switch {
+	case failures < bruteForceFreeAttempts:
+		return 0
+	case failures >= bruteForceLockoutAttempts:
+		return bruteForceLockoutDuration
+	default:
+		return time.Second << uint(failures-bruteForceFreeAttempts)
+	}
+}
+
+// bruteForceWait returns how much longer a client must wait before its next attempt is checked.
+func bruteForceWait(stats PasswordFailureStats, now time.Time) time.Duration {
+	if !stats.IPLatest.Valid {
+		return 0
+	}
+
+	wait := stats.IPLatest.Time.Add(bruteForceDelay(stats.IPFailures)).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// emailIndex is a keyed hash of the normalised address, a blind index that finds participants by email
+// without decrypting every row. It changes with the encryption key; rotate-key rebuilds it.
+func emailIndex(key []byte, email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, deriveKey(key, "email-index"))
+	mac.Write([]byte("email-index:" + email))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashIP keys client addresses with the encryption key so stored hashes cannot be reversed by enumerating IPs.
+func hashIP(key []byte, ip string) string {
+	mac := hmac.New(sha256.New, deriveKey(key, "ip-hash"))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// buildParticipantDataExport collects everything held about a participant, with their email decrypted.
+func buildParticipantDataExport(db *sqlx.DB, participant Participant, encryptionKey []byte, now time.Time) (ParticipantDataExport, error) {
+	var export ParticipantDataExport
+
+	room, err := dbGetOneRoom(db, participant.RoomID)
+	if err != nil {
+		return export, err
+	}
+
+	email, err := decryptAES(encryptionKey, participant.Email)
+	if err != nil {
+		return export, err
+	}
+
+	export = ParticipantDataExport{
+		RoomName:       room.Name,
+		Name:           participant.Name,
+		Email:          email,
+		ExclusionGroup: participant.ExclusionGroup,
+		Wishlist:       participant.Wishlist,
+		JoinedAt:       participant.CreatedAt,
+		Status:         participant.Status,
+		ExportedAt:     now,
+	}
+
+	// Their own giftee is already theirs to know; who drew them is not
+	assignment, err := getMyAssignment(db, participant)
+	if err == nil {
+		export.GifteeName = assignment.GifteeName
+	} else if err != errNoAssignment {
+		return export, err
+	}
+
+	export.RemindersSent, err = dbGetRemindersForParticipant(db, participant.RoomID, participant.ID)
+	if err != nil {
+		return export, err
+	}
+
+	events, err := dbGetAuditEventsForParticipant(db, participant.RoomID, participant.ID)
+	if err != nil {
+		return export, err
+	}
+	export.Activity = make([]APIAuditEvent, len(events))
+	for i, event := range events {
+		export.Activity[i] = toAPIAuditEvent(event)
+	}
+
+	return export, nil
+}
+
+// eraseParticipant removes a participant's personal data, returning whether the row was anonymized rather than deleted.
+func eraseParticipant(db *sqlx.DB, participant Participant, encryptionKey []byte, notifier *Notifier, audit *Auditor, c *fiber.Ctx) (bool, error) {
+	// An encrypted empty string keeps every code path that decrypts emails working
+	anonymizedEmail, err := encryptAES(encryptionKey, "")
+	if err != nil {
+		return false, err
+	}
+
+	email, err := decryptAES(encryptionKey, participant.Email)
+	if err != nil {
+		return false, err
+	}
+	invites, err := dbGetInvitesForRoom(db, participant.RoomID)
+	if err != nil {
+		return false, err
+	}
+	inviteIds, err := invitesSentTo(invites, email, encryptionKey)
+	if err != nil {
+		return false, err
+	}
+
+	anonymized, err := dbEraseParticipant(db, participant.ID, anonymizedEmail, inviteIds, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+
+	requestLogger(c).Info("Erased participant", "roomId", participant.RoomID, "participantId", participant.ID, "anonymized", anonymized)
+	audit.Record(c, participant.RoomID, actorParticipant, "participant.erased", map[string]interface{}{"participantId": participant.ID, "anonymized": anonymized})
+
+	// A deleted participant frees their place for the waitlist
+	if !anonymized && participant.Status == participantStatusApproved {
+		room, err := dbGetOneRoom(db, participant.RoomID)
+		if err != nil {
+			requestLogger(c).Error("Error fetching room to promote waitlist", "roomId", participant.RoomID, "error", err)
+		} else {
+			promoteWaitlisted(db, room, notifier, audit, c, actorParticipant)
+		}
+	}
+	return anonymized, nil
+}
+
+// magicLinksEnabled reports whether participants can sign in with an emailed link instead of their password.
+func magicLinksEnabled(emailConfig EmailConfig) bool {
+	return emailConfig.MagicLinkTemplateID != ""
+}
+
+// fillMagicLinkPassword gives a participant who left the password empty an unguessable one when they
+// can sign in by email instead.
+func fillMagicLinkPassword(data *CreateParticipantFormData, emailConfig EmailConfig) error {
+	if data.ParticipantPassword != "" || !magicLinksEnabled(emailConfig) {
+		return nil
+	}
+
+	password, err := generateRandomSecret()
+	if err != nil {
+		return err
+	}
+	data.ParticipantPassword = password
+	return nil
+}
+
+// requestMagicLinks emails a sign-in link to every participant of the room with this address and returns
+// their IDs. Callers answer the same whether or not anyone matched, and run it through startMagicLinks so
+// they answer equally fast, so addresses cannot be probed.
+func requestMagicLinks(db *sqlx.DB, room Room, email string, baseURL string, encryptionKey []byte, emailConfig EmailConfig, logger *Logger) ([]int, error) {
+	if !magicLinksEnabled(emailConfig) {
+		return nil, errMagicLinksDisabled
+	}
+
+	// Claimed for every address, participant or not, so the cooldown tells nothing either
+	emailHash := emailIndex(encryptionKey, email)
+	claimed, err := dbClaimEmailRequest(db, room.ID, emailRequestMagicLink, emailHash, time.Now().UTC())
+	if err != nil || !claimed {
+		return nil, err
+	}
+
+	participants, err := dbGetParticipantsByEmailHash(db, room.ID, emailHash)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().UTC().Add(magicLinkExpiry)
+	var sent []int
+	for _, participant := range participants {
+		err := sendTemplateEmail(emailConfig, participant.Name, strings.TrimSpace(email), emailConfig.MagicLinkTemplateID, map[string]interface{}{
+			"Name":      participant.Name,
+			"RoomName":  room.Name,
+			"SignInURL": fmt.Sprintf("%s/magic-link/%s", baseURL, magicLinkToken(encryptionKey, participant, expiresAt)),
+			"ExpiresAt": expiresAt.Format("2006-01-02 15:04"),
+		})
+		if err != nil {
+			logger.Error("Failed to send sign-in link", "roomId", room.ID, "participantId", participant.ID, "error", err)
+			continue
+		}
+		sent = append(sent, participant.ID)
+	}
+
+	logger.Info("Sent sign-in links", "roomId", room.ID, "sent", len(sent))
+	return sent, nil
+}
+
+// startMagicLinks runs requestMagicLinks in the background, so the response time does not tell whether the
+// address belongs to a participant either.
+func startMagicLinks(c *fiber.Ctx, db *sqlx.DB, room Room, email string, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) {
+	// Fiber reuses the request's memory once the handler returns
+	email, baseURL, ip := utils.CopyString(email), utils.CopyString(c.BaseURL()), utils.CopyString(c.IP())
+	reqLogger := requestLogger(c)
+	background.Go(func() {
+		participantIds, err := requestMagicLinks(db, room, email, baseURL, encryptionKey, emailConfig, reqLogger)
+		if err != nil {
+			reqLogger.Error("Error sending sign-in links", "roomId", room.ID, "error", err)
+		}
+		for _, participantId := range participantIds {
+			audit.RecordFromIP(ip, room.ID, actorVisitor, "participant.magic_link_requested", map[string]interface{}{"participantId": participantId})
+		}
+	})
+}
+
+// participantFromMagicLink resolves a sign-in link without using it up. Links stop working once the participant's
+// email changes or they sign in with a link; see useMagicLink.
+func participantFromMagicLink(db *sqlx.DB, encryptionKey []byte, token string) (Participant, error) {
+	participantId, fingerprint, err := parseMagicLinkToken(encryptionKey, token, time.Now().UTC())
+	if err != nil {
+		return Participant{}, err
+	}
+
+	participant, err := dbGetOneParticipant(db, participantId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Participant{}, errNotSignedIn
+	}
+	if err != nil {
+		return Participant{}, err
+	}
+	if participant.ErasedAt.Valid || magicLinkFingerprint(participant) != fingerprint {
+		return Participant{}, errNotSignedIn
+	}
+
+	return participant, nil
+}
+
+// useMagicLink signs a participant resolved by participantFromMagicLink in. It moves their last link sign-in,
+// which every link carries, so this link and any sent before it stop working; a concurrent use gets errNotSignedIn.
+func useMagicLink(db *sqlx.DB, participant Participant) error {
+	used, err := dbUseMagicLink(db, participant.ID, participant.MagicLinkUsedAt, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if !used {
+		return errNotSignedIn
+	}
+	return nil
+}
+
+// isRegistrationOpen reports whether participants can still join or leave the room.
+func isRegistrationOpen(room Room, now time.Time) bool {
+	return !room.DrawCompleted && now.Before(room.Deadline)
+}
+
+// updateParticipantProfile changes a participant's name and email, keeping both unique within the room.
+// The name is fixed once the draw has happened, since givers were told it; the email can always be corrected.
+func updateParticipantProfile(db *sqlx.DB, participant Participant, name string, email string, encryptionKey []byte, audit *Auditor, c *fiber.Ctx) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errNameRequired
+	}
+	address, err := netMail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return errInvalidEmail
+	}
+	email = address.Address
+
+	room, err := dbGetOneRoom(db, participant.RoomID)
+	if err != nil {
+		return err
+	}
+	nameChanged := name != participant.Name
+	if nameChanged && room.DrawCompleted {
+		return errNameLocked
+	}
+
+	if nameChanged {
+		participants, err := dbGetParticipantsForRoom(db, participant.RoomID)
+		if err != nil {
+			return err
+		}
+		for _, other := range participants {
+			if other.ID != participant.ID && strings.EqualFold(other.Name, name) {
+				return errNameTaken
+			}
+		}
+	}
+
+	currentEmail, err := decryptAES(encryptionKey, participant.Email)
+	if err != nil {
+		return err
+	}
+	emailChanged := currentEmail != email
+	emailHash := emailIndex(encryptionKey, email)
+	if emailChanged {
+		// Matched on the blind index, so nobody else's address has to be decrypted
+		owners, err := dbGetParticipantsByEmailHash(db, participant.RoomID, emailHash)
+		if err != nil {
+			return err
+		}
+		for _, owner := range owners {
+			if owner.ID != participant.ID {
+				return errEmailTaken
+			}
+		}
+	}
+
+	if !nameChanged && !emailChanged {
+		return nil
+	}
+
+	encryptedEmail, err := encryptAES(encryptionKey, email)
+	if err != nil {
+		return err
+	}
+	if err := dbUpdateParticipantProfile(db, participant.ID, name, encryptedEmail, emailHash); err != nil {
+		return err
+	}
+
+	requestLogger(c).Info("Updated participant profile", "roomId", participant.RoomID, "participantId", participant.ID)
+	audit.Record(c, participant.RoomID, actorParticipant, "participant.profile_updated", map[string]interface{}{
+		"participantId": participant.ID,
+		"nameChanged":   nameChanged,
+		"emailChanged":  emailChanged,
+	})
+	return nil
+}
+
+// changeParticipantPassword replaces a participant's password after checking the current one through the guard.
+func changeParticipantPassword(db *sqlx.DB, participant Participant, currentPassword string, newPassword string, guard *PasswordGuard, audit *Auditor, c *fiber.Ctx) error {
+	err := guard.Check(participant.RoomID, passwordScopeParticipant, c.IP(), func() error {
+		if !checkStringHash(currentPassword, participant.ParticipantPassword) {
+			return errInvalidPassword
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if newPassword == "" {
+		return errPasswordRequired
+	}
+	if err := dbSetParticipantPassword(db, participant.ID, newPassword); err != nil {
+		return err
+	}
+
+	requestLogger(c).Info("Changed participant password", "roomId", participant.RoomID, "participantId", participant.ID)
+	audit.Record(c, participant.RoomID, actorParticipant, "participant.password_changed", map[string]interface{}{"participantId": participant.ID})
+	return nil
+}
+
+// leaveRoom withdraws a participant before registration closes and lets the organizers know.
+func leaveRoom(db *sqlx.DB, participant Participant, notifier *Notifier, audit *Auditor, c *fiber.Ctx) error {
+	room, err := dbGetOneRoom(db, participant.RoomID)
+	if err != nil {
+		return err
+	}
+	if !isRegistrationOpen(room, roomClockNow()) {
+		return errRegistrationClosed
+	}
+
+	left, err := dbLeaveRoom(db, room.ID, participant.ID, roomClockNow())
+	if err != nil {
+		return err
+	}
+	if !left {
+		return errRegistrationClosed
+	}
+
+	requestLogger(c).Info("Participant left room", "roomId", room.ID, "participantId", participant.ID)
+	audit.Record(c, room.ID, actorParticipant, "participant.left", map[string]interface{}{"participantId": participant.ID})
+	if participant.Status == participantStatusApproved {
+		notifier.ParticipantLeft(requestLogger(c), room, participant.ID, participant.Name)
+		promoteWaitlisted(db, room, notifier, audit, c, actorParticipant)
+	}
+	return nil
+}
+
+// purgeExpiredRooms removes personal data from every room past the retention period. With dryRun it only
+// reports the rooms that would be purged.
+func purgeExpiredRooms(db *sqlx.DB, retention RetentionConfig, audit *Auditor, logger *Logger, actorType string, now time.Time, dryRun bool) ([]RetentionCandidate, error) {
+	if retention.DaysAfterExchange <= 0 {
+		return nil, nil
+	}
+
+	candidates, err := dbGetRoomsDueForRetention(db, retentionCutoff(retention, now))
+	if err != nil || dryRun {
+		return candidates, err
+	}
+
+	for i, candidate := range candidates {
+		if err := dbPurgeRoomPersonalData(db, candidate.ID, now); err != nil {
+			return candidates[:i], fmt.Errorf("purging room %d: %w", candidate.ID, err)
+		}
+
+		logger.Info("Purged personal data", "roomId", candidate.ID, "participants", candidate.ParticipantCount)
+		audit.Record(nil, candidate.ID, actorType, "room.retention_purged", map[string]interface{}{
+			"participants": candidate.ParticipantCount,
+			"assignments":  candidate.AssignmentCount,
+			"invites":      candidate.InviteCount,
+		})
+	}
+
+	return candidates, nil
+}
+
+// retentionCutoff is the exchange date before which a room's personal data is purged.
+func retentionCutoff(retention RetentionConfig, now time.Time) time.Time {
+	return now.AddDate(0, 0, -retention.DaysAfterExchange)
+}
+
+// joinRoom adds a participant to the room, using up one use of the invite they arrived with, if any.
+func joinRoom(db *sqlx.DB, roomId int, data CreateParticipantFormData, inviteId int, encryptionKey []byte, notifier *Notifier, metrics *Metrics, logger *Logger) (int, error) {
+	if inviteId == 0 {
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return -1, err
+		}
+		if room.Visibility == roomVisibilityPrivate {
+			return -1, errRoomNotJoinable
+		}
+	} else {
+		if err := checkInviteEmail(db, inviteId, data.Email, encryptionKey); err != nil {
+			return -1, err
+		}
+
+		consumed, err := dbConsumeInvite(db, inviteId, time.Now().UTC())
+		if err != nil {
+			return -1, err
+		}
+		if !consumed {
+			return -1, errInviteUnavailable
+		}
+	}
+
+	participantId, status, err := dbCreateNewParticipant(db, data, roomId, encryptionKey)
+	if err != nil {
+		if inviteId != 0 {
+			if err := dbReleaseInvite(db, inviteId); err != nil {
+				logger.Error("Error releasing invite", "roomId", roomId, "inviteId", inviteId, "error", err)
+			}
+		}
+		return -1, err
+	}
+
+	logger.Info("Created new participant", "roomId", roomId, "participantId", participantId, "status", status)
+	metrics.Inc("secret_santa_participants_joined_total")
+	// Pending and waitlisted joiners are announced once they are admitted; the waitlisted hear they are waiting
+	switch status {
+	case participantStatusApproved:
+		notifier.ParticipantJoined(logger, roomId, participantId, data.Name)
+	case participantStatusWaitlisted:
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			logger.Error("Error fetching room for waitlist notification", "roomId", roomId, "participantId", participantId, "error", err)
+			break
+		}
+		notifier.ParticipantStatusChanged(logger, room, participantId, status)
+	}
+	return participantId, nil
+}
+
+// checkInviteEmail makes sure an invite sent to one address is only used to join with that address.
+func checkInviteEmail(db *sqlx.DB, inviteId int, email string, encryptionKey []byte) error {
+	invite, err := dbGetOneInvite(db, inviteId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errInviteUnavailable
+	}
+	if err != nil {
+		return err
+	}
+	if invite.Email == "" {
+		return nil
+	}
+
+	invited, err := decryptAES(encryptionKey, invite.Email)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(strings.TrimSpace(invited), strings.TrimSpace(email)) {
+		return errInviteEmailMismatch
+	}
+	return nil
+}
+
+// invitesSentTo returns the IDs of the invites bound to email, which hold a copy of the address.
+func invitesSentTo(invites []Invite, email string, encryptionKey []byte) ([]int, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return nil, nil
+	}
+
+	var inviteIds []int
+	for _, invite := range invites {
+		if invite.Email == "" {
+			continue
+		}
+		invited, err := decryptAES(encryptionKey, invite.Email)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(strings.TrimSpace(invited), email) {
+			inviteIds = append(inviteIds, invite.ID)
+		}
+	}
+	return inviteIds, nil
+}
+
+// approveParticipant admits a waiting participant, or waitlists them when the room is full, and returns their new status.
+func approveParticipant(db *sqlx.DB, room Room, participantId int, notifier *Notifier, audit *Auditor, c *fiber.Ctx) (string, error) {
+	status, err := dbApproveParticipant(db, room.ID, participantId)
+	if err != nil {
+		return "", err
+	}
+	if status == "" {
+		return "", errNotWaiting
+	}
+
+	requestLogger(c).Info("Approved participant", "roomId", room.ID, "participantId", participantId, "status", status)
+	audit.Record(c, room.ID, actorAdmin, "participant.approved", map[string]interface{}{"participantId": participantId, "status": status})
+	notifier.ParticipantStatusChanged(requestLogger(c), room, participantId, status)
+	return status, nil
+}
+
+func rejectParticipant(db *sqlx.DB, room Room, participantId int, notifier *Notifier, audit *Auditor, c *fiber.Ctx) error {
+	rejected, err := dbRejectParticipant(db, room.ID, participantId)
+	if err != nil {
+		return err
+	}
+	if !rejected {
+		return errNotWaiting
+	}
+
+	requestLogger(c).Info("Rejected participant", "roomId", room.ID, "participantId", participantId)
+	audit.Record(c, room.ID, actorAdmin, "participant.rejected", map[string]interface{}{"participantId": participantId})
+	notifier.ParticipantStatusChanged(requestLogger(c), room, participantId, participantStatusRejected)
+	return nil
+}
+
+// promoteWaitlisted fills free places from the waitlist after someone leaves or the limit changes.
+// Failures are logged; the next departure or settings change tries again.
+func promoteWaitlisted(db *sqlx.DB, room Room, notifier *Notifier, audit *Auditor, c *fiber.Ctx, actorType string) {
+	promoted, err := dbPromoteWaitlisted(db, room.ID)
+	if err != nil {
+		requestLogger(c).Error("Error promoting waitlisted participants", "roomId", room.ID, "error", err)
+		return
+	}
+
+	for _, participantId := range promoted {
+		requestLogger(c).Info("Promoted waitlisted participant", "roomId", room.ID, "participantId", participantId)
+		audit.Record(c, room.ID, actorType, "participant.promoted", map[string]interface{}{"participantId": participantId})
+		notifier.ParticipantStatusChanged(requestLogger(c), room, participantId, participantStatusApproved)
+	}
+}
+
+// updateRoomRegistration changes whether joiners need approval and how many can take part.
+func updateRoomRegistration(db *sqlx.DB, room Room, requireApproval bool, maxParticipants int, notifier *Notifier, audit *Auditor, c *fiber.Ctx) error {
+	if maxParticipants < 0 {
+		return errInvalidCapacity
+	}
+
+	if err := dbSetRoomRegistration(db, room.ID, requireApproval, maxParticipants); err != nil {
+		return err
+	}
+
+	requestLogger(c).Info("Updated room registration", "roomId", room.ID, "requireApproval", requireApproval, "maxParticipants", maxParticipants)
+	audit.Record(c, room.ID, actorAdmin, "room.registration_updated", map[string]interface{}{"requireApproval": requireApproval, "maxParticipants": maxParticipants})
+	promoteWaitlisted(db, room, notifier, audit, c, actorAdmin)
+	return nil
+}
+
+func createInviteLink(db *sqlx.DB, roomId int, data CreateInviteFormData, encryptionKey []byte, logger *Logger) (Invite, error) {
+	if data.MaxUses <= 0 {
+		data.MaxUses = 1
+	}
+	if data.ExpiresInDays <= 0 {
+		data.ExpiresInDays = defaultInviteExpiryDays
+	}
+
+	expiresAt := time.Now().UTC().Add(time.Duration(data.ExpiresInDays) * 24 * time.Hour)
+	invite, err := dbCreateInvite(db, roomId, "", data.MaxUses, expiresAt, encryptionKey)
+	if err != nil {
+		return invite, err
+	}
+
+	logger.Info("Created new invite", "roomId", roomId, "inviteId", invite.ID)
+	return invite, nil
+}
+
+// sendInvitations creates a single-use invite for every address and emails it, returning how many were sent.
+func sendInvitations(db *sqlx.DB, room Room, emails []string, expiresInDays int, baseURL string, encryptionKey []byte, emailConfig EmailConfig, logger *Logger) (int, error) {
+	if emailConfig.InviteTemplateID == "" {
+		return 0, errors.New("email invitations are not configured")
+	}
+
+	if expiresInDays <= 0 {
+		expiresInDays = defaultInviteExpiryDays
+	}
+	expiresAt := time.Now().UTC().Add(time.Duration(expiresInDays) * 24 * time.Hour)
+
+	sent := 0
+	for _, email := range emails {
+		invite, err := dbCreateInvite(db, room.ID, email, 1, expiresAt, encryptionKey)
+		if err != nil {
+			return sent, err
+		}
+
+		err = sendTemplateEmail(emailConfig, email, email, emailConfig.InviteTemplateID, map[string]interface{}{
+			"RoomName":  room.Name,
+			"InviteURL": fmt.Sprintf("%s/invite/%s", baseURL, inviteToken(encryptionKey, invite)),
+			"ExpiresAt": expiresAt.Format("2006-01-02 15:04"),
+		})
+		if err != nil {
+			logger.Error("Failed to send invitation", "roomId", room.ID, "inviteId", invite.ID, "error", err)
+			continue
+		}
+		sent++
+	}
+
+	logger.Info("Sent invitations", "roomId", room.ID, "sent", sent)
+	return sent, nil
+}
+
+// getInvitesWithURL returns the room's invites with decrypted emails and their shareable links.
+func getInvitesWithURL(db *sqlx.DB, roomId int, baseURL string, encryptionKey []byte) ([]InviteWithURL, error) {
+	invites, err := dbGetInvitesForRoom(db, roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	invitesWithURL := make([]InviteWithURL, len(invites))
+	for i, invite := range invites {
+		if invite.Email != "" {
+			invite.Email, err = decryptAES(encryptionKey, invite.Email)
+			if err != nil {
+				return nil, err
+			}
+		}
+		invitesWithURL[i] = InviteWithURL{
+			Invite: invite,
+			URL:    fmt.Sprintf("%s/invite/%s", baseURL, inviteToken(encryptionKey, invite)),
+		}
+	}
+
+	return invitesWithURL, nil
+}
+
+func getMyAssignment(db *sqlx.DB, participant Participant) (Assignment, error) {
+	assignments, err := dbGetAssignmentsForRoom(db, participant.RoomID)
+	if err != nil {
+		return Assignment{}, err
+	}
+
+	for _, assignment := range assignments {
+		if assignment.Participant.ID == participant.ID {
+			return assignment, nil
+		}
+	}
+
+	return Assignment{}, errNoAssignment
+}
+
+/*
+   ##### Handlers
+*/
+// handleGetHealthz only reports that the process is serving requests.
+func handleGetHealthz() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	}
+}
+
+// handleGetReadyz reports whether the database is reachable, so traffic is only routed to working instances.
+func handleGetReadyz(db *sqlx.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+		defer cancel()
+
+		if err := db.PingContext(ctx); err != nil {
+			requestLogger(c).Warn("Readiness check failed", "error", err)
+			return c.Status(fiber.StatusServiceUnavailable).SendString("database unavailable")
+		}
+		return c.SendString("ok")
+	}
+}
+
+// handleGetMetrics serves the registry to scrapers that send token as a bearer token. The rooms gauge
+// is a database aggregate, so it is refreshed at most once per metricsRoomCountInterval; when a refresh fails
+// the last counts are served until the next one is due.
+func handleGetMetrics(db *sqlx.DB, metrics *Metrics, token string) fiber.Handler {
+	var mu sync.Mutex
+	var countedAt time.Time
+
+	return func(c *fiber.Ctx) error {
+		if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), []byte("Bearer "+token)) != 1 {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+
+		mu.Lock()
+		if time.Since(countedAt) >= metricsRoomCountInterval {
+			counts, err := dbCountRoomsByState(db, roomClockNow())
+			if err != nil {
+				requestLogger(c).Error("Error counting rooms for metrics", "error", err)
+			}
+			countedAt = time.Now()
+			for state, count := range counts {
+				metrics.Set("secret_santa_rooms", float64(count), "state", state)
+			}
+		}
+		mu.Unlock()
+
+		c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+		_, err := metrics.WriteTo(c)
+		return err
+	}
+}
+
+func handleGetIndex(db *sqlx.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		page, err := strconv.Atoi(c.Query("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		rooms, err := dbGetPublicRooms(db, indexPageSize, (page-1)*indexPageSize)
+		if err != nil {
+			requestLogger(c).Error("Error fetching rooms", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		}
+
+		roomCount, err := dbCountPublicRooms(db)
+		if err != nil {
+			requestLogger(c).Error("Error counting rooms", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		}
+
+		return c.Render("index", fiber.Map{
+			"Title":    "Titkowos Mikuwulás Főoldal",
+			"Rooms":    rooms,
+			"Page":     page,
+			"PrevPage": page - 1,
+			"NextPage": page + 1,
+			"HasPrev":  page > 1,
+			"HasNext":  page*indexPageSize < roomCount,
+		})
+	}
+}
+
+func handleGetCreateRoom(defaultDeadline string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.Render("create-room", fiber.Map{
+			"DefaultDeadline": defaultDeadline,
+		})
+	}
+}
+
+func handlePostCreateRoom(db *sqlx.DB, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var data CreateRoomFormData
+		if err := c.BodyParser(&data); err != nil {
+			requestLogger(c).Warn("Error parsing form", "error", err)
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Error parsing form data: %s", err))
+		}
+
+		roomId, err := dbCreateNewRoom(db, data, encryptionKey)
+		if err == errRoomNameTaken {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		if isRoomValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if err != nil {
+			requestLogger(c).Error("Error creating room", "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Error creating room")
+		}
+
+		requestLogger(c).Info("Created new room", "roomId", roomId)
+		audit.Record(c, roomId, actorVisitor, "room.created", map[string]interface{}{"visibility": data.Visibility})
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+		return c.Redirect("/r/" + room.Slug)
+	}
+}
+
+// handleGetRoomLink opens a room from its slug link, which is how unlisted rooms are reached.
+func handleGetRoomLink(db *sqlx.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		room, err := dbGetRoomBySlug(db, c.Params("slug"))
+		if err != nil {
+			return c.Redirect("/")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil {
+			return c.Redirect("/")
+		}
+		sess.Set("roomLink", room.Slug)
+		sess.Save()
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d", room.ID))
+	}
+}
+
+func handleGetRoomDetails(db *sqlx.DB, store *session.Store, emailConfig EmailConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		var room Room
+		room, err = dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Redirect("/")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "roomAccess", roomId) {
+			if err != nil || !roomVisible(sess, room) {
+				return c.Redirect("/")
+			}
+
+			return c.Render("room-login", fiber.Map{
+				"Room":       room,
+				"MagicLinks": magicLinksEnabled(emailConfig),
+			})
+		}
+
+		var participants []Participant
+		participants, err = dbGetApprovedParticipantsForRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get participants for room ID: %d. %s", roomId, err))
+		}
+
+		exports, err := dbGetRoomExportRecords(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get exports for room ID: %d. %s", roomId, err))
+		}
+
+		// A signed-in joiner who is not in yet sees where their request stands
+		myStatus := ""
+		if participant, err := sessionParticipant(db, sess, roomId); err == nil && participant.Status != participantStatusApproved {
+			myStatus = participant.Status
+		}
+
+		return c.Render("room-details", fiber.Map{
+			"Room":         room,
+			"Participants": participants,
+			"Exports":      exports,
+			"MyStatus":     myStatus,
+		})
+	}
+}
+
+func handlePostRoomDetails(db *sqlx.DB, store *session.Store, guard *PasswordGuard, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		joinPassword := c.FormValue("joinPassword")
+		sess, _ := store.Get(c)
+		slug, _ := sess.Get("roomLink").(string)
+		err = guard.Check(roomId, passwordScopeJoin, c.IP(), func() error {
+			return verifyJoinPassword(db, roomId, slug, joinPassword)
+		})
+
+		var lockout *LockoutError
+		if errors.As(err, &lockout) {
+			return sendLockout(c, lockout)
+		}
+
+		if err == nil {
+			if err := sess.Regenerate(); err != nil {
+				return c.Status(fiber.StatusInternalServerError).SendString("Cannot start session")
+			}
+			sess.Set("roomAccess", roomId)
+			sess.Set("joinAccess", roomId)
+			sess.Save()
+			audit.Record(c, roomId, actorVisitor, "room.accessed", nil)
+			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		} else {
+			return c.Redirect("/")
+		}
+	}
+}
+
+func sendLockout(c *fiber.Ctx, lockout *LockoutError) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(lockout.RetryAfter.Seconds()+1)))
+	return c.Status(fiber.StatusTooManyRequests).SendString(fmt.Sprintf("Too many failed password attempts for this room, %s", lockout))
+}
+
+func handleGetJoinRoom(store *session.Store, emailConfig EmailConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "joinAccess", roomId) {
+			return c.Redirect("/")
+		}
+
+		return c.Render("join-room", fiber.Map{
+			"Title":      "Join Room - Secret Santa App",
+			"roomId":     roomId,
+			"MagicLinks": magicLinksEnabled(emailConfig),
+		})
+	}
+}
+
+func handlePostJoinRoom(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, notifier *Notifier, metrics *Metrics, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "joinAccess", roomId) {
+			return c.Redirect("/")
+		}
+
+		var data CreateParticipantFormData
+		if err := c.BodyParser(&data); err != nil {
+			requestLogger(c).Warn("Error parsing form", "error", err)
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Error parsing form data: %s", err))
+		}
+
+		if err := fillMagicLinkPassword(&data, emailConfig); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error generating password: %s", err))
+		}
+
+		// Visitors who arrived through an invite link use up one of its uses
+		inviteId, _ := sess.Get("inviteId").(int)
+		participantId, err := joinRoom(db, roomId, data, inviteId, encryptionKey, notifier, metrics, requestLogger(c))
+		if err == errInviteUnavailable {
+			clearInvite(sess, roomId, false)
+			sess.Save()
+			return c.Status(fiber.StatusForbidden).SendString("This invite link has expired or has already been used")
+		}
+		if err == errInviteEmailMismatch || err == errRoomNotJoinable {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+		if err == errEmailTaken || err == errNameTaken {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		if err != nil {
+			requestLogger(c).Error("Error adding participant", "roomId", roomId, "error", err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Error adding participant")
+		}
+		audit.Record(c, roomId, actorVisitor, "participant.joined", map[string]interface{}{"participantId": participantId, "inviteId": inviteId})
+
+		if err := sess.Regenerate(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Cannot start session")
+		}
+		if inviteId != 0 {
+			clearInvite(sess, roomId, true)
+		}
+		sess.Set("participantId", participantId)
+		sess.Save()
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+	}
+}
+
+// sessionHasGrant reports whether the session holds grant for the room. roomAccess lets a visitor see the
+// room and joinAccess also lets them add a participant; an invite link grants both until it expires or
+// is used to join.
+func sessionHasGrant(sess *session.Session, grant string, roomId int) bool {
+	if sess.Get(grant) == roomId {
+		return true
+	}
+	if grant != "roomAccess" && grant != "joinAccess" {
+		return false
+	}
+
+	expiresAt, _ := sess.Get("inviteExpiresAt").(int64)
+	return sess.Get("inviteAccess") == roomId && time.Now().Unix() < expiresAt
+}
+
+// roomVisible reports whether the session may see the room at all. Private rooms can only be entered through
+// an invite link, unlisted ones through their link; pages reachable by room ID must not show anyone else
+// the room's name.
+func roomVisible(sess *session.Session, room Room) bool {
+	if sessionHasGrant(sess, "roomAccess", room.ID) || sess.Get("roomAdmin") == room.ID {
+		return true
+	}
+
+	switch room.Visibility {
+	case roomVisibilityPrivate:
+		return false
+	case roomVisibilityUnlisted:
+		return hasRoomSlug(room, fmt.Sprint(sess.Get("roomLink")))
+	}
+	return true
+}
+
+// adminPageRoom is the room as the admin sign-in pages show it. Admins of private and unlisted rooms sign in
+// there too, so the pages stay reachable by room ID, but only visitors who may see the room get its name.
+func adminPageRoom(c *fiber.Ctx, store *session.Store, room Room) Room {
+	sess, err := store.Get(c)
+	if err != nil || !roomVisible(sess, room) {
+		return Room{ID: room.ID}
+	}
+	return room
+}
+
+// clearInvite drops the invite grant once the invite is used up, leaving the joiner able to see the room
+// but not to join it again.
+func clearInvite(sess *session.Session, roomId int, joined bool) {
+	sess.Delete("inviteId")
+	sess.Delete("inviteAccess")
+	sess.Delete("inviteExpiresAt")
+	if joined {
+		sess.Set("roomAccess", roomId)
+	}
+}
+
+// sessionParticipant returns the participant signed in to the session when they belong to the room.
+func sessionParticipant(db *sqlx.DB, sess *session.Session, roomId int) (Participant, error) {
+	participantId, ok := sess.Get("participantId").(int)
+	if !ok {
+		return Participant{}, errNotSignedIn
+	}
+
+	participant, err := dbGetOneParticipant(db, participantId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Participant{}, errNotSignedIn
+	}
+	if err != nil {
+		return Participant{}, err
+	}
+
+	if participant.RoomID != roomId || participant.ErasedAt.Valid {
+		return Participant{}, errNotSignedIn
+	}
+
+	return participant, nil
+}
+
+func handleGetMyData(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Redirect("/")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "roomAccess", roomId) {
+			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		}
+
+		participant, err := sessionParticipant(db, sess, roomId)
+		if err == errNotSignedIn {
+			return c.Render("participant-login", fiber.Map{
+				"Room":       room,
+				"MagicLinks": magicLinksEnabled(emailConfig),
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get participant for room ID: %d. %s", roomId, err))
+		}
+
+		data, err := buildParticipantDataExport(db, participant, encryptionKey, time.Now().UTC())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot collect your data: %s", err))
+		}
+
+		return c.Render("my-data", fiber.Map{
+			"RoomID":           roomId,
+			"Data":             data,
+			"RegistrationOpen": isRegistrationOpen(room, roomClockNow()),
+			"DrawCompleted":    room.DrawCompleted,
+		})
+	}
+}
+
+func handlePostMyData(db *sqlx.DB, store *session.Store, guard *PasswordGuard, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "roomAccess", roomId) {
+			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		}
+
+		name := c.FormValue("name")
+		participantPassword := c.FormValue("participantPassword")
+		var participant Participant
+		err = guard.Check(roomId, passwordScopeParticipant, c.IP(), func() error {
+			var err error
+			participant, err = verifyParticipantPassword(db, roomId, name, participantPassword)
+			return err
+		})
+
+		var lockout *LockoutError
+		if errors.As(err, &lockout) {
+			return sendLockout(c, lockout)
+		}
+		if err == nil {
+			if err := sess.Regenerate(); err != nil {
+				return c.Status(fiber.StatusInternalServerError).SendString("Cannot start session")
+			}
+			sess.Set("participantId", participant.ID)
+			sess.Save()
+			audit.Record(c, roomId, actorParticipant, "participant.signed_in", map[string]interface{}{"participantId": participant.ID})
+		}
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/me", roomId))
+	}
+}
+
+func handleGetExportMyData(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "roomAccess", roomId) {
+			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		}
+
+		participant, err := sessionParticipant(db, sess, roomId)
+		if err == errNotSignedIn {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/me", roomId))
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get participant for room ID: %d. %s", roomId, err))
+		}
+
+		data, err := buildParticipantDataExport(db, participant, encryptionKey, time.Now().UTC())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot collect your data: %s", err))
+		}
+		audit.Record(c, roomId, actorParticipant, "participant.data_exported", map[string]interface{}{"participantId": participant.ID})
+
+		c.Attachment(fmt.Sprintf("room-%d-my-data.json", roomId))
+		return c.JSON(data)
+	}
+}
+
+func handlePostEraseMyData(db *sqlx.DB, store *session.Store, encryptionKey []byte, notifier *Notifier, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "roomAccess", roomId) {
+			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		}
+
+		participant, err := sessionParticipant(db, sess, roomId)
+		if err == errNotSignedIn {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/me", roomId))
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get participant for room ID: %d. %s", roomId, err))
+		}
+
+		if c.FormValue("confirm") != "true" {
+			return c.Status(fiber.StatusBadRequest).SendString("Confirm that you want your data deleted")
+		}
+
+		if _, err := eraseParticipant(db, participant, encryptionKey, notifier, audit, c); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error deleting your data: %s", err))
+		}
+
+		sess.Delete("participantId")
+		sess.Save()
+		return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+	}
+}
+
+func handleGetMagicLink(db *sqlx.DB, store *session.Store, emailConfig EmailConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		if !magicLinksEnabled(emailConfig) {
+			return c.Status(fiber.StatusNotFound).SendString("Sign-in links are not enabled")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Redirect("/")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !roomVisible(sess, room) {
+			return c.Redirect("/")
+		}
+
+		return c.Render("magic-link", fiber.Map{
+			"Room": room,
+		})
+	}
+}
+
+func handlePostMagicLink(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Redirect("/")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !roomVisible(sess, room) {
+			return c.Redirect("/")
+		}
+
+		if !magicLinksEnabled(emailConfig) {
+			return c.Status(fiber.StatusNotFound).SendString("Sign-in links are not enabled")
+		}
+		startMagicLinks(c, db, room, c.FormValue("email"), encryptionKey, emailConfig, audit)
+
+		return c.Render("magic-link", fiber.Map{
+			"Room": room,
+			"Sent": true,
+		})
+	}
+}
+
+// handleGetMagicLinkSignIn asks before signing in, so mail scanners that open links do not use them up.
+func handleGetMagicLinkSignIn(db *sqlx.DB, encryptionKey []byte) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participant, err := participantFromMagicLink(db, encryptionKey, c.Params("token"))
+		if err == errNotSignedIn {
+			return c.Status(fiber.StatusForbidden).SendString("This link is no longer valid")
+		}
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("Invalid link: %s", err))
+		}
+
+		room, err := dbGetOneRoom(db, participant.RoomID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", participant.RoomID, err))
+		}
+
+		return c.Render("magic-link", fiber.Map{
+			"Room":  room,
+			"Name":  participant.Name,
+			"Token": c.Params("token"),
+		})
+	}
+}
+
+func handlePostMagicLinkSignIn(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participant, err := participantFromMagicLink(db, encryptionKey, c.Params("token"))
+		if err == nil {
+			err = useMagicLink(db, participant)
+		}
+		if err == errNotSignedIn {
+			return c.Status(fiber.StatusForbidden).SendString("This link is no longer valid")
+		}
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("Invalid link: %s", err))
+		}
+
+		sess, _ := store.Get(c)
+		if err := sess.Regenerate(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Cannot start session")
+		}
+		sess.Set("roomAccess", participant.RoomID)
+		sess.Set("participantId", participant.ID)
+		sess.Save()
+
+		audit.Record(c, participant.RoomID, actorParticipant, "participant.signed_in", map[string]interface{}{"participantId": participant.ID, "method": "magic_link"})
+		return c.Redirect(fmt.Sprintf("/room-details/%d/me", participant.RoomID))
+	}
+}
+
+// selfServiceStatus maps the errors of the participant self-service actions to HTTP statuses.
+func selfServiceStatus(err error) int {
+	switch err {
+	case errNameRequired, errInvalidEmail, errPasswordRequired:
+		return fiber.StatusBadRequest
+	case errInvalidPassword:
+		return fiber.StatusUnauthorized
+	case errNameTaken, errEmailTaken, errNameLocked, errRegistrationClosed:
+		return fiber.StatusConflict
+	}
+	return fiber.StatusInternalServerError
+}
+
+func handlePostMyProfile(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "roomAccess", roomId) {
+			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		}
+
+		participant, err := sessionParticipant(db, sess, roomId)
+		if err == errNotSignedIn {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/me", roomId))
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get participant for room ID: %d. %s", roomId, err))
+		}
+
+		err = updateParticipantProfile(db, participant, c.FormValue("name"), c.FormValue("email"), encryptionKey, audit, c)
+		if err != nil {
+			return c.Status(selfServiceStatus(err)).SendString(fmt.Sprintf("Error updating your details: %s", err))
+		}
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/me", roomId))
+	}
+}
+
+func handlePostMyPassword(db *sqlx.DB, store *session.Store, guard *PasswordGuard, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "roomAccess", roomId) {
+			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		}
+
+		participant, err := sessionParticipant(db, sess, roomId)
+		if err == errNotSignedIn {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/me", roomId))
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get participant for room ID: %d. %s", roomId, err))
+		}
+
+		err = changeParticipantPassword(db, participant, c.FormValue("currentPassword"), c.FormValue("newPassword"), guard, audit, c)
+
+		var lockout *LockoutError
+		if errors.As(err, &lockout) {
+			return sendLockout(c, lockout)
+		}
+		if err != nil {
+			return c.Status(selfServiceStatus(err)).SendString(fmt.Sprintf("Error changing your password: %s", err))
+		}
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/me", roomId))
+	}
+}
+
+func handlePostLeaveRoom(db *sqlx.DB, store *session.Store, notifier *Notifier, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || !sessionHasGrant(sess, "roomAccess", roomId) {
+			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		}
+
+		participant, err := sessionParticipant(db, sess, roomId)
+		if err == errNotSignedIn {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/me", roomId))
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get participant for room ID: %d. %s", roomId, err))
+		}
+
+		if c.FormValue("confirm") != "true" {
+			return c.Status(fiber.StatusBadRequest).SendString("Confirm that you want to leave the room")
+		}
+
+		if err := leaveRoom(db, participant, notifier, audit, c); err != nil {
+			return c.Status(selfServiceStatus(err)).SendString(fmt.Sprintf("Error leaving the room: %s", err))
+		}
+
+		sess.Delete("participantId")
+		sess.Save()
+		return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+	}
+}
+
+func handleGetRoomAdmin(db *sqlx.DB, store *session.Store, encryptionKey []byte) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Render("admin-login", fiber.Map{
+				"Room": adminPageRoom(c, store, room),
+			})
+		}
+
+		invitesWithURL, err := getInvitesWithURL(db, roomId, c.BaseURL(), encryptionKey)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get invites for room ID: %d. %s", roomId, err))
+		}
+
+		webhooks, err := dbGetWebhooksForRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get webhooks for room ID: %d. %s", roomId, err))
+		}
+
+		webhooksWithSecret := make([]WebhookWithSecret, len(webhooks))
+		for i, webhook := range webhooks {
+			secret, err := decryptAES(encryptionKey, webhook.Secret)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot decrypt webhook %d. %s", webhook.ID, err))
+			}
+			webhooksWithSecret[i] = WebhookWithSecret{Webhook: webhook, PlainSecret: secret}
+		}
+
+		deliveries, err := dbGetWebhookDeliveriesForRoom(db, roomId, 50)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get webhook deliveries for room ID: %d. %s", roomId, err))
+		}
+
+		lockouts, err := dbGetLockoutEventsForRoom(db, roomId, 20)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get lockouts for room ID: %d. %s", roomId, err))
+		}
+
+		auditEvents, err := dbGetAuditEventsForRoom(db, roomId, 50)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get audit log for room ID: %d. %s", roomId, err))
+		}
+
+		admins, err := getAdminsWithEmail(db, roomId, encryptionKey)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get admins for room ID: %d. %s", roomId, err))
+		}
+
+		joinRequests, err := dbGetJoinRequestsForRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get join requests for room ID: %d. %s", roomId, err))
+		}
+
+		return c.Render("room-admin", fiber.Map{
+			"Room":               room,
+			"RoomURL":            fmt.Sprintf("%s/r/%s", c.BaseURL(), room.Slug),
+			"Admins":             admins,
+			"JoinRequests":       joinRequests,
+			"Invites":            invitesWithURL,
+			"Webhooks":           webhooksWithSecret,
+			"WebhookDeliveries":  deliveries,
+			"WebhookMaxAttempts": webhookMaxAttempts,
+			"Lockouts":           lockouts,
+			"AuditEvents":        auditEvents,
+		})
+	}
+}
+
+func handlePostRoomAdmin(db *sqlx.DB, store *session.Store, encryptionKey []byte, guard *PasswordGuard, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		email := c.FormValue("email")
+		adminPassword := c.FormValue("adminPassword")
+		var admin RoomAdmin
+		err = guard.Check(roomId, passwordScopeAdmin, c.IP(), func() error {
+			var err error
+			admin, err = verifyAdminPassword(db, encryptionKey, roomId, email, adminPassword)
+			return err
+		})
+
+		var lockout *LockoutError
+		if errors.As(err, &lockout) {
+			return sendLockout(c, lockout)
+		}
+		if err != nil && err != errInvalidPassword {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error logging in to room, roomId=%d, err=%s", roomId, err))
+		}
+
+		if err == nil {
+			sess, _ := store.Get(c)
+			if err := sess.Regenerate(); err != nil {
+				return c.Status(fiber.StatusInternalServerError).SendString("Cannot start session")
+			}
+			sess.Set("roomAccess", roomId)
+			sess.Set("joinAccess", roomId)
+			sess.Set("roomAdmin", roomId)
+			sess.Set("adminId", admin.ID)
+			sess.Save()
+			audit.Record(c, roomId, actorAdmin, "admin.signed_in", map[string]interface{}{"adminId": admin.ID})
+		}
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handleGetAdminForgotPassword(db *sqlx.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+
+		return c.Render("admin-forgot-password", fiber.Map{
+			"Room": adminPageRoom(c, store, room),
+		})
+	}
+}
+
+// handlePostAdminForgotPassword answers the same whether or not the address belongs to an admin; see
+// startAdminPasswordReset.
+func handlePostAdminForgotPassword(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+		if emailConfig.AdminPasswordTemplateID == "" {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Admin password reset emails are not configured")
+		}
+
+		startAdminPasswordReset(c, db, room, c.FormValue("email"), encryptionKey, emailConfig, audit)
+
+		return c.Render("admin-forgot-password", fiber.Map{
+			"Room": adminPageRoom(c, store, room),
+			"Sent": true,
+		})
+	}
+}
+
+func handlePostInviteRoomAdmin(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		address, err := netMail.ParseAddress(strings.TrimSpace(c.FormValue("email")))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid email address")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+
+		admin, err := inviteRoomAdmin(db, room, address.Address, c.BaseURL(), encryptionKey, emailConfig, requestLogger(c))
+		if err == errAdminEmailNotConfigured {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Admin invitation emails are not configured")
+		}
+		if err == errAdminExists {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error inviting admin: %s", err))
+		}
+		audit.Record(c, roomId, actorAdmin, "admin.invited", map[string]interface{}{"adminId": admin.ID})
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handlePostRoomVisibility(db *sqlx.DB, store *session.Store, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		visibility := c.FormValue("visibility")
+		if !isValidRoomVisibility(visibility) {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid room visibility: %s", visibility))
+		}
+
+		err = dbSetRoomVisibility(db, roomId, visibility)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error updating room visibility: %s", err))
+		}
+
+		requestLogger(c).Info("Set room visibility", "roomId", roomId, "visibility", visibility)
+		audit.Record(c, roomId, actorAdmin, "room.visibility_changed", map[string]interface{}{"visibility": visibility})
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handlePostRoomRegistration(db *sqlx.DB, store *session.Store, notifier *Notifier, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+
+		maxParticipants := 0
+		if value := strings.TrimSpace(c.FormValue("maxParticipants")); value != "" {
+			maxParticipants, err = strconv.Atoi(value)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString("Invalid maximum number of participants")
+			}
+		}
+
+		err = updateRoomRegistration(db, room, c.FormValue("requireApproval") == "true", maxParticipants, notifier, audit, c)
+		if err == errInvalidCapacity {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error updating registration settings: %s", err))
+		}
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+// handlePostReviewParticipant approves or rejects a join request, depending on approve.
+func handlePostReviewParticipant(db *sqlx.DB, store *session.Store, notifier *Notifier, audit *Auditor, approve bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		participantId, err := strconv.Atoi(c.Params("participantId"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid participant ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+
+		if approve {
+			_, err = approveParticipant(db, room, participantId, notifier, audit, c)
+		} else {
+			err = rejectParticipant(db, room, participantId, notifier, audit, c)
+		}
+		if err == errNotWaiting {
+			return c.Status(fiber.StatusConflict).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error reviewing participant: %s", err))
+		}
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handlePostCreateWebhook(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		webhookURL := strings.TrimSpace(c.FormValue("url"))
+		if !isValidWebhookURL(webhookURL) {
+			return c.Status(fiber.StatusBadRequest).SendString("Webhook URL must be an absolute http or https URL on a public address")
+		}
+
+		secret, err := generateRandomSecret()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error generating webhook secret: %s", err))
+		}
+
+		encryptedSecret, err := encryptAES(encryptionKey, secret)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error encrypting webhook secret: %s", err))
+		}
+
+		webhookId, err := dbCreateWebhook(db, roomId, webhookURL, encryptedSecret)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error creating webhook: %s", err))
+		}
+
+		requestLogger(c).Info("Created new webhook", "roomId", roomId, "webhookId", webhookId)
+		audit.Record(c, roomId, actorAdmin, "webhook.created", map[string]interface{}{"webhookId": webhookId})
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handlePostChatSettings(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		var data ChatSettingsFormData
+		if err := c.BodyParser(&data); err != nil {
+			requestLogger(c).Warn("Error parsing form", "error", err)
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Error parsing form data: %s", err))
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Room not found")
+		}
+
+		// An empty webhook URL turns chat notifications off
+		var encryptedWebhookURL string
+		encryptedBotToken := room.ChatBotToken
+		if data.ClearBotToken {
+			encryptedBotToken = ""
+		}
+		if data.WebhookURL != "" {
+			if !isValidChatPlatform(data.Platform) {
+				return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid chat platform: %s", data.Platform))
+			}
+			if !isValidWebhookURL(data.WebhookURL) {
+				return c.Status(fiber.StatusBadRequest).SendString("Chat webhook URL must be an absolute http or https URL on a public address")
+			}
+
+			encryptedWebhookURL, err = encryptAES(encryptionKey, data.WebhookURL)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error encrypting chat webhook URL: %s", err))
+			}
+
+			if data.BotToken != "" {
+				encryptedBotToken, err = encryptAES(encryptionKey, data.BotToken)
+				if err != nil {
+					return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error encrypting chat bot token: %s", err))
+				}
+			}
+		} else {
+			data.Platform = ""
+		}
+
+		err = dbSetRoomChatSettings(db, roomId, data.Platform, encryptedWebhookURL, encryptedBotToken)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error updating chat settings: %s", err))
+		}
+
+		requestLogger(c).Info("Updated chat settings", "roomId", roomId)
+		audit.Record(c, roomId, actorAdmin, "chat.updated", map[string]interface{}{"platform": data.Platform, "directMessages": data.Platform == chatPlatformSlack && encryptedBotToken != ""})
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handlePostDeleteWebhook(db *sqlx.DB, store *session.Store, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		webhookId, err := strconv.Atoi(c.Params("webhookId"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid webhook ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		err = dbDeleteWebhook(db, roomId, webhookId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error deleting webhook: %s", err))
+		}
+
+		requestLogger(c).Info("Deleted webhook", "roomId", roomId, "webhookId", webhookId)
+		audit.Record(c, roomId, actorAdmin, "webhook.deleted", map[string]interface{}{"webhookId": webhookId})
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handlePostCreateInvite(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		var data CreateInviteFormData
+		if err := c.BodyParser(&data); err != nil {
+			requestLogger(c).Warn("Error parsing form", "error", err)
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Error parsing form data: %s", err))
+		}
+
+		invite, err := createInviteLink(db, roomId, data, encryptionKey, requestLogger(c))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error creating invite: %s", err))
+		}
+		audit.Record(c, roomId, actorAdmin, "invite.created", map[string]interface{}{"inviteId": invite.ID, "maxUses": invite.MaxUses, "expiresAt": invite.ExpiresAt})
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handlePostSendInvitations(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+
+		emails, invalid := parseEmailList(c.FormValue("emails"))
+		if len(invalid) > 0 {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid email addresses: %s", strings.Join(invalid, ", ")))
+		}
+
+		expiresInDays, _ := strconv.Atoi(c.FormValue("expiresInDays"))
+		sent, err := sendInvitations(db, room, emails, expiresInDays, c.BaseURL(), encryptionKey, emailConfig, requestLogger(c))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error sending invitations: %s", err))
+		}
+		audit.Record(c, roomId, actorAdmin, "invitations.sent", map[string]interface{}{"requested": len(emails), "sent": sent})
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handleGetInvite(db *sqlx.DB, store *session.Store, encryptionKey []byte) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		now := time.Now().UTC()
+		roomId, inviteId, err := parseInviteToken(encryptionKey, c.Params("token"), now)
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("Invalid invite link: %s", err))
+		}
+
+		invite, err := dbGetOneInvite(db, inviteId)
+		if err != nil || invite.RoomID != roomId {
+			return c.Status(fiber.StatusForbidden).SendString("Invalid invite link")
+		}
+
+		if invite.Uses >= invite.MaxUses || !now.Before(invite.ExpiresAt) {
+			return c.Status(fiber.StatusForbidden).SendString("This invite link has expired or has already been used")
+		}
+
+		sess, _ := store.Get(c)
+		if err := sess.Regenerate(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Cannot start session")
+		}
+		sess.Set("inviteAccess", roomId)
+		sess.Set("inviteId", inviteId)
+		sess.Set("inviteExpiresAt", invite.ExpiresAt.Unix())
+		sess.Save()
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/join-room", roomId))
+	}
+}
+
+func handleGetImportParticipants(db *sqlx.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+
+		return c.Render("import-participants", fiber.Map{
+			"Room": room,
+		})
+	}
+}
+
+func handlePostImportParticipants(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, notifier *Notifier, metrics *Metrics, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
+		}
+
+		csvText := c.FormValue("csvText")
+		if fileHeader, err := c.FormFile("csvFile"); err == nil && fileHeader.Size > 0 {
+			file, err := fileHeader.Open()
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Error reading uploaded file: %s", err))
+			}
+			defer file.Close()
+
+			content, err := io.ReadAll(file)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Error reading uploaded file: %s", err))
+			}
+			csvText = string(content)
+		}
+
+		participants, err := dbGetParticipantsForRoom(db, roomId)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot get participants for room ID: %d. %s", roomId, err))
+		}
+
+		existingNames := make(map[string]bool, len(participants))
+		existingEmails := make(map[string]bool, len(participants))
+		for _, participant := range participants {
+			existingNames[strings.ToLower(participant.Name)] = true
+			email, err := decryptAES(encryptionKey, participant.Email)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Cannot decrypt participant %d. %s", participant.ID, err))
+			}
+			existingEmails[strings.ToLower(email)] = true
+		}
+
+		sendPasswordLinks := c.FormValue("sendPasswordLinks") == "on"
+		rows, err := parseParticipantCSV(csvText, existingNames, existingEmails)
+		if err != nil {
+			return c.Render("import-participants", fiber.Map{
+				"Room":              room,
+				"CSVText":           csvText,
+				"SendPasswordLinks": sendPasswordLinks,
+				"ParseError":        err.Error(),
+			})
+		}
+
+		hasErrors := false
+		for _, row := range rows {
+			if len(row.Errors) > 0 {
+				hasErrors = true
+			}
+		}
+
+		// Show a preview first; only a confirmed, error-free import is committed
+		if c.FormValue("confirm") != "1" || hasErrors || len(rows) == 0 {
+			return c.Render("import-participants", fiber.Map{
+				"Room":              room,
+				"CSVText":           csvText,
+				"SendPasswordLinks": sendPasswordLinks,
+				"Rows":              rows,
+				"HasErrors":         hasErrors,
+			})
+		}
+
+		if sendPasswordLinks && emailConfig.SetPasswordTemplateID == "" {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("Set-your-password emails are not configured")
+		}
+
+		data := make([]CreateParticipantFormData, len(rows))
+		for i, row := range rows {
+			// Imported participants have no password until they set their own
+			data[i] = CreateParticipantFormData{
+				Email:          row.Email,
+				Name:           row.Name,
+				ExclusionGroup: row.ExclusionGroup,
+				Wishlist:       row.Wishlist,
+			}
+		}
+
+		participantIds, err := dbImportParticipants(db, data, roomId, encryptionKey)
+		if errors.Is(err, errEmailTaken) || errors.Is(err, errNameTaken) {
+			return c.Status(fiber.StatusConflict).SendString(fmt.Sprintf("Error importing participants: %s", err))
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error importing participants: %s", err))
+		}
+
+		requestLogger(c).Info("Imported participants", "roomId", roomId, "count", len(participantIds))
+		metrics.Add("secret_santa_participants_joined_total", float64(len(participantIds)))
+		audit.Record(c, roomId, actorAdmin, "participants.imported", map[string]interface{}{"participantIds": participantIds, "passwordLinks": sendPasswordLinks})
+		for i, participantId := range participantIds {
+			notifier.ParticipantJoined(requestLogger(c), roomId, participantId, data[i].Name)
+		}
+
+		if sendPasswordLinks {
+			expiresAt := time.Now().UTC().Add(setPasswordExpiryDays * 24 * time.Hour)
+			for i, participantId := range participantIds {
+				participant, err := dbGetOneParticipant(db, participantId)
+				if err != nil {
+					requestLogger(c).Error("Error fetching imported participant", "roomId", roomId, "participantId", participantId, "error", err)
+					continue
+				}
+
+				err = sendTemplateEmail(emailConfig, data[i].Name, data[i].Email, emailConfig.SetPasswordTemplateID, map[string]interface{}{
+					"Name":           data[i].Name,
+					"RoomName":       room.Name,
+					"SetPasswordURL": fmt.Sprintf("%s/set-password/%s", c.BaseURL(), setPasswordToken(encryptionKey, participant, expiresAt)),
+				})
+				if err != nil {
+					requestLogger(c).Error("Failed to send set-password email", "roomId", roomId, "participantId", participantId, "error", err)
+				}
+			}
+		}
+
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+	}
+}
+
+func handleGetSetPassword(db *sqlx.DB, encryptionKey []byte) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participantId, fingerprint, err := parseSetPasswordToken(encryptionKey, c.Params("token"), time.Now().UTC())
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("Invalid link: %s", err))
+		}
+
+		participant, err := dbGetOneParticipant(db, participantId)
+		if err != nil || passwordFingerprint(participant.ParticipantPassword) != fingerprint {
+			return c.Status(fiber.StatusForbidden).SendString("This link has already been used")
+		}
+
+		return c.Render("set-password", fiber.Map{
+			"Participant": participant,
+			"Token":       c.Params("token"),
+		})
+	}
+}
+
+func handlePostSetPassword(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participantId, fingerprint, err := parseSetPasswordToken(encryptionKey, c.Params("token"), time.Now().UTC())
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("Invalid link: %s", err))
+		}
+
+		participant, err := dbGetOneParticipant(db, participantId)
+		if err != nil || passwordFingerprint(participant.ParticipantPassword) != fingerprint {
+			return c.Status(fiber.StatusForbidden).SendString("This link has already been used")
+		}
+
+		password := c.FormValue("participantPassword")
+		if password == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("Password is required")
+		}
+
+		err = dbSetParticipantPassword(db, participantId, password)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error setting password: %s", err))
+		}
+
+		sess, _ := store.Get(c)
+		if err := sess.Regenerate(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Cannot start session")
+		}
+		sess.Set("roomAccess", participant.RoomID)
+		sess.Save()
+
+		requestLogger(c).Info("Set participant password", "roomId", participant.RoomID, "participantId", participantId)
+		audit.Record(c, participant.RoomID, actorParticipant, "participant.password_set", map[string]interface{}{"participantId": participantId})
+		return c.Redirect(fmt.Sprintf("/room-details/%d", participant.RoomID))
+	}
+}
+
+// adminFromPasswordToken resolves an admin password link, which stops working once the password changes.
+func adminFromPasswordToken(db *sqlx.DB, encryptionKey []byte, token string) (RoomAdmin, error) {
+	adminId, fingerprint, err := parseAdminPasswordToken(encryptionKey, token, time.Now().UTC())
+	if err != nil {
+		return RoomAdmin{}, fmt.Errorf("Invalid link: %s", err)
+	}
+
+	admin, err := dbGetOneRoomAdmin(db, adminId)
+	if err != nil || passwordFingerprint(admin.AdminPassword) != fingerprint {
+		return RoomAdmin{}, errors.New("This link has already been used")
+	}
+
+	return admin, nil
+}
+
+func handleGetAdminSetPassword(db *sqlx.DB, encryptionKey []byte) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		admin, err := adminFromPasswordToken(db, encryptionKey, c.Params("token"))
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+
+		room, err := dbGetOneRoom(db, admin.RoomID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", admin.RoomID, err))
+		}
+
+		return c.Render("admin-set-password", fiber.Map{
+			"Room":    room,
+			"Invited": admin.AdminPassword == "",
+			"Token":   c.Params("token"),
+		})
+	}
+}
+
+func handlePostAdminSetPassword(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		admin, err := adminFromPasswordToken(db, encryptionKey, c.Params("token"))
+		if err != nil {
+			return c.Status(fiber.StatusForbidden).SendString(err.Error())
+		}
+
+		password := c.FormValue("adminPassword")
+		if password == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("Password is required")
+		}
+
+		err = dbSetAdminPassword(db, admin.ID, password)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error setting password: %s", err))
+		}
+
+		sess, _ := store.Get(c)
+		if err := sess.Regenerate(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Cannot start session")
+		}
+		sess.Set("roomAccess", admin.RoomID)
+		sess.Set("joinAccess", admin.RoomID)
+		sess.Set("roomAdmin", admin.RoomID)
+		sess.Set("adminId", admin.ID)
+		sess.Save()
+
+		requestLogger(c).Info("Set admin password", "roomId", admin.RoomID, "adminId", admin.ID)
+		audit.Record(c, admin.RoomID, actorAdmin, "admin.password_set", map[string]interface{}{"adminId": admin.ID})
+		return c.Redirect(fmt.Sprintf("/room-details/%d/admin", admin.RoomID))
+	}
+}
+
+// handlePostExportRoom is a POST because every export is recorded and shown to participants.
+func handlePostExportRoom(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		format := c.FormValue("format", "csv")
+		if format != "csv" && format != "json" {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Unsupported export format: %s", format))
+		}
+
+		export, err := buildRoomExport(db, roomId, encryptionKey, roomClockNow())
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error exporting room: %s", err))
+		}
+
+		err = dbCreateRoomExportRecord(db, roomId, format, export.IncludeAssignments)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error recording export: %s", err))
+		}
+
+		requestLogger(c).Info("Exported room", "roomId", roomId, "format", format)
+		audit.Record(c, roomId, actorAdmin, "room.exported", map[string]interface{}{"format": format, "includeAssignments": export.IncludeAssignments})
+
+		c.Attachment(fmt.Sprintf("room-%d.%s", roomId, format))
+		if format == "json" {
+			return c.JSON(export)
+		}
+
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		return writeRoomExportCSV(c, export)
+	}
+}
+
+func handleGetExportAuditEvents(db *sqlx.DB, store *session.Store, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+		}
+
+		sess, err := store.Get(c)
+		if err != nil || sess.Get("roomAdmin") != roomId {
+			return c.Redirect(fmt.Sprintf("/room-details/%d/admin", roomId))
+		}
+
+		format := c.Query("format", "csv")
+		if format != "csv" && format != "json" {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Unsupported export format: %s", format))
+		}
+
+		events, err := dbGetAuditEventsForRoom(db, roomId, 0)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error exporting audit log: %s", err))
+		}
+
+		audit.Record(c, roomId, actorAdmin, "audit.exported", map[string]interface{}{"format": format, "events": len(events)})
+
+		c.Attachment(fmt.Sprintf("room-%d-audit.%s", roomId, format))
+		if format == "json" {
+			apiEvents := make([]APIAuditEvent, len(events))
+			for i, event := range events {
+				apiEvents[i] = toAPIAuditEvent(event)
+			}
+			return c.JSON(apiEvents)
+		}
+
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		return writeAuditEventsCSV(c, events)
+	}
+}
+
+/*
+   ##### API Handlers
+*/
+func sendAPIError(c *fiber.Ctx, status int, code string, message string) error {
+	return c.Status(status).JSON(APIErrorResponse{
+		Error: APIError{Code: code, Message: message},
+	})
+}
+
+// sendAPILockout tells a throttled client when it may try its password again.
+func sendAPILockout(c *fiber.Ctx, lockout *LockoutError) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(lockout.RetryAfter.Seconds()+1)))
+	return sendAPIError(c, fiber.StatusTooManyRequests, "too_many_attempts", lockout.Error())
+}
+
+// sendAPIDBError reports a data layer failure, mapping missing rows to 404.
+func sendAPIDBError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return sendAPIError(c, fiber.StatusNotFound, "not_found", "The requested resource does not exist")
+	}
+
+	requestLogger(c).Error("API error", "route", c.Route().Path, "error", err)
+	return sendAPIError(c, fiber.StatusInternalServerError, "internal_error", "Internal Server Error")
+}
+
+// apiRoomSession parses the room ID and checks the session holds the given room grant.
+// When it returns false the error response has already been sent.
+func apiRoomSession(c *fiber.Ctx, store *session.Store, grant string) (int, *session.Session, bool) {
+	roomId, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		sendAPIError(c, fiber.StatusBadRequest, "invalid_room_id", "Invalid room ID")
+		return -1, nil, false
+	}
+
+	sess, err := store.Get(c)
+	if err != nil {
+		sendAPIError(c, fiber.StatusInternalServerError, "internal_error", "Cannot load session")
+		return -1, nil, false
+	}
+
+	if grant != "" && !sessionHasGrant(sess, grant, roomId) {
+		sendAPIError(c, fiber.StatusUnauthorized, "unauthorized", "Authenticate for this room first")
+		return -1, nil, false
+	}
+
+	return roomId, sess, true
+}
+
+func toAPIRoom(room Room, participantCount int) APIRoom {
+	apiRoom := APIRoom{
+		ID:               room.ID,
+		Name:             room.Name,
+		Visibility:       room.Visibility,
+		Slug:             room.Slug,
+		Deadline:         room.Deadline,
+		DrawCompleted:    room.DrawCompleted,
+		RequireApproval:  room.RequireApproval,
+		MaxParticipants:  room.MaxParticipants,
+		ParticipantCount: participantCount,
+	}
+	if room.ExchangeDate.Valid {
+		apiRoom.ExchangeDate = &room.ExchangeDate.Time
+	}
+
+	return apiRoom
+}
+
+func handleAPIGetRooms(db *sqlx.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		page, err := strconv.Atoi(c.Query("page", "1"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		rooms, err := dbGetPublicRooms(db, indexPageSize, (page-1)*indexPageSize)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		roomCount, err := dbCountPublicRooms(db)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		apiRooms := make([]APIRoom, len(rooms))
+		for i, room := range rooms {
+			apiRooms[i] = toAPIRoom(room.Room, room.ParticipantCount)
+		}
+
+		return c.JSON(APIRoomList{
+			Rooms:   apiRooms,
+			Page:    page,
+			HasNext: page*indexPageSize < roomCount,
+		})
+	}
+}
+
+func handleAPIPostRooms(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var data CreateRoomFormData
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		if data.RoomName == "" || data.AdminPassword == "" || data.JoinPassword == "" || data.Deadline == "" {
+			return sendAPIError(c, fiber.StatusBadRequest, "missing_fields", "roomName, adminPassword, joinPassword and deadline are required")
+		}
+
+		roomId, err := dbCreateNewRoom(db, data, encryptionKey)
+		switch {
+		case err == errRoomNameTaken:
+			return sendAPIError(c, fiber.StatusConflict, "room_name_taken", err.Error())
+		case isRoomValidationError(err):
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_room", err.Error())
+		case err != nil:
+			return sendAPIDBError(c, err)
+		}
+		requestLogger(c).Info("Created new room", "roomId", roomId)
+		audit.Record(c, roomId, actorVisitor, "room.created", map[string]interface{}{"visibility": data.Visibility})
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		// The creator knows the admin password, so they are signed in as admin right away
+		sess, err := store.Get(c)
+		if err == nil && sess.Regenerate() == nil {
+			sess.Set("roomAccess", roomId)
+			sess.Set("joinAccess", roomId)
+			sess.Set("roomAdmin", roomId)
+			sess.Save()
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(toAPIRoom(room, 0))
+	}
+}
+
+func handleAPIPostRoomAccess(db *sqlx.DB, store *session.Store, guard *PasswordGuard, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, sess, ok := apiRoomSession(c, store, "")
+		if !ok {
+			return nil
+		}
+
+		var data APIRoomAccessRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		err := guard.Check(roomId, passwordScopeJoin, c.IP(), func() error {
+			return verifyJoinPassword(db, roomId, data.Slug, data.JoinPassword)
+		})
+
+		var lockout *LockoutError
+		switch {
+		case errors.As(err, &lockout):
+			return sendAPILockout(c, lockout)
+		case err == errInvalidPassword:
+			return sendAPIError(c, fiber.StatusUnauthorized, "invalid_password", "Invalid join password")
+		case err == errRoomNotJoinable:
+			return sendAPIError(c, fiber.StatusForbidden, "invite_required", err.Error())
+		case err != nil:
+			return sendAPIDBError(c, err)
+		}
+
+		if err := sess.Regenerate(); err != nil {
+			return sendAPIError(c, fiber.StatusInternalServerError, "internal_error", "Cannot start session")
+		}
+		sess.Set("roomAccess", roomId)
+		sess.Set("joinAccess", roomId)
+		sess.Save()
+		audit.Record(c, roomId, actorVisitor, "room.accessed", nil)
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func handleAPIGetRoom(db *sqlx.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAccess")
+		if !ok {
+			return nil
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		participants, err := dbGetApprovedParticipantsForRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		return c.JSON(toAPIRoom(room, len(participants)))
+	}
+}
+
+func handleAPIGetParticipants(db *sqlx.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAccess")
+		if !ok {
+			return nil
+		}
+
+		participants, err := dbGetApprovedParticipantsForRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		apiParticipants := make([]APIParticipant, len(participants))
+		for i, participant := range participants {
+			apiParticipants[i] = toAPIParticipant(participant)
+		}
+
+		return c.JSON(apiParticipants)
+	}
+}
+
+func toAPIParticipant(participant Participant) APIParticipant {
+	return APIParticipant{
+		ID:       participant.ID,
+		Name:     participant.Name,
+		Wishlist: participant.Wishlist,
+		Status:   participant.Status,
+		JoinedAt: participant.CreatedAt,
+	}
+}
+
+func handleAPIPostParticipants(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, notifier *Notifier, metrics *Metrics, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, sess, ok := apiRoomSession(c, store, "joinAccess")
+		if !ok {
+			return nil
+		}
+
+		var data CreateParticipantFormData
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		if err := fillMagicLinkPassword(&data, emailConfig); err != nil {
+			return sendAPIDBError(c, err)
+		}
+		if data.Name == "" || data.ParticipantPassword == "" {
+			return sendAPIError(c, fiber.StatusBadRequest, "missing_fields", "name, email and participantPassword are required")
+		}
+		if address, err := netMail.ParseAddress(data.Email); err != nil || address.Address != data.Email {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_email", "Invalid email address")
+		}
+
+		inviteId, _ := sess.Get("inviteId").(int)
+		participantId, err := joinRoom(db, roomId, data, inviteId, encryptionKey, notifier, metrics, requestLogger(c))
+		if err == errInviteUnavailable {
+			clearInvite(sess, roomId, false)
+			sess.Save()
+			return sendAPIError(c, fiber.StatusForbidden, "invite_unavailable", err.Error())
+		}
+		if err == errInviteEmailMismatch {
+			return sendAPIError(c, fiber.StatusForbidden, "invite_email_mismatch", err.Error())
+		}
+		if err == errRoomNotJoinable {
+			return sendAPIError(c, fiber.StatusForbidden, "invite_required", err.Error())
+		}
+		if err == errEmailTaken {
+			return sendAPIError(c, fiber.StatusConflict, "email_taken", err.Error())
+		}
+		if err == errNameTaken {
+			return sendAPIError(c, fiber.StatusConflict, "name_taken", err.Error())
+		}
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+		audit.Record(c, roomId, actorVisitor, "participant.joined", map[string]interface{}{"participantId": participantId, "inviteId": inviteId})
+
+		if inviteId != 0 {
+			clearInvite(sess, roomId, true)
+			sess.Save()
+		}
+
+		participant, err := dbGetOneParticipant(db, participantId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		return c.Status(fiber.StatusCreated).JSON(toAPIParticipant(participant))
+	}
+}
+
+func handleAPIPostAdminSession(db *sqlx.DB, store *session.Store, encryptionKey []byte, guard *PasswordGuard, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, sess, ok := apiRoomSession(c, store, "")
+		if !ok {
+			return nil
+		}
+
+		var data APIAdminSessionRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		var admin RoomAdmin
+		err := guard.Check(roomId, passwordScopeAdmin, c.IP(), func() error {
+			var err error
+			admin, err = verifyAdminPassword(db, encryptionKey, roomId, data.Email, data.AdminPassword)
+			return err
+		})
+
+		var lockout *LockoutError
+		if errors.As(err, &lockout) {
+			return sendAPILockout(c, lockout)
+		}
+		if err == errInvalidPassword {
+			return sendAPIError(c, fiber.StatusUnauthorized, "invalid_password", "Invalid admin password")
+		}
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		if err := sess.Regenerate(); err != nil {
+			return sendAPIError(c, fiber.StatusInternalServerError, "internal_error", "Cannot start session")
+		}
+		sess.Set("roomAccess", roomId)
+		sess.Set("joinAccess", roomId)
+		sess.Set("roomAdmin", roomId)
+		sess.Set("adminId", admin.ID)
+		sess.Save()
+		audit.Record(c, roomId, actorAdmin, "admin.signed_in", map[string]interface{}{"adminId": admin.ID})
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func toAPIRoomAdmin(admin RoomAdmin) APIRoomAdmin {
+	return APIRoomAdmin{
+		ID:        admin.ID,
+		Email:     admin.Email,
+		Pending:   admin.AdminPassword == "",
+		CreatedAt: admin.CreatedAt,
+	}
+}
+
+func handleAPIGetAdmins(db *sqlx.DB, store *session.Store, encryptionKey []byte) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		admins, err := getAdminsWithEmail(db, roomId, encryptionKey)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		apiAdmins := make([]APIRoomAdmin, len(admins))
+		for i, admin := range admins {
+			apiAdmins[i] = toAPIRoomAdmin(admin)
+		}
+		return c.JSON(apiAdmins)
+	}
+}
+
+func handleAPIPostAdmins(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		var data APIRoomAdminRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		address, err := netMail.ParseAddress(strings.TrimSpace(data.Email))
+		if err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_email", "Invalid email address")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		admin, err := inviteRoomAdmin(db, room, address.Address, c.BaseURL(), encryptionKey, emailConfig, requestLogger(c))
+		if err == errAdminEmailNotConfigured {
+			return sendAPIError(c, fiber.StatusServiceUnavailable, "not_configured", "Admin invitation emails are not configured")
+		}
+		if err == errAdminExists {
+			return sendAPIError(c, fiber.StatusConflict, "admin_exists", err.Error())
+		}
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+		audit.Record(c, roomId, actorAdmin, "admin.invited", map[string]interface{}{"adminId": admin.ID})
+
+		admin.Email = address.Address
+		return c.Status(fiber.StatusCreated).JSON(toAPIRoomAdmin(admin))
+	}
+}
+
+// handleAPIPostAdminPasswordReset always accepts a well-formed request so it cannot be used to find admin addresses.
+func handleAPIPostAdminPasswordReset(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "")
+		if !ok {
+			return nil
+		}
+
+		var data APIRoomAdminRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		if _, err := netMail.ParseAddress(strings.TrimSpace(data.Email)); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_email", "Invalid email address")
+		}
+
+		if emailConfig.AdminPasswordTemplateID == "" {
+			return sendAPIError(c, fiber.StatusServiceUnavailable, "not_configured", "Admin password reset emails are not configured")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		startAdminPasswordReset(c, db, room, data.Email, encryptionKey, emailConfig, audit)
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
+
+func handleAPIPutVisibility(db *sqlx.DB, store *session.Store, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		var data APIVisibilityRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		if !isValidRoomVisibility(data.Visibility) {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_visibility", "Visibility must be one of public, unlisted or private")
+		}
+
+		err := dbSetRoomVisibility(db, roomId, data.Visibility)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		requestLogger(c).Info("Set room visibility", "roomId", roomId, "visibility", data.Visibility)
+		audit.Record(c, roomId, actorAdmin, "room.visibility_changed", map[string]interface{}{"visibility": data.Visibility})
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func handleAPIPutRegistration(db *sqlx.DB, store *session.Store, notifier *Notifier, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		var data APIRegistrationRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		err = updateRoomRegistration(db, room, data.RequireApproval, data.MaxParticipants, notifier, audit, c)
+		if err == errInvalidCapacity {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_capacity", err.Error())
+		}
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func handleAPIGetJoinRequests(db *sqlx.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		participants, err := dbGetJoinRequestsForRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		apiParticipants := make([]APIParticipant, len(participants))
+		for i, participant := range participants {
+			apiParticipants[i] = toAPIParticipant(participant)
+		}
+		return c.JSON(apiParticipants)
+	}
+}
+
+func handleAPIPostApproveParticipant(db *sqlx.DB, store *session.Store, notifier *Notifier, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		participantId, err := strconv.Atoi(c.Params("participantId"))
+		if err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_participant_id", "Invalid participant ID")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		if _, err := approveParticipant(db, room, participantId, notifier, audit, c); err == errNotWaiting {
+			return sendAPIError(c, fiber.StatusConflict, "not_waiting", err.Error())
+		} else if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		participant, err := dbGetOneParticipant(db, participantId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+		return c.JSON(toAPIParticipant(participant))
+	}
+}
+
+func handleAPIPostRejectParticipant(db *sqlx.DB, store *session.Store, notifier *Notifier, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		participantId, err := strconv.Atoi(c.Params("participantId"))
+		if err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_participant_id", "Invalid participant ID")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		if err := rejectParticipant(db, room, participantId, notifier, audit, c); err == errNotWaiting {
+			return sendAPIError(c, fiber.StatusConflict, "not_waiting", err.Error())
+		} else if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func toAPIInvite(invite InviteWithURL) APIInvite {
+	return APIInvite{
+		ID:        invite.ID,
+		Email:     invite.Email,
+		MaxUses:   invite.MaxUses,
+		Uses:      invite.Uses,
+		ExpiresAt: invite.ExpiresAt,
+		URL:       invite.URL,
+	}
+}
+
+func handleAPIGetInvites(db *sqlx.DB, store *session.Store, encryptionKey []byte) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		invites, err := getInvitesWithURL(db, roomId, c.BaseURL(), encryptionKey)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		apiInvites := make([]APIInvite, len(invites))
+		for i, invite := range invites {
+			apiInvites[i] = toAPIInvite(invite)
+		}
+
+		return c.JSON(apiInvites)
+	}
+}
+
+func handleAPIPostInvites(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		var data CreateInviteFormData
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		invite, err := createInviteLink(db, roomId, data, encryptionKey, requestLogger(c))
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+		audit.Record(c, roomId, actorAdmin, "invite.created", map[string]interface{}{"inviteId": invite.ID, "maxUses": invite.MaxUses, "expiresAt": invite.ExpiresAt})
+
+		return c.Status(fiber.StatusCreated).JSON(toAPIInvite(InviteWithURL{
+			Invite: invite,
+			URL:    fmt.Sprintf("%s/invite/%s", c.BaseURL(), inviteToken(encryptionKey, invite)),
+		}))
+	}
+}
+
+func handleAPIPostInvitations(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		var data APIInvitationsRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		emails, invalid := parseEmailList(strings.Join(data.Emails, ","))
+		if len(invalid) > 0 {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_email", fmt.Sprintf("Invalid email addresses: %s", strings.Join(invalid, ", ")))
+		}
+
+		if emailConfig.InviteTemplateID == "" {
+			return sendAPIError(c, fiber.StatusServiceUnavailable, "not_configured", "Email invitations are not configured")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		sent, err := sendInvitations(db, room, emails, data.ExpiresInDays, c.BaseURL(), encryptionKey, emailConfig, requestLogger(c))
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+		audit.Record(c, roomId, actorAdmin, "invitations.sent", map[string]interface{}{"requested": len(emails), "sent": sent})
+
+		return c.JSON(APIInvitationsResponse{Sent: sent})
+	}
+}
+
+func handleAPIPostExport(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		export, err := buildRoomExport(db, roomId, encryptionKey, roomClockNow())
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		err = dbCreateRoomExportRecord(db, roomId, "json", export.IncludeAssignments)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		requestLogger(c).Info("Exported room", "roomId", roomId, "format", "json")
+		audit.Record(c, roomId, actorAdmin, "room.exported", map[string]interface{}{"format": "json", "includeAssignments": export.IncludeAssignments})
+		return c.JSON(export)
+	}
+}
+
+func handleAPIGetAuditEvents(db *sqlx.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "roomAdmin")
+		if !ok {
+			return nil
+		}
+
+		events, err := dbGetAuditEventsForRoom(db, roomId, 0)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		apiEvents := make([]APIAuditEvent, len(events))
+		for i, event := range events {
+			apiEvents[i] = toAPIAuditEvent(event)
+		}
+
+		return c.JSON(apiEvents)
+	}
+}
+
+func handleAPIPostParticipantSession(db *sqlx.DB, store *session.Store, guard *PasswordGuard, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, sess, ok := apiRoomSession(c, store, "")
+		if !ok {
+			return nil
+		}
+
+		var data APIParticipantSessionRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		var participant Participant
+		err := guard.Check(roomId, passwordScopeParticipant, c.IP(), func() error {
+			var err error
+			participant, err = verifyParticipantPassword(db, roomId, data.Name, data.ParticipantPassword)
+			return err
+		})
+
+		var lockout *LockoutError
+		if errors.As(err, &lockout) {
+			return sendAPILockout(c, lockout)
+		}
+		if err == errInvalidPassword {
+			return sendAPIError(c, fiber.StatusUnauthorized, "invalid_password", "Invalid name or password")
+		}
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		if err := sess.Regenerate(); err != nil {
+			return sendAPIError(c, fiber.StatusInternalServerError, "internal_error", "Cannot start session")
+		}
+		sess.Set("roomAccess", roomId)
+		sess.Set("participantId", participant.ID)
+		sess.Save()
+		audit.Record(c, roomId, actorParticipant, "participant.signed_in", map[string]interface{}{"participantId": participant.ID})
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// apiParticipantSession loads the participant signed in to the room.
+// When it returns false the error response has already been sent.
+func apiParticipantSession(c *fiber.Ctx, db *sqlx.DB, store *session.Store) (Participant, *session.Session, bool) {
+	roomId, sess, ok := apiRoomSession(c, store, "roomAccess")
+	if !ok {
+		return Participant{}, nil, false
+	}
+
+	participant, err := sessionParticipant(db, sess, roomId)
+	if err == errNotSignedIn {
+		sendAPIError(c, fiber.StatusUnauthorized, "unauthorized", "Sign in as a participant of this room first")
+		return Participant{}, nil, false
+	}
+	if err != nil {
+		sendAPIDBError(c, err)
+		return Participant{}, nil, false
+	}
+
+	return participant, sess, true
+}
+
+func handleAPIGetMyAssignment(db *sqlx.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participant, _, ok := apiParticipantSession(c, db, store)
+		if !ok {
+			return nil
+		}
+		roomId := participant.RoomID
+
+		assignment, err := getMyAssignment(db, participant)
+		if err == errNoAssignment {
+			return sendAPIError(c, fiber.StatusNotFound, "no_assignment", err.Error())
+		}
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		giftee, err := dbGetOneParticipant(db, assignment.GifteeID)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		apiAssignment := APIAssignment{
+			GifteeName:     giftee.Name,
+			GifteeWishlist: giftee.Wishlist,
+		}
+		if room.ExchangeDate.Valid {
+			apiAssignment.ExchangeDate = &room.ExchangeDate.Time
+		}
+
+		return c.JSON(apiAssignment)
+	}
+}
+
+func handleAPIGetMyData(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participant, _, ok := apiParticipantSession(c, db, store)
+		if !ok {
+			return nil
+		}
+
+		data, err := buildParticipantDataExport(db, participant, encryptionKey, time.Now().UTC())
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+		audit.Record(c, participant.RoomID, actorParticipant, "participant.data_exported", map[string]interface{}{"participantId": participant.ID})
+
+		return c.JSON(data)
+	}
+}
+
+func handleAPIDeleteMe(db *sqlx.DB, store *session.Store, encryptionKey []byte, notifier *Notifier, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participant, sess, ok := apiParticipantSession(c, db, store)
+		if !ok {
+			return nil
+		}
+
+		anonymized, err := eraseParticipant(db, participant, encryptionKey, notifier, audit, c)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		sess.Delete("participantId")
+		sess.Save()
+		return c.JSON(APIErasureResponse{Anonymized: anonymized})
+	}
+}
+
+// handleAPIPostMagicLink always accepts a well-formed request so it cannot be used to find participant addresses.
+func handleAPIPostMagicLink(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, _, ok := apiRoomSession(c, store, "")
+		if !ok {
+			return nil
+		}
+
+		var data APIMagicLinkRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		if _, err := netMail.ParseAddress(strings.TrimSpace(data.Email)); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_email", "Invalid email address")
+		}
+
+		if !magicLinksEnabled(emailConfig) {
+			return sendAPIError(c, fiber.StatusNotFound, "not_enabled", "Sign-in links are not enabled")
+		}
+
+		room, err := dbGetOneRoom(db, roomId)
+		if err != nil {
+			return sendAPIDBError(c, err)
+		}
+
+		startMagicLinks(c, db, room, data.Email, encryptionKey, emailConfig, audit)
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
+
+func handleAPIPostMagicLinkSession(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, sess, ok := apiRoomSession(c, store, "")
+		if !ok {
+			return nil
+		}
+
+		var data APIMagicLinkSessionRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		participant, err := participantFromMagicLink(db, encryptionKey, data.Token)
+		if err == nil && participant.RoomID != roomId {
+			err = errNotSignedIn
+		}
+		if err == nil {
+			err = useMagicLink(db, participant)
+		}
+		if err != nil {
+			return sendAPIError(c, fiber.StatusUnauthorized, "invalid_token", "This sign-in link is invalid, used or has expired")
+		}
+
+		if err := sess.Regenerate(); err != nil {
+			return sendAPIError(c, fiber.StatusInternalServerError, "internal_error", "Cannot start session")
+		}
+		sess.Set("roomAccess", roomId)
+		sess.Set("participantId", participant.ID)
+		sess.Save()
+		audit.Record(c, roomId, actorParticipant, "participant.signed_in", map[string]interface{}{"participantId": participant.ID, "method": "magic_link"})
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// sendAPISelfServiceError reports a failed participant self-service action.
+func sendAPISelfServiceError(c *fiber.Ctx, err error) error {
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		return sendAPILockout(c, lockout)
+	}
+
+	switch err {
+	case errNameRequired, errInvalidEmail, errPasswordRequired:
+		return sendAPIError(c, fiber.StatusBadRequest, "invalid_input", err.Error())
+	case errInvalidPassword:
+		return sendAPIError(c, fiber.StatusUnauthorized, "invalid_password", "Current password is incorrect")
+	case errNameTaken:
+		return sendAPIError(c, fiber.StatusConflict, "name_taken", err.Error())
+	case errEmailTaken:
+		return sendAPIError(c, fiber.StatusConflict, "email_taken", err.Error())
+	case errNameLocked:
+		return sendAPIError(c, fiber.StatusConflict, "name_locked", err.Error())
+	case errRegistrationClosed:
+		return sendAPIError(c, fiber.StatusConflict, "registration_closed", err.Error())
+	}
+	return sendAPIDBError(c, err)
+}
+
+func handleAPIPutMe(db *sqlx.DB, store *session.Store, encryptionKey []byte, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participant, _, ok := apiParticipantSession(c, db, store)
+		if !ok {
+			return nil
+		}
+
+		var data APIProfileRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		if err := updateParticipantProfile(db, participant, data.Name, data.Email, encryptionKey, audit, c); err != nil {
+			return sendAPISelfServiceError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func handleAPIPutMyPassword(db *sqlx.DB, store *session.Store, guard *PasswordGuard, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participant, _, ok := apiParticipantSession(c, db, store)
+		if !ok {
+			return nil
+		}
+
+		var data APIPasswordChangeRequest
+		if err := c.BodyParser(&data); err != nil {
+			return sendAPIError(c, fiber.StatusBadRequest, "invalid_body", fmt.Sprintf("Error parsing request body: %s", err))
+		}
+
+		if err := changeParticipantPassword(db, participant, data.CurrentPassword, data.NewPassword, guard, audit, c); err != nil {
+			return sendAPISelfServiceError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func handleAPIPostLeave(db *sqlx.DB, store *session.Store, notifier *Notifier, audit *Auditor) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		participant, sess, ok := apiParticipantSession(c, db, store)
+		if !ok {
+			return nil
+		}
+
+		if err := leaveRoom(db, participant, notifier, audit, c); err != nil {
+			return sendAPISelfServiceError(c, err)
+		}
+
+		sess.Delete("participantId")
+		sess.Save()
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+func apiOperations(db *sqlx.DB, store *session.Store, encryptionKey []byte, emailConfig EmailConfig, notifier *Notifier, metrics *Metrics, guard *PasswordGuard, audit *Auditor) []APIOperation {
+	return []APIOperation{
+		{
+			Method: fiber.MethodGet, Path: "/rooms", Summary: "List public rooms",
+			Response: APIRoomList{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetRooms(db),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms", Summary: "Create a room and sign in as its admin",
+			Request: CreateRoomFormData{}, Response: APIRoom{}, SuccessStatus: fiber.StatusCreated,
+			Handler: handleAPIPostRooms(db, store, encryptionKey, audit),
+		},
+		{
+			Method: fiber.MethodGet, Path: "/rooms/:id", Summary: "Get a room", Auth: "roomAccess",
+			Response: APIRoom{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetRoom(db, store),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/access", Summary: "Enter a room with its join password",
+			Request: APIRoomAccessRequest{}, SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPostRoomAccess(db, store, guard, audit),
+		},
+		{
+			Method: fiber.MethodGet, Path: "/rooms/:id/participants", Summary: "List the participants of a room", Auth: "roomAccess",
+			Response: []APIParticipant{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetParticipants(db, store),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/participants", Summary: "Join a room", Auth: "joinAccess",
+			Request: CreateParticipantFormData{}, Response: APIParticipant{}, SuccessStatus: fiber.StatusCreated,
+			Handler: handleAPIPostParticipants(db, store, encryptionKey, emailConfig, notifier, metrics, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/participant-session", Summary: "Sign in as a participant",
+			Request: APIParticipantSessionRequest{}, SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPostParticipantSession(db, store, guard, audit),
+		},
+		{
+			Method: fiber.MethodGet, Path: "/rooms/:id/my-assignment", Summary: "Get the signed in participant's giftee", Auth: "participantId",
+			Response: APIAssignment{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetMyAssignment(db, store),
+		},
+		{
+			Method: fiber.MethodGet, Path: "/rooms/:id/me/data", Summary: "Download everything held about the signed in participant", Auth: "participantId",
+			Response: ParticipantDataExport{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetMyData(db, store, encryptionKey, audit),
+		},
+		{
+			Method: fiber.MethodDelete, Path: "/rooms/:id/me", Summary: "Erase the signed in participant; after the draw they are anonymized instead", Auth: "participantId",
+			Response: APIErasureResponse{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIDeleteMe(db, store, encryptionKey, notifier, audit),
+		},
+		{
+			Method: fiber.MethodPut, Path: "/rooms/:id/me", Summary: "Change the signed in participant's name and email", Auth: "participantId",
+			Request: APIProfileRequest{}, SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPutMe(db, store, encryptionKey, audit),
+		},
+		{
+			Method: fiber.MethodPut, Path: "/rooms/:id/me/password", Summary: "Change the signed in participant's password", Auth: "participantId",
+			Request: APIPasswordChangeRequest{}, SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPutMyPassword(db, store, guard, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/me/leave", Summary: "Leave the room before registration closes", Auth: "participantId",
+			SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPostLeave(db, store, notifier, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/admin-session", Summary: "Sign in as the room admin",
+			Request: APIAdminSessionRequest{}, SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPostAdminSession(db, store, encryptionKey, guard, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/magic-link", Summary: "Email a participant a short-lived sign-in link",
+			Request: APIMagicLinkRequest{}, SuccessStatus: fiber.StatusAccepted,
+			Handler: handleAPIPostMagicLink(db, store, encryptionKey, emailConfig, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/magic-link-session", Summary: "Sign in as a participant with the token from a sign-in link",
+			Request: APIMagicLinkSessionRequest{}, SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPostMagicLinkSession(db, store, encryptionKey, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/admin-password-reset", Summary: "Email an admin a password reset link",
+			Request: APIRoomAdminRequest{}, SuccessStatus: fiber.StatusAccepted,
+			Handler: handleAPIPostAdminPasswordReset(db, store, encryptionKey, emailConfig, audit),
+		},
+		{
+			Method: fiber.MethodGet, Path: "/rooms/:id/admins", Summary: "List the room's admins", Auth: "roomAdmin",
+			Response: []APIRoomAdmin{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetAdmins(db, store, encryptionKey),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/admins", Summary: "Invite a co-organizer", Auth: "roomAdmin",
+			Request: APIRoomAdminRequest{}, Response: APIRoomAdmin{}, SuccessStatus: fiber.StatusCreated,
+			Handler: handleAPIPostAdmins(db, store, encryptionKey, emailConfig, audit),
+		},
+		{
+			Method: fiber.MethodPut, Path: "/rooms/:id/visibility", Summary: "Change room visibility", Auth: "roomAdmin",
+			Request: APIVisibilityRequest{}, SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPutVisibility(db, store, audit),
+		},
+		{
+			Method: fiber.MethodPut, Path: "/rooms/:id/registration", Summary: "Change whether joiners need approval and the participant limit", Auth: "roomAdmin",
+			Request: APIRegistrationRequest{}, SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPutRegistration(db, store, notifier, audit),
+		},
+		{
+			Method: fiber.MethodGet, Path: "/rooms/:id/join-requests", Summary: "List pending and waitlisted joiners, oldest first", Auth: "roomAdmin",
+			Response: []APIParticipant{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetJoinRequests(db, store),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/participants/:participantId/approve", Summary: "Approve a join request; the joiner is waitlisted if the room is full", Auth: "roomAdmin",
+			Response: APIParticipant{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIPostApproveParticipant(db, store, notifier, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/participants/:participantId/reject", Summary: "Reject a pending or waitlisted joiner", Auth: "roomAdmin",
+			SuccessStatus: fiber.StatusNoContent,
+			Handler: handleAPIPostRejectParticipant(db, store, notifier, audit),
+		},
+		{
+			Method: fiber.MethodGet, Path: "/rooms/:id/invites", Summary: "List invite links", Auth: "roomAdmin",
+			Response: []APIInvite{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetInvites(db, store, encryptionKey),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/invites", Summary: "Create an invite link", Auth: "roomAdmin",
+			Request: CreateInviteFormData{}, Response: APIInvite{}, SuccessStatus: fiber.StatusCreated,
+			Handler: handleAPIPostInvites(db, store, encryptionKey, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/invitations", Summary: "Email single-use invites", Auth: "roomAdmin",
+			Request: APIInvitationsRequest{}, Response: APIInvitationsResponse{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIPostInvitations(db, store, encryptionKey, emailConfig, audit),
+		},
+		{
+			Method: fiber.MethodPost, Path: "/rooms/:id/export", Summary: "Export participants and, after the exchange, assignments; participants see that it happened", Auth: "roomAdmin",
+			Response: RoomExport{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIPostExport(db, store, encryptionKey, audit),
+		},
+		{
+			Method: fiber.MethodGet, Path: "/rooms/:id/audit-events", Summary: "List the room's audit log, newest first", Auth: "roomAdmin",
+			Response: []APIAuditEvent{}, SuccessStatus: fiber.StatusOK,
+			Handler: handleAPIGetAuditEvents(db, store),
+		},
+	}
+}
+
+func registerAPIRoutes(router fiber.Router, operations []APIOperation) {
+	for _, operation := range operations {
+		router.Add(operation.Method, operation.Path, operation.Handler)
+	}
+
+	spec := buildOpenAPISpec(operations)
+	router.Get("/openapi.json", func(c *fiber.Ctx) error {
+		return c.JSON(spec)
+	})
+}
+
+// buildOpenAPISpec generates the OpenAPI document for the operations, deriving schemas from their Go types.
+func buildOpenAPISpec(operations []APIOperation) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": openAPISchema(reflect.TypeOf(APIErrorResponse{}), schemas),
+			},
+		},
+	}
+
+	paths := map[string]interface{}{
+		"/openapi.json": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "This OpenAPI document",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "OK",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": map[string]interface{}{"type": "object"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, operation := range operations {
+		var parameters []interface{}
+		segments := strings.Split(operation.Path, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				name := strings.TrimPrefix(segment, ":")
+				segments[i] = "{" + name + "}"
+				parameters = append(parameters, map[string]interface{}{
+					"name":     name,
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "integer"},
+				})
+			}
+		}
+		path := strings.Join(segments, "/")
+
+		success := map[string]interface{}{"description": http.StatusText(operation.SuccessStatus)}
+		if operation.Response != nil {
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": openAPISchema(reflect.TypeOf(operation.Response), schemas),
+				},
+			}
+		}
+
+		spec := map[string]interface{}{
+			"summary": operation.Summary,
+			"responses": map[string]interface{}{
+				strconv.Itoa(operation.SuccessStatus): success,
+				"default":                             errorResponse,
+			},
+		}
+		if parameters != nil {
+			spec["parameters"] = parameters
+		}
+		if operation.Auth != "" {
+			spec["security"] = []interface{}{map[string]interface{}{"sessionCookie": []string{}}}
+			spec["description"] = fmt.Sprintf("Requires a session holding the %s grant for the room.", operation.Auth)
+		}
+		if operation.Request != nil {
+			spec["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": openAPISchema(reflect.TypeOf(operation.Request), schemas),
+					},
+				},
+			}
+		}
+
+		pathItem, ok := paths[path].(map[string]interface{})
+		if !ok {
+			pathItem = map[string]interface{}{}
+			paths[path] = pathItem
+		}
+		pathItem[strings.ToLower(operation.Method)] = spec
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Secret Santa API",
+			"version": "1",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": "/api/v1"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"sessionCookie": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": "session_id",
+				},
+			},
+		},
+	}
+}
+
+// openAPISchema describes t as an OpenAPI schema, registering named structs under components.
+func openAPISchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := openAPISchema(t.Elem(), schemas)
+		if _, isRef := schema["$ref"]; isRef {
+			return schema
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, exists := schemas[t.Name()]; exists {
+			return ref
+		}
+		// Register before walking the fields so recursive types terminate
+		schemas[t.Name()] = map[string]interface{}{}
+
+		properties := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, omitEmpty, ok := jsonFieldName(field)
+			if !ok {
+				continue
+			}
+			properties[name] = openAPISchema(field.Type, schemas)
+			if !omitEmpty && field.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+
+		schema := map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+		if required != nil {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		schemas[t.Name()] = schema
+		return ref
+	}
+
+	return map[string]interface{}{}
+}
+
+func jsonFieldName(field reflect.StructField) (string, bool, bool) {
+	if field.PkgPath != "" {
+		return "", false, false
+	}
+
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+
+	parts := strings.Split(tag, ",")
+	name := parts[0]
+	if name == "" {
+		name = field.Name
+	}
+
+	omitEmpty := false
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+
+	return name, omitEmpty, true
+}
+
+/*
+   ##### Utils
+*/
+func AssignSecretSanta(participants []Participant) ([]Assignment, error) {
+    if len(participants) < 2 {
+        return nil, errors.New("a minimum of 2 participants is required")
+    }
+
+    // Create a list of Assignments
+    assignments := make([]Assignment, len(participants))
+    for i, p := range participants {
+        assignments[i] = Assignment{
+            Participant: p, 
+            GifteeName: p.Name, 
+        }
+    }
+
+    // Randomly shuffle the list until no one would gift a member of their own exclusion group.
+    mRand.Seed(time.Now().UnixNano())
+    for attempt := 0; ; attempt++ {
+        if attempt == maxAssignAttempts {
+            return nil, errors.New("cannot assign giftees without violating exclusion groups")
+        }
+
+        mRand.Shuffle(len(assignments), func(i, j int) { 
+            assignments[i], assignments[j] = assignments[j], assignments[i] 
+        })
+
+        if respectsExclusionGroups(assignments) {
+            break
+        }
+    }
+
+    // Shift the giftees by one
+    for i := 0; i < len(assignments); i++ {
+        gifteeIdx := (i + 1) % len(assignments)
+        assignments[i].GifteeID = assignments[gifteeIdx].Participant.ID
+        assignments[i].GifteeName = assignments[gifteeIdx].Participant.Name
+    }
+
+    return assignments, nil
+}
+
+// respectsExclusionGroups reports whether no one in the shuffled cycle is followed by a member of their own exclusion group.
+func respectsExclusionGroups(assignments []Assignment) bool {
+	for i := range assignments {
+		group := assignments[i].Participant.ExclusionGroup
+		next := assignments[(i+1)%len(assignments)].Participant.ExclusionGroup
+		if group != "" && group == next {
+			return false
+		}
+	}
+	return true
+}
+
+func sendEmail(emailConfig EmailConfig, assignment Assignment) error {
+	return sendTemplateEmail(emailConfig, assignment.Participant.Name, assignment.Participant.Email, emailConfig.AssignmentTemplateID, map[string]interface{}{
+		"Name":   assignment.Participant.Name,
+		"Giftee": assignment.GifteeName,
+	})
+}
+
+func sendTemplateEmail(emailConfig EmailConfig, toName string, toEmail string, templateID string, data map[string]interface{}) error {
+    // Sender and recipient information
+    from := mail.NewEmail("Raul", emailConfig.From)
+    to := mail.NewEmail(toName, toEmail)
+
+    // Create a new SendGrid message
+    message := mail.NewV3Mail()
+
+    // Set the 'from' address
+    message.SetFrom(from)
+
+    // Create a personalization object
+    p := mail.NewPersonalization()
+    p.AddTos(to)
+
+    // Set dynamic template data based on your template placeholders
+    for key, value := range data {
+        p.SetDynamicTemplateData(key, value)
+    }
+
+    // Add personalization to the message
+    message.AddPersonalizations(p)
+
+    // Set the Template ID from SendGrid
+    message.SetTemplateID(templateID)
+
+    // Create a SendGrid client and send the message
+    client := sendgrid.NewSendClient(emailConfig.APIKey)
+    response, err := client.Send(message)
+    if err != nil {
+        emailConfig.metrics.Inc("secret_santa_emails_total", "provider", "sendgrid", "result", "failed")
+        return err
+    }
+    // SendGrid reports rejected messages through the status code rather than an error
+    if response.StatusCode >= 300 {
+        emailConfig.metrics.Inc("secret_santa_emails_total", "provider", "sendgrid", "result", "failed")
+        return fmt.Errorf("sendgrid responded with status %d", response.StatusCode)
+    }
+    emailConfig.metrics.Inc("secret_santa_emails_total", "provider", "sendgrid", "result", "sent")
+
+    logger.Debug("Email sent", "templateId", templateID, "status", response.StatusCode)
+    return nil
+}
+
+func isValidRoomVisibility(visibility string) bool {
+	switch visibility {
+	case roomVisibilityPublic, roomVisibilityUnlisted, roomVisibilityPrivate:
+		return true
+	}
+	return false
+}
+
+// isReminderDue reports whether now falls within the daysBefore window leading up to target.
+func isReminderDue(now time.Time, target time.Time, daysBefore int) bool {
+	if daysBefore <= 0 {
+		return false
+	}
+
+	windowStart := target.Add(-time.Duration(daysBefore) * 24 * time.Hour)
+	return !now.Before(windowStart) && now.Before(target)
+}
+
+func sendReminderOnce(db *sqlx.DB, notifier *Notifier, logger *Logger, roomId int, kind string, participantId int, send func() error) {
+	claimed, err := dbClaimReminder(db, roomId, kind, participantId)
+	if err != nil {
+		logger.Error("Error recording reminder", "kind", kind, "roomId", roomId, "participantId", participantId, "error", err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	if err := send(); err != nil {
+		logger.Error("Failed to send reminder", "kind", kind, "roomId", roomId, "participantId", participantId, "error", err)
+		// Release the claim so the next scheduler run retries
+		if err := dbReleaseReminder(db, roomId, kind, participantId); err != nil {
+			logger.Error("Error releasing reminder", "kind", kind, "roomId", roomId, "participantId", participantId, "error", err)
+		}
+		return
+	}
+
+	// Emitted only for the run that sent the reminder, so retries after a failed send don't repeat it
+	notifier.ReminderDue(logger, roomId, kind, participantId)
+}
+
+func sendRoomReminders(db *sqlx.DB, config Config, notifier *Notifier, logger *Logger, room RoomWithParticipantCount, now time.Time) {
+	encryptionKey, reminderConfig := config.EncryptionKey, config.Reminders
+
+	if !room.DrawCompleted && room.AdminEmail != "" && reminderConfig.AdminTemplateID != "" &&
+		isReminderDue(now, room.Deadline, reminderConfig.AdminDaysBeforeDeadline) {
+		sendReminderOnce(db, notifier, logger, room.ID, reminderKindAdminDeadline, 0, func() error {
+			adminEmail, err := decryptAES(encryptionKey, room.AdminEmail)
+			if err != nil {
+				return err
+			}
+
+			return sendTemplateEmail(config.Email, room.Name, adminEmail, reminderConfig.AdminTemplateID, map[string]interface{}{
+				"RoomName":         room.Name,
+				"Deadline":         room.Deadline.Format("2006-01-02 15:04"),
+				"ParticipantCount": room.ParticipantCount,
+			})
+		})
+	}
+
+	if room.DrawCompleted && room.ExchangeDate.Valid && reminderConfig.GiverTemplateID != "" &&
+		isReminderDue(now, room.ExchangeDate.Time, reminderConfig.GiverDaysBeforeExchange) {
+		assignments, err := dbGetAssignmentsForRoom(db, room.ID)
+		if err != nil {
+			logger.Error("Error fetching assignments", "roomId", room.ID, "error", err)
+			return
+		}
+
+		for _, assignment := range assignments {
+			if assignment.Participant.ErasedAt.Valid {
+				continue
+			}
+			sendReminderOnce(db, notifier, logger, room.ID, reminderKindGiverExchange, assignment.Participant.ID, func() error {
+				email, err := decryptAES(encryptionKey, assignment.Participant.Email)
+				if err != nil {
+					return err
+				}
+
+				return sendTemplateEmail(config.Email, assignment.Participant.Name, email, reminderConfig.GiverTemplateID, map[string]interface{}{
+					"Name":         assignment.Participant.Name,
+					"Giftee":       assignment.GifteeName,
+					"RoomName":     room.Name,
+					"ExchangeDate": room.ExchangeDate.Time.Format("2006-01-02 15:04"),
+				})
+			})
+		}
+	}
+}
+
+// runRoomDraw assigns giftees for the room and saves them, marking it drawn, then notifies every giver.
+// A room someone else already drew is not reshuffled; only its outstanding notifications are sent.
+func runRoomDraw(ctx context.Context, db *sqlx.DB, encryptionKey []byte, notifier *Notifier, audit *Auditor, logger *Logger, actorType string, room Room) error {
+	logger.Info("Processing draw", "roomId", room.ID)
+
+	// Fetch participants from database; pending, waitlisted and rejected joiners are left out
+	participants, err := dbGetApprovedParticipantsForRoom(db, room.ID)
+	if err != nil {
+		return fmt.Errorf("fetching participants: %w", err)
+	}
+	logger.Debug("Fetched participants for the draw", "roomId", room.ID, "participants", len(participants))
+
+	claimed, err := dbClaimReminder(db, room.ID, reminderKindRegistrationClosed, 0)
+	if err != nil {
+		logger.Error("Error recording registration close", "roomId", room.ID, "error", err)
+	} else if claimed {
+		notifier.RegistrationClosed(logger, room, len(participants))
+		audit.Record(nil, room.ID, actorType, "registration.closed", map[string]interface{}{"participants": len(participants)})
+	}
+
+	// Assign Secret Santa
+	assignments, err := AssignSecretSanta(participants)
+	if err != nil {
+		recordFailure := actorType != actorScheduler
+		if !recordFailure {
+			claimed, claimErr := dbClaimReminder(db, room.ID, reminderKindDrawFailed, 0)
+			if claimErr != nil {
+				logger.Error("Error recording draw failure", "roomId", room.ID, "error", claimErr)
+			}
+			recordFailure = claimed
+		}
+		if recordFailure {
+			audit.Record(nil, room.ID, actorType, "draw.failed", map[string]interface{}{"participants": len(participants), "error": err.Error()})
+		}
+		return fmt.Errorf("assigning Secret Santa: %w", err)
+	}
+	logger.Debug("Secret Santa assigned", "roomId", room.ID)
+
+	// Nothing is persisted or sent yet, so a draw caught by shutdown here is simply dropped and rerun later
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("draw interrupted before saving: %w", err)
+	}
+
+	saved, err := dbSaveDraw(db, room.ID, assignments)
+	if err != nil {
+		return fmt.Errorf("saving assignments: %w", err)
+	}
+	if saved {
+		notifier.DrawCompleted(logger, room, len(assignments))
+		// Only the count is audited; who drew whom lives solely in the assignment table
+		audit.Record(nil, room.ID, actorType, "draw.completed", map[string]interface{}{"assignments": len(assignments)})
+	} else {
+		logger.Info("Room was already drawn, sending outstanding assignments only", "roomId", room.ID)
+	}
+
+	_, err = notifyAssignments(ctx, db, encryptionKey, notifier, logger, room)
+	return err
+}
+
+// assignmentNeedsSending reports whether an assignment still has to go out at now: it was never claimed, or its
+// claim is older than assignmentClaimTimeout and the send was never confirmed, as a crash mid-send leaves it.
+func assignmentNeedsSending(assignment Assignment, now time.Time) bool {
+	if assignment.Participant.ErasedAt.Valid {
+		return false
+	}
+	if !assignment.NotifiedAt.Valid {
+		return true
+	}
+	return !assignment.SentAt.Valid && assignment.NotifiedAt.Time.Before(now.Add(-assignmentClaimTimeout))
+}
+
+// resumeAssignments sends the assignments of a drawn room that a crash, shutdown or failed sends left outstanding.
+func resumeAssignments(ctx context.Context, db *sqlx.DB, encryptionKey []byte, notifier *Notifier, logger *Logger, room Room) error {
+	pending, err := dbHasUnnotifiedAssignments(db, room.ID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("checking for unsent assignments: %w", err)
+	}
+	if !pending {
+		return nil
+	}
+
+	_, err = notifyAssignments(ctx, db, encryptionKey, notifier, logger, room)
+	return err
+}
+
+// notifyAssignments sends each saved assignment of the room that has not been sent yet. Every send is claimed
+// first and confirmed once delivered, so a giver hears about their giftee once however often this runs; failed
+// sends are released and retried by the next scheduler run. A claim a crash left unconfirmed is retried after
+// assignmentClaimTimeout, and since the send may have gone out before the crash that giver may get it twice.
+// It returns how many were sent.
+func notifyAssignments(ctx context.Context, db *sqlx.DB, encryptionKey []byte, notifier *Notifier, logger *Logger, room Room) (int, error) {
+	assignments, err := dbGetAssignmentsForRoom(db, room.ID)
+	if err != nil {
+		return 0, fmt.Errorf("fetching assignments: %w", err)
+	}
+
+	sent, failed := 0, 0
+	for _, assignment := range assignments {
+		if !assignmentNeedsSending(assignment, time.Now().UTC()) {
+			continue
+		}
+		// Stopping between sends is safe, the rest go out on the next run
+		if err := ctx.Err(); err != nil {
+			return sent, fmt.Errorf("sending assignments interrupted: %w", err)
+		}
+
+		claimed, err := dbClaimAssignmentNotification(db, room.ID, assignment.Participant.ID, time.Now().UTC())
+		if err != nil {
+			logger.Error("Error claiming assignment notification", "roomId", room.ID, "participantId", assignment.Participant.ID, "error", err)
+			failed++
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		if assignment.NotifiedAt.Valid {
+			logger.Warn("Resending an assignment whose earlier send never completed, the giver may get it twice", "roomId", room.ID, "participantId", assignment.Participant.ID, "claimedAt", assignment.NotifiedAt.Time)
+		}
+
+		assignment.Participant.Email, err = decryptAES(encryptionKey, assignment.Participant.Email)
+		if err == nil {
+			err = notifier.Assignment(logger, room, assignment)
+		}
+		if err != nil {
+			logger.Error("Assignment not delivered", "roomId", room.ID, "participantId", assignment.Participant.ID, "error", err)
+			if err := dbReleaseAssignmentNotification(db, room.ID, assignment.Participant.ID); err != nil {
+				logger.Error("Error releasing assignment notification", "roomId", room.ID, "participantId", assignment.Participant.ID, "error", err)
+			}
+			failed++
+			continue
+		}
+		if err := dbConfirmAssignmentNotification(db, room.ID, assignment.Participant.ID, time.Now().UTC()); err != nil {
+			logger.Error("Error confirming assignment notification, it will be resent", "roomId", room.ID, "participantId", assignment.Participant.ID, "error", err)
+		}
+		sent++
+	}
+
+	logger.Info("Assignments sent", "roomId", room.ID, "sent", sent, "failed", failed)
+	if failed > 0 {
+		return sent, fmt.Errorf("%d assignment(s) not sent, retrying on the next run", failed)
+	}
+	return sent, nil
+}
+
+// startScheduler runs the scheduled jobs until ctx is cancelled; stop the returned cron to wait for the running ones.
+func startScheduler(ctx context.Context, db *sqlx.DB, config Config, notifier *Notifier, audit *Auditor, metrics *Metrics) *cron.Cron {
+    c := cron.New()
+    // c.AddFunc("0 * * * *", func() {
+    c.AddFunc("@every 1m", func() {
+        started := time.Now()
+        runLogger := logger.With("runId", newRunID())
+        now := roomClockNow()
+		runLogger.Debug("Scheduler run", "now", now)
+        rooms, err := dbGetAllRooms(db)
+		runLogger.Debug("Fetched rooms", "rooms", len(rooms))
+        if err != nil {
+            runLogger.Error("Error fetching rooms for draw", "error", err)
+            metrics.Inc("secret_santa_scheduler_runs_total", "result", "failed")
+            return
+        }
+
+        for _, room := range rooms {
+			// Leave the remaining rooms for the next instance once shutdown starts
+			if ctx.Err() != nil {
+				runLogger.Info("Scheduler run interrupted by shutdown")
+				return
+			}
+			runLogger.Debug("Checking room", "roomId", room.ID, "deadline", room.Deadline, "drawCompleted", room.DrawCompleted)
+			if room.PurgedAt.Valid {
+				continue
+			}
+            if now.After(room.Deadline) && !room.DrawCompleted { 
+                err := runRoomDraw(ctx, db, config.EncryptionKey, notifier, audit, runLogger, actorScheduler, room.Room)
+                if err != nil {
+                    runLogger.Error("Error in draw", "roomId", room.ID, "error", err)
+                    metrics.Inc("secret_santa_draw_failures_total")
+                } else {
+                    metrics.Inc("secret_santa_draws_total")
+                }
+                continue
+            }
+
+            // Finish a draw whose notifications were cut short by a crash, shutdown or failed sends
+            if room.DrawCompleted {
+                if err := resumeAssignments(ctx, db, config.EncryptionKey, notifier, runLogger, room.Room); err != nil {
+                    runLogger.Error("Error sending outstanding assignments", "roomId", room.ID, "error", err)
+                }
+            }
+
+            sendRoomReminders(db, config, notifier, runLogger, room, now)
+            notifier.Countdown(runLogger, room, now)
+        }
+
+        // Retry webhook deliveries that failed on earlier runs
+        notifier.webhooks.DeliverDue(runLogger)
+
+        metrics.Inc("secret_santa_scheduler_runs_total", "result", "success")
+        metrics.Set("secret_santa_scheduler_run_duration_seconds", time.Since(started).Seconds())
+        metrics.Set("secret_santa_scheduler_last_success_timestamp_seconds", float64(time.Now().Unix()))
+    })
+
+	c.AddFunc(sessionCleanupInterval, func() {
+		now := time.Now().UTC()
+		runLogger := logger.With("runId", newRunID())
+
+		if config.Session.Storage == sessionStoragePostgres {
+			deleted, err := dbDeleteExpiredSessions(db, now)
+			if err != nil {
+				runLogger.Error("Error deleting expired sessions", "error", err)
+			} else {
+				runLogger.Info("Deleted expired sessions", "count", deleted)
+			}
+		}
+
+		deleted, err := dbDeletePasswordFailuresBefore(db, now.Add(-bruteForceWindow))
+		if err != nil {
+			runLogger.Error("Error deleting old password failures", "error", err)
+		} else {
+			runLogger.Info("Deleted old password failures", "count", deleted)
+		}
+
+		deleted, err = dbDeleteEmailRequestsBefore(db, now.Add(-emailRequestCooldown))
+		if err != nil {
+			runLogger.Error("Error deleting old email requests", "error", err)
+		} else {
+			runLogger.Info("Deleted old email requests", "count", deleted)
+		}
+	})
+	if config.Retention.DaysAfterExchange > 0 {
+		c.AddFunc(retentionPurgeInterval, func() {
+			runLogger := logger.With("runId", newRunID())
+			if _, err := purgeExpiredRooms(db, config.Retention, audit, runLogger, actorScheduler, time.Now().UTC(), false); err != nil {
+				runLogger.Error("Error purging rooms past retention", "error", err)
+			}
+		})
+	}
+    c.Start()
+    return c
+}
+
+// newSessionStore builds the session store with hardened cookies, backed by Postgres unless memory storage is configured.
+func newSessionStore(db *sqlx.DB, sessionConfig SessionConfig) *session.Store {
+	storeConfig := session.Config{
+		Expiration:     sessionConfig.Expiration,
+		CookieSecure:   sessionConfig.CookieSecure,
+		CookieHTTPOnly: true,
+		CookieSameSite: "Lax",
+	}
+	if sessionConfig.Storage == sessionStoragePostgres {
+		storeConfig.Storage = &PostgresSessionStorage{db: db}
+	}
+
+	return session.New(storeConfig)
+}
+
+// newCSRFMiddleware checks a per-session token on every state-changing request; rendered views get it as .CSRFToken.
+// API calls are exempt when they send JSON, which browsers cannot do cross-site without a CORS preflight, or when
+// they are not cross-site at all, which covers body-less calls such as DELETE /api/v1/rooms/:id/me.
+func newCSRFMiddleware(store *session.Store, sessionConfig SessionConfig) fiber.Handler {
+	return csrf.New(csrf.Config{
+		Next: func(c *fiber.Ctx) bool {
+			return strings.HasPrefix(c.Path(), "/api/") && (c.Is("json") || !isCrossSiteRequest(c))
+		},
+		KeyLookup:      "form:" + csrfFormField,
+		CookieSecure:   sessionConfig.CookieSecure,
+		CookieHTTPOnly: true,
+		CookieSameSite: "Lax",
+		Expiration:     sessionConfig.Expiration,
+		Session:        store,
+		ContextKey:     csrfContextKey,
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			requestLogger(c).Warn("Rejected request without a valid CSRF token", "method", c.Method(), "route", c.Route().Path, "error", err)
+			if strings.HasPrefix(c.Path(), "/api/") {
+				return sendAPIError(c, fiber.StatusForbidden, "json_required", "Cross-site API requests must send a JSON body")
+			}
+			return c.Status(fiber.StatusForbidden).SendString("Invalid or expired form, please go back, reload the page and try again")
+		},
+	})
+}
+
+// isCrossSiteRequest reports whether a browser says the request comes from another site. Browsers send
+// Sec-Fetch-Site, or at least Origin, on cross-site POST and DELETE; clients that send neither are not browsers.
+func isCrossSiteRequest(c *fiber.Ctx) bool {
+	switch c.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return false
+	case "":
+	default:
+		return true
+	}
+
+	origin := c.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	parsed, err := url.Parse(origin)
+	return err != nil || parsed.Host != c.Hostname()
+}
+
+// roomClockNow returns the current time on the naive clock that room deadlines are entered in (CET).
+func roomClockNow() time.Time {
+	return time.Now().UTC().Add(time.Hour)
+}
+
+func newNotifier(db *sqlx.DB, encryptionKey []byte, emailConfig EmailConfig, webhooks *WebhookDispatcher) *Notifier {
+	return &Notifier{
+		db:            db,
+		encryptionKey: encryptionKey,
+		email:         emailConfig,
+		client:        newOutboundClient(),
+		slackAPIURL:   slackAPIURL,
+		webhooks:      webhooks,
+
+		sendAssignmentEmail: sendEmail,
+	}
+}
+
+func (n *Notifier) ParticipantJoined(logger *Logger, roomId int, participantId int, name string) {
+	if n == nil {
+		return
+	}
+
+	n.webhooks.Emit(logger, roomId, webhookEventParticipantJoined, map[string]interface{}{
+		"participantId": participantId,
+		"name":          name,
+	})
+
+	room, err := dbGetOneRoom(n.db, roomId)
+	if err != nil {
+		logger.Error("Error fetching room for chat announcement", "roomId", roomId, "error", err)
+		return
+	}
+	background.Go(func() {
+		n.announce(logger, room, fmt.Sprintf("🎁 %s joined %s!", name, room.Name))
+	})
+}
+
+// ParticipantLeft tells webhooks, the room chat and, when the template is configured, every admin with an email.
+func (n *Notifier) ParticipantLeft(logger *Logger, room Room, participantId int, name string) {
+	if n == nil {
+		return
+	}
+
+	n.webhooks.Emit(logger, room.ID, webhookEventParticipantLeft, map[string]interface{}{
+		"participantId": participantId,
+		"name":          name,
+	})
+
+	background.Go(func() {
+		n.announce(logger, room, fmt.Sprintf("👋 %s left %s.", name, room.Name))
+		n.emailAdmins(logger, room, n.email.ParticipantLeftTemplateID, map[string]interface{}{
+			"RoomName": room.Name,
+			"Name":     name,
+		})
+	})
+}
+
+// ParticipantStatusChanged tells a participant they were admitted, waitlisted or turned down. Admission is
+// announced like a join.
+func (n *Notifier) ParticipantStatusChanged(logger *Logger, room Room, participantId int, status string) {
+	if n == nil {
+		return
+	}
+
+	participant, err := dbGetOneParticipant(n.db, participantId)
+	if err != nil {
+		logger.Error("Error fetching participant for status notification", "roomId", room.ID, "participantId", participantId, "error", err)
+		return
+	}
+
+	if status == participantStatusApproved {
+		n.ParticipantJoined(logger, room.ID, participant.ID, participant.Name)
+	}
+
+	if n.email.ParticipantStatusTemplateID == "" {
+		return
+	}
+	email, err := decryptAES(n.encryptionKey, participant.Email)
+	if err != nil || email == "" {
+		logger.Error("Cannot email participant about their status", "roomId", room.ID, "participantId", participantId, "error", err)
+		return
+	}
+	background.Go(func() {
+		err := sendTemplateEmail(n.email, participant.Name, email, n.email.ParticipantStatusTemplateID, map[string]interface{}{
+			"Name":     participant.Name,
+			"RoomName": room.Name,
+			"Status":   status,
+		})
+		if err != nil {
+			logger.Error("Failed to send participant status email", "roomId", room.ID, "participantId", participantId, "error", err)
+		}
+	})
+}
+
+func (n *Notifier) emailAdmins(logger *Logger, room Room, templateID string, data map[string]interface{}) {
+	if templateID == "" {
+		return
+	}
+
+	admins, err := getAdminsWithEmail(n.db, room.ID, n.encryptionKey)
+	if err != nil {
+		logger.Error("Error fetching admins to notify", "roomId", room.ID, "error", err)
+		return
+	}
+
+	for _, admin := range admins {
+		if admin.Email == "" {
+			continue
+		}
+		if err := sendTemplateEmail(n.email, admin.Email, admin.Email, templateID, data); err != nil {
+			logger.Error("Failed to email admin", "roomId", room.ID, "adminId", admin.ID, "error", err)
+		}
+	}
+}
+
+func (n *Notifier) RegistrationClosed(logger *Logger, room Room, participantCount int) {
+	if n == nil {
+		return
+	}
+
+	n.webhooks.Emit(logger, room.ID, webhookEventRegistrationClosed, map[string]interface{}{
+		"participantCount": participantCount,
+	})
+	n.announce(logger, room, fmt.Sprintf("🔒 Registration for %s is closed with %d participants.", room.Name, participantCount))
+}
+
+func (n *Notifier) DrawCompleted(logger *Logger, room Room, participantCount int) {
+	if n == nil {
+		return
+	}
+
+	n.webhooks.Emit(logger, room.ID, webhookEventDrawCompleted, map[string]interface{}{
+		"participantCount": participantCount,
+	})
+	n.announce(logger, room, fmt.Sprintf("🎅 The draw for %s has happened! All %d participants have been told who they are gifting.", room.Name, participantCount))
+}
+
+func (n *Notifier) ReminderDue(logger *Logger, roomId int, kind string, participantId int) {
+	if n == nil {
+		return
+	}
+
+	data := map[string]interface{}{"kind": kind}
+	if participantId != 0 {
+		data["participantId"] = participantId
+	}
+	n.webhooks.Emit(logger, roomId, webhookEventReminderDue, data)
+}
+
+// Countdown announces the days left until registration closes, once for each of chatCountdownDays.
+func (n *Notifier) Countdown(logger *Logger, room RoomWithParticipantCount, now time.Time) {
+	if n == nil || room.DrawCompleted || room.ChatWebhook == "" || !now.Before(room.Deadline) {
+		return
+	}
+
+	daysLeft := int(room.Deadline.Sub(now).Hours() / 24)
+	for _, countdownDay := range chatCountdownDays {
+		if daysLeft != countdownDay {
+			continue
+		}
+
+		claimed, err := dbClaimReminder(n.db, room.ID, fmt.Sprintf("chat_countdown_%d", daysLeft), 0)
+		if err != nil {
+			logger.Error("Error recording chat countdown", "roomId", room.ID, "error", err)
+			return
+		}
+		if claimed {
+			n.announce(logger, room.Room, fmt.Sprintf("⏳ %s: %d day(s) left to join! %d participants so far.", room.Name, daysLeft, room.ParticipantCount))
+		}
+	}
+}
+
+// Assignment tells a giver who they are gifting by email and, when the room has a Slack bot token, by direct message.
+// It succeeds when any channel delivered; each channel's failure is logged and counted on its own.
+func (n *Notifier) Assignment(logger *Logger, room Room, assignment Assignment) error {
+	delivered := false
+	var failures []string
+	record := func(channel string, err error) {
+		if err != nil {
+			logger.Error("Failed to send assignment", "roomId", room.ID, "participantId", assignment.Participant.ID, "channel", channel, "error", err)
+			n.email.metrics.Inc("secret_santa_assignment_deliveries_total", "channel", channel, "result", "failed")
+			failures = append(failures, fmt.Sprintf("%s: %v", channel, err))
+			return
+		}
+		delivered = true
+		n.email.metrics.Inc("secret_santa_assignment_deliveries_total", "channel", channel, "result", "sent")
+	}
+
+	record("email", n.sendAssignmentEmail(n.email, assignment))
+
+	if room.ChatPlatform == chatPlatformSlack && room.ChatBotToken != "" {
+		botToken, err := decryptAES(n.encryptionKey, room.ChatBotToken)
+		if err != nil {
+			err = fmt.Errorf("decrypting bot token: %w", err)
+		} else {
+			message := fmt.Sprintf("🎅 Secret Santa in %s: you are gifting %s!", room.Name, assignment.GifteeName)
+			err = sendSlackDirectMessage(n.client, n.slackAPIURL, botToken, assignment.Participant.Email, message)
+		}
+		record(chatPlatformSlack, err)
+	}
+
+	if !delivered {
+		return fmt.Errorf("no channel delivered the assignment (%s)", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (n *Notifier) announce(logger *Logger, room Room, message string) {
+	if room.ChatWebhook == "" {
+		return
+	}
+
+	webhookURL, err := decryptAES(n.encryptionKey, room.ChatWebhook)
+	if err != nil {
+		logger.Error("Error decrypting chat webhook", "roomId", room.ID, "error", err)
+		return
+	}
+
+	if err := postChatMessage(n.client, room.ChatPlatform, webhookURL, message); err != nil {
+		logger.Error("Failed to post chat announcement", "roomId", room.ID, "error", err)
+	}
+}
+
+func isValidChatPlatform(platform string) bool {
+	switch platform {
+	case chatPlatformSlack, chatPlatformMattermost, chatPlatformDiscord:
+		return true
+	}
+	return false
+}
+
+// postChatMessage posts text to an incoming webhook in the payload shape the platform expects.
+func postChatMessage(client *http.Client, platform string, webhookURL string, text string) error {
+	payload := map[string]string{"text": text}
+	if platform == chatPlatformDiscord {
+		payload = map[string]string{"content": text}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// callSlackAPI invokes a Slack Web API method and decodes the response, which reports failures in its "ok" field.
+func callSlackAPI(client *http.Client, req *http.Request, botToken string, result interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+botToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return err
+	}
+	if !envelope.OK {
+		return fmt.Errorf("slack API error: %s", envelope.Error)
+	}
+
+	if result != nil {
+		return json.Unmarshal(body, result)
+	}
+	return nil
+}
+
+func sendSlackDirectMessage(client *http.Client, apiURL string, botToken string, email string, text string) error {
+	req, err := http.NewRequest(http.MethodGet, apiURL+"/users.lookupByEmail?email="+url.QueryEscape(email), nil)
+	if err != nil {
+		return err
+	}
+
+	var lookup struct {
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	}
+	if err := callSlackAPI(client, req, botToken, &lookup); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{"channel": lookup.User.ID, "text": text})
+	if err != nil {
+		return err
+	}
+
+	req, err = http.NewRequest(http.MethodPost, apiURL+"/chat.postMessage", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	return callSlackAPI(client, req, botToken, nil)
+}
+
+func newWebhookDispatcher(db *sqlx.DB, encryptionKey []byte) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:            db,
+		encryptionKey: encryptionKey,
+		client:        newOutboundClient(),
+	}
+}
+
+// Emit queues the event for the room's webhooks and starts delivering it in the background.
+func (d *WebhookDispatcher) Emit(logger *Logger, roomId int, event string, data map[string]interface{}) {
+	if d == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	payload, err := json.Marshal(WebhookEvent{
+		Event:      event,
+		RoomID:     roomId,
+		OccurredAt: now,
+		Data:       data,
+	})
+	if err != nil {
+		logger.Error("Error encoding webhook event", "event", event, "roomId", roomId, "error", err)
+		return
+	}
+
+	err = dbQueueWebhookDeliveries(d.db, roomId, event, string(payload), now)
+	if err != nil {
+		logger.Error("Error queueing webhook event", "event", event, "roomId", roomId, "error", err)
+		return
+	}
+
+	background.Go(func() { d.DeliverDue(logger) })
+}
+
+// DeliverDue attempts every delivery whose retry time has come, rescheduling failures with exponential backoff.
+func (d *WebhookDispatcher) DeliverDue(logger *Logger) {
+	if d == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	deliveries, err := dbClaimDueWebhookDeliveries(d.db, now, now.Add(2*webhookTimeout), webhookDeliveryBatchSize)
+	if err != nil {
+		logger.Error("Error claiming webhook deliveries", "error", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		statusCode, err := d.deliver(delivery)
+		if err == nil {
+			err = dbRecordWebhookAttempt(d.db, delivery.ID, true, statusCode, "", now)
+		} else {
+			logger.Warn("Webhook delivery failed", "deliveryId", delivery.ID, "error", err)
+			err = dbRecordWebhookAttempt(d.db, delivery.ID, false, statusCode, webhookFailureReason(statusCode, err), now.Add(webhookRetryDelay(delivery.Attempts+1)))
+		}
+		if err != nil {
+			logger.Error("Error recording webhook delivery", "deliveryId", delivery.ID, "error", err)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) deliver(delivery WebhookDelivery) (int, error) {
+	webhook, err := dbGetOneWebhook(d.db, delivery.WebhookID)
+	if err != nil {
+		return 0, err
+	}
+
+	secret, err := decryptAES(d.encryptionKey, webhook.Secret)
+	if err != nil {
+		return 0, err
+	}
+
+	return deliverWebhook(d.client, webhook.URL, secret, delivery)
+}
+
+// deliverWebhook POSTs the delivery payload signed with the webhook secret, succeeding only on a 2xx response.
+func deliverWebhook(client *http.Client, targetURL string, secret string, delivery WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, targetURL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "SecretSanta-Webhooks/1")
+	req.Header.Set("X-SecretSanta-Event", delivery.Event)
+	req.Header.Set("X-SecretSanta-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-SecretSanta-Signature", "sha256="+webhookSignature(secret, []byte(delivery.Payload)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of the payload that receivers compare against X-SecretSanta-Signature.
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookRetryDelay(attempts int) time.Duration {
+	return time.Minute << uint(attempts-1)
+}
+
+// webhookFailureReason summarizes a failed delivery for last_error, which room admins can read. It never
+// includes the receiver's response or the request URL, which may embed a token.
+func webhookFailureReason(statusCode int, err error) string {
+	var urlErr *url.Error
+	switch {
+	case statusCode != 0:
+		return fmt.Sprintf("unexpected status code %d", statusCode)
+	case errors.Is(err, errBlockedAddress):
+		return errBlockedAddress.Error()
+	case errors.As(err, &urlErr) && urlErr.Timeout():
+		return "request timed out"
+	case errors.As(err, &urlErr):
+		return "could not connect"
+	}
+	return "internal error"
+}
+
+var errBlockedAddress = errors.New("destination address is not allowed")
+
+// blockedNetworks are loopback, private, link-local (including cloud metadata endpoints) and other
+// non-public ranges that admin-supplied URLs must never reach.
+var blockedNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// blockInternalAddresses is a net.Dialer Control hook. It sees the address actually being dialed, after DNS
+// resolution and on every redirect, so a hostname that later resolves to an internal address is still refused.
+func blockInternalAddresses(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// newOutboundClient returns the HTTP client for admin-supplied URLs, which refuses to connect to internal addresses.
+func newOutboundClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: blockInternalAddresses}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the target, bypassing the address check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+// isValidWebhookURL only accepts absolute http(s) URLs whose host does not resolve to an internal address.
+// Delivery checks the address again at dial time, so this is early feedback rather than the guard itself.
+func isValidWebhookURL(rawURL string) bool {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return false
+	}
+
+	ips, err := net.LookupIP(parsed.Hostname())
+	if err != nil {
+		// Unresolvable hosts fail at delivery instead; DNS may only be unavailable for now
+		return true
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// metricFamilies lists every exported metric in output order.
+var metricFamilies = []metricFamily{
+	{"secret_santa_rooms", "gauge", "Rooms by state."},
+	{"secret_santa_participants_joined_total", "counter", "Participants who joined or were imported."},
+	{"secret_santa_draws_total", "counter", "Draws completed by the scheduler."},
+	{"secret_santa_draw_failures_total", "counter", "Draws the scheduler attempted and could not complete."},
+	{"secret_santa_emails_total", "counter", "Emails handed to the provider, by result."},
+	{"secret_santa_assignment_deliveries_total", "counter", "Assignment notifications, by channel and result."},
+	{"secret_santa_scheduler_runs_total", "counter", "Scheduler runs, by result."},
+	{"secret_santa_scheduler_run_duration_seconds", "gauge", "Duration of the latest scheduler run."},
+	{"secret_santa_scheduler_last_success_timestamp_seconds", "gauge", "Unix time of the latest successful scheduler run."},
+}
+
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// Field names whose values never reach the logs, matched case-insensitively as substrings.
+var redactedLogKeys = []string{"email", "password", "token", "secret", "giftee", "wishlist"}
+
+var logEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// logger is the process-wide logger; requests and scheduler runs derive their own with a correlation ID.
+var logger = newLogger(os.Stdout, logLevelInfo)
+
+// background holds the process's fire-and-forget goroutines.
+var background backgroundTasks
+
+// configSettings lists every setting by its environment variable name, which is also its key in a config file.
+var configSettings = []string{
+	"PORT",
+	"DATABASE_URL",
+	"ENCRYPTION_KEY",
+	"DEFAULT_DEADLINE",
+	"SENDGRID_API_KEY",
+	"SENDGRID_EMAIL_FROM",
+	"SENDGRID_TEMPLATE_ID",
+	"SENDGRID_INVITE_TEMPLATE_ID",
+	"SENDGRID_SET_PASSWORD_TEMPLATE_ID",
+	"SENDGRID_ADMIN_PASSWORD_TEMPLATE_ID",
+	"SENDGRID_PARTICIPANT_LEFT_TEMPLATE_ID",
+	"SENDGRID_MAGIC_LINK_TEMPLATE_ID",
+	"SENDGRID_PARTICIPANT_STATUS_TEMPLATE_ID",
+	"SENDGRID_ADMIN_REMINDER_TEMPLATE_ID",
+	"SENDGRID_GIVER_REMINDER_TEMPLATE_ID",
+	"REMINDER_ADMIN_DAYS_BEFORE_DEADLINE",
+	"REMINDER_GIVER_DAYS_BEFORE_EXCHANGE",
+	"RETENTION_DAYS_AFTER_EXCHANGE",
+	"SESSION_STORAGE",
+	"SESSION_EXPIRATION_HOURS",
+	"SESSION_COOKIE_SECURE",
+	"PROXY_HEADER",
+	"METRICS_TOKEN",
+	"LOG_LEVEL",
+	"SHUTDOWN_TIMEOUT_SECONDS",
+}
+
+// configOverride is a command-line flag that overrides a single setting.
+type configOverride struct {
+	values map[string]string
+	name   string
+}
+
+func (o configOverride) String() string {
+	if o.values == nil {
+		return ""
+	}
+	return o.values[o.name]
+}
+
+func (o configOverride) Set(value string) error {
+	o.values[o.name] = value
+	return nil
+}
+
+type configFlags struct {
+	file      string
+	overrides map[string]string
+}
+
+// addConfigFlags registers the flags every command shares for locating its configuration.
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{overrides: make(map[string]string)}
+	fs.StringVar(&f.file, "config", os.Getenv("CONFIG_FILE"), "JSON config file keyed by environment variable name")
+	fs.Var(configOverride{f.overrides, "DATABASE_URL"}, "database-url", "PostgreSQL connection string (overrides DATABASE_URL)")
+	return f
+}
+
+func (f *configFlags) load(requireEmail bool) Config {
+	config, err := loadConfig(f.file, f.overrides, requireEmail)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	logger.SetLevel(config.LogLevel)
+	return config
+}
+
+// loadConfig layers the config file, then the environment, then flag overrides, and validates the result.
+func loadConfig(configFile string, overrides map[string]string, requireEmail bool) (Config, error) {
+	values := make(map[string]string)
+
+	if configFile != "" {
+		contents, err := os.ReadFile(configFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := json.Unmarshal(contents, &values); err != nil {
+			return Config{}, fmt.Errorf("parsing config file %s: %w", configFile, err)
+		}
+	}
+
+	for _, name := range configSettings {
+		if value, ok := os.LookupEnv(name); ok {
+			values[name] = value
+		}
+	}
+
+	for name, value := range overrides {
+		values[name] = value
+	}
+
+	return parseConfig(values, requireEmail)
+}
+
+// parseConfig turns raw settings into a Config, collecting every problem instead of stopping at the first.
+func parseConfig(values map[string]string, requireEmail bool) (Config, error) {
+	var problems ConfigError
+
+	known := make(map[string]bool, len(configSettings))
+	for _, name := range configSettings {
+		known[name] = true
+	}
+	var unknown []string
+	for name := range values {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("%s is not a known setting", name))
+	}
+
+	required := func(name string) string {
+		value := strings.TrimSpace(values[name])
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", name))
+		}
+		return value
+	}
+
+	nonNegativeInt := func(name string, defaultValue int) int {
+		raw := strings.TrimSpace(values[name])
+		if raw == "" {
+			return defaultValue
+		}
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 {
+			problems = append(problems, fmt.Sprintf("%s must be a non-negative integer, got %q", name, raw))
+			return defaultValue
+		}
+		return value
+	}
+
+	config := Config{
+		Port:            "3000",
+		LogLevel:        logLevelInfo,
+		ProxyHeader:     strings.TrimSpace(values["PROXY_HEADER"]),
+		MetricsToken:    strings.TrimSpace(values["METRICS_TOKEN"]),
+		DatabaseURL:     required("DATABASE_URL"),
+		DefaultDeadline: required("DEFAULT_DEADLINE"),
+		Email: EmailConfig{
+			APIKey:                      values["SENDGRID_API_KEY"],
+			From:                        values["SENDGRID_EMAIL_FROM"],
+			AssignmentTemplateID:        values["SENDGRID_TEMPLATE_ID"],
+			InviteTemplateID:            values["SENDGRID_INVITE_TEMPLATE_ID"],
+			SetPasswordTemplateID:       values["SENDGRID_SET_PASSWORD_TEMPLATE_ID"],
+			AdminPasswordTemplateID:     values["SENDGRID_ADMIN_PASSWORD_TEMPLATE_ID"],
+			ParticipantLeftTemplateID:   values["SENDGRID_PARTICIPANT_LEFT_TEMPLATE_ID"],
+			MagicLinkTemplateID:         values["SENDGRID_MAGIC_LINK_TEMPLATE_ID"],
+			ParticipantStatusTemplateID: values["SENDGRID_PARTICIPANT_STATUS_TEMPLATE_ID"],
+		},
+		Reminders: ReminderConfig{
+			AdminDaysBeforeDeadline: nonNegativeInt("REMINDER_ADMIN_DAYS_BEFORE_DEADLINE", 2),
+			GiverDaysBeforeExchange: nonNegativeInt("REMINDER_GIVER_DAYS_BEFORE_EXCHANGE", 3),
+			AdminTemplateID:         values["SENDGRID_ADMIN_REMINDER_TEMPLATE_ID"],
+			GiverTemplateID:         values["SENDGRID_GIVER_REMINDER_TEMPLATE_ID"],
+		},
+		Retention: RetentionConfig{
+			DaysAfterExchange: nonNegativeInt("RETENTION_DAYS_AFTER_EXCHANGE", 0),
+		},
+	}
+
+	config.ShutdownTimeout = time.Duration(nonNegativeInt("SHUTDOWN_TIMEOUT_SECONDS", 30)) * time.Second
+	if config.ShutdownTimeout == 0 {
+		problems = append(problems, "SHUTDOWN_TIMEOUT_SECONDS must be at least 1")
+	}
+
+	config.Session = SessionConfig{
+		Storage:      sessionStoragePostgres,
+		Expiration:   time.Duration(nonNegativeInt("SESSION_EXPIRATION_HOURS", 24)) * time.Hour,
+		CookieSecure: true,
+	}
+	if config.Session.Expiration == 0 {
+		problems = append(problems, "SESSION_EXPIRATION_HOURS must be at least 1")
+	}
+	if storage := strings.TrimSpace(values["SESSION_STORAGE"]); storage != "" {
+		if storage != sessionStoragePostgres && storage != sessionStorageMemory {
+			problems = append(problems, fmt.Sprintf("SESSION_STORAGE must be %q or %q, got %q", sessionStoragePostgres, sessionStorageMemory, storage))
+		} else {
+			config.Session.Storage = storage
+		}
+	}
+	if secure := strings.TrimSpace(values["SESSION_COOKIE_SECURE"]); secure != "" {
+		value, err := strconv.ParseBool(secure)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("SESSION_COOKIE_SECURE must be true or false, got %q", secure))
+		} else {
+			config.Session.CookieSecure = value
+		}
+	}
+
+	if name := strings.TrimSpace(values["LOG_LEVEL"]); name != "" {
+		level, ok := parseLogLevel(name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("LOG_LEVEL must be one of %s, got %q", strings.Join(logLevelNames, ", "), name))
+		}
+		config.LogLevel = level
+	}
+
+	if port := strings.TrimSpace(values["PORT"]); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			problems = append(problems, fmt.Sprintf("PORT must be a port number, got %q", port))
+		} else {
+			config.Port = port
+		}
+	}
+
+	if encodedKey := required("ENCRYPTION_KEY"); encodedKey != "" {
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			problems = append(problems, "ENCRYPTION_KEY must be base64 encoded")
+		} else if _, err := aes.NewCipher(key); err != nil {
+			problems = append(problems, "ENCRYPTION_KEY must decode to a 16, 24 or 32 byte AES key")
+		} else {
+			config.EncryptionKey = key
+		}
+	}
+
+	if config.DefaultDeadline != "" {
+		if _, err := time.Parse("2006-01-02T15:04", config.DefaultDeadline); err != nil {
+			problems = append(problems, fmt.Sprintf("DEFAULT_DEADLINE must look like 2006-01-02T15:04, got %q", config.DefaultDeadline))
+		}
+	}
+
+	if requireEmail {
+		required("SENDGRID_API_KEY")
+		required("SENDGRID_TEMPLATE_ID")
+		if from := required("SENDGRID_EMAIL_FROM"); from != "" {
+			if _, err := netMail.ParseAddress(from); err != nil {
+				problems = append(problems, fmt.Sprintf("SENDGRID_EMAIL_FROM must be an email address, got %q", from))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return Config{}, problems
+	}
+
+	return config, nil
+}
+
+func hashString(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	return string(bytes), err
+}
+
+func checkStringHash(password, hash string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
+
+func encryptAES(key []byte, plaintext string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ciphertext := aesGCM.Seal(nonce, nonce, []byte(plaintext), nil)
+	return hex.EncodeToString(ciphertext), nil
+}
+
+func decryptAES(key []byte, ciphertext string) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	enc, err := hex.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	nonceSize := aesGCM.NonceSize()
+	if len(enc) < nonceSize {
+		return "", err
+	}
+
+	nonce, ciphertextBytes := enc[:nonceSize], enc[nonceSize:]
+	plaintext, err := aesGCM.Open(nil, nonce, ciphertextBytes, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// deriveKey derives a subkey for one use of the encryption key with HKDF, so the AES key never doubles as
+// an HMAC key and a leaked MAC key reveals nothing about the others.
+func deriveKey(key []byte, purpose string) []byte {
+	subkey := make([]byte, 32)
+	// Reading 32 bytes from HKDF-SHA256 cannot fail
+	io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("secret-santa/"+purpose)), subkey)
+	return subkey
+}
+
+// signToken returns a URL-safe token carrying payload, authenticated with an HMAC bound to purpose.
+func signToken(secret []byte, purpose string, payload string) string {
+	mac := hmac.New(sha256.New, deriveKey(secret, "token"))
+	mac.Write([]byte(purpose + ":" + payload))
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks a token produced by signToken and returns its payload.
+func verifyToken(secret []byte, purpose string, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", errors.New("malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+
+	mac := hmac.New(sha256.New, deriveKey(secret, "token"))
+	mac.Write([]byte(purpose + ":" + string(payload)))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("invalid token signature")
+	}
+
+	return string(payload), nil
+}
+
+func inviteToken(secret []byte, invite Invite) string {
+	payload := fmt.Sprintf("%d:%d:%d", invite.RoomID, invite.ID, invite.ExpiresAt.Unix())
+	return signToken(secret, "invite", payload)
+}
+
+// parseInviteToken verifies an invite token and returns the room and invite IDs it grants.
+func parseInviteToken(secret []byte, token string, now time.Time) (int, int, error) {
+	payload, err := verifyToken(secret, "invite", token)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	var roomId, inviteId int
+	var expiresAt int64
+	if _, err := fmt.Sscanf(payload, "%d:%d:%d", &roomId, &inviteId, &expiresAt); err != nil {
+		return -1, -1, errors.New("malformed token")
+	}
+
+	if !now.Before(time.Unix(expiresAt, 0)) {
+		return -1, -1, errors.New("invite has expired")
+	}
+
+	return roomId, inviteId, nil
+}
+
+// parseEmailList splits pasted text on commas, semicolons and whitespace into validated addresses.
+func parseEmailList(text string) ([]string, []string) {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ';' || unicode.IsSpace(r)
+	})
+
+	var valid, invalid []string
+	for _, field := range fields {
+		address, err := netMail.ParseAddress(field)
+		if err != nil {
+			invalid = append(invalid, field)
+			continue
+		}
+		valid = append(valid, address.Address)
+	}
+
+	return valid, invalid
+}
+
+// generateRoomSlug returns 96 random bits, hex encoded, so room links cannot be guessed from room IDs.
+func generateRoomSlug() (string, error) {
+	slug := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, slug); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(slug), nil
+}
+
+func generateRandomSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// passwordFingerprint identifies a stored password hash so tokens can be invalidated once it changes.
+func passwordFingerprint(hashedPassword string) string {
+	sum := sha256.Sum256([]byte(hashedPassword))
+	return hex.EncodeToString(sum[:8])
+}
+
+func setPasswordToken(secret []byte, participant Participant, expiresAt time.Time) string {
+	payload := fmt.Sprintf("%d:%d:%s", participant.ID, expiresAt.Unix(), passwordFingerprint(participant.ParticipantPassword))
+	return signToken(secret, "set-password", payload)
+}
+
+// parseSetPasswordToken verifies a set-password token and returns the participant ID and password fingerprint it was issued for.
+func parseSetPasswordToken(secret []byte, token string, now time.Time) (int, string, error) {
+	return parseFingerprintToken(secret, "set-password", token, now)
+}
+
+func adminPasswordToken(secret []byte, admin RoomAdmin, expiresAt time.Time) string {
+	payload := fmt.Sprintf("%d:%d:%s", admin.ID, expiresAt.Unix(), passwordFingerprint(admin.AdminPassword))
+	return signToken(secret, "admin-password", payload)
+}
+
+// parseAdminPasswordToken verifies an admin password token and returns the admin ID and password fingerprint it was issued for.
+func parseAdminPasswordToken(secret []byte, token string, now time.Time) (int, string, error) {
+	return parseFingerprintToken(secret, "admin-password", token, now)
+}
+
+// magicLinkFingerprint ties a sign-in link to the participant's current email address and last sign-in by link,
+// so a link works once.
+func magicLinkFingerprint(participant Participant) string {
+	usedAt := ""
+	if participant.MagicLinkUsedAt.Valid {
+		usedAt = strconv.FormatInt(participant.MagicLinkUsedAt.Time.UnixNano(), 10)
+	}
+	return passwordFingerprint(participant.EmailHash + ":" + usedAt)
+}
+
+func magicLinkToken(secret []byte, participant Participant, expiresAt time.Time) string {
+	payload := fmt.Sprintf("%d:%d:%s", participant.ID, expiresAt.Unix(), magicLinkFingerprint(participant))
+	return signToken(secret, "magic-link", payload)
+}
+
+// parseMagicLinkToken verifies a sign-in link token and returns the participant ID and email fingerprint it was issued for.
+func parseMagicLinkToken(secret []byte, token string, now time.Time) (int, string, error) {
+	return parseFingerprintToken(secret, "magic-link", token, now)
+}
+
+// parseFingerprintToken verifies an "id:expiry:fingerprint" token signed for purpose.
+func parseFingerprintToken(secret []byte, purpose string, token string, now time.Time) (int, string, error) {
+	payload, err := verifyToken(secret, purpose, token)
+	if err != nil {
+		return -1, "", err
+	}
+
+	parts := strings.Split(payload, ":")
+	if len(parts) != 3 {
+		return -1, "", errors.New("malformed token")
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return -1, "", errors.New("malformed token")
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return -1, "", errors.New("malformed token")
+	}
+
+	if !now.Before(time.Unix(expiresAt, 0)) {
+		return -1, "", errors.New("link has expired")
+	}
+
+	return id, parts[2], nil
+}
+
+// parseParticipantCSV reads "name,email[,exclusion group[,wishlist]]" rows and validates each one
+// against the rest of the file and the participants already in the room.
+func parseParticipantCSV(text string, existingNames map[string]bool, existingEmails map[string]bool) ([]ImportRow, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	seenNames := make(map[string]int)
+	seenEmails := make(map[string]int)
+
+	var rows []ImportRow
+	for i, record := range records {
+		line := i + 1
+		if i == 0 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "name") {
+			continue
+		}
+
+		row := ImportRow{Line: line}
+		fields := make([]string, 4)
+		for j := 0; j < len(record) && j < len(fields); j++ {
+			fields[j] = strings.TrimSpace(record[j])
+		}
+		row.Name, row.Email, row.ExclusionGroup, row.Wishlist = fields[0], fields[1], fields[2], fields[3]
+
+		if len(record) < 2 || len(record) > 4 {
+			row.Errors = append(row.Errors, fmt.Sprintf("expected 2 to 4 columns, got %d", len(record)))
+		}
+
+		nameKey := strings.ToLower(row.Name)
+		if row.Name == "" {
+			row.Errors = append(row.Errors, "name is required")
+		} else if existingNames[nameKey] {
+			row.Errors = append(row.Errors, "a participant with this name already exists in the room")
+		} else if other, ok := seenNames[nameKey]; ok {
+			row.Errors = append(row.Errors, fmt.Sprintf("duplicate name, also on line %d", other))
+		} else {
+			seenNames[nameKey] = line
+		}
+
+		if address, err := netMail.ParseAddress(row.Email); err != nil || address.Address != row.Email {
+			row.Errors = append(row.Errors, "invalid email address")
+		} else {
+			emailKey := strings.ToLower(row.Email)
+			if existingEmails[emailKey] {
+				row.Errors = append(row.Errors, "a participant with this email already exists in the room")
+			} else if other, ok := seenEmails[emailKey]; ok {
+				row.Errors = append(row.Errors, fmt.Sprintf("duplicate email, also on line %d", other))
+			} else {
+				seenEmails[emailKey] = line
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// buildRoomExport collects a room's participants with decrypted emails, adding who drew whom once the exchange date has passed.
+func buildRoomExport(db *sqlx.DB, roomId int, encryptionKey []byte, now time.Time) (RoomExport, error) {
+	var export RoomExport
+
+	room, err := dbGetOneRoom(db, roomId)
+	if err != nil {
+		return export, err
+	}
+
+	participants, err := dbGetApprovedParticipantsForRoom(db, roomId)
+	if err != nil {
+		return export, err
+	}
+
+	export = RoomExport{
+		RoomName:           room.Name,
+		Deadline:           room.Deadline,
+		ExportedAt:         now,
+		IncludeAssignments: room.DrawCompleted && room.ExchangeDate.Valid && now.After(room.ExchangeDate.Time),
+		Participants:       make([]ExportedParticipant, len(participants)),
+	}
+	if room.ExchangeDate.Valid {
+		export.ExchangeDate = &room.ExchangeDate.Time
+	}
+
+	gifteeNames := make(map[int]string)
+	if export.IncludeAssignments {
+		assignments, err := dbGetAssignmentsForRoom(db, roomId)
+		if err != nil {
+			return export, err
+		}
+		for _, assignment := range assignments {
+			gifteeNames[assignment.Participant.ID] = assignment.GifteeName
+		}
+	}
+
+	for i, participant := range participants {
+		email, err := decryptAES(encryptionKey, participant.Email)
+		if err != nil {
+			return export, err
+		}
+
+		export.Participants[i] = ExportedParticipant{
+			Name:           participant.Name,
+			Email:          email,
+			ExclusionGroup: participant.ExclusionGroup,
+			Wishlist:       participant.Wishlist,
+			JoinedAt:       participant.CreatedAt,
+			GifteeName:     gifteeNames[participant.ID],
+		}
+	}
+
+	return export, nil
+}
+
+func writeRoomExportCSV(w io.Writer, export RoomExport) error {
+	writer := csv.NewWriter(w)
+
+	header := []string{"name", "email", "exclusion_group", "wishlist", "joined_at"}
+	if export.IncludeAssignments {
+		header = append(header, "giftee")
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, participant := range export.Participants {
+		record := []string{
+			participant.Name,
+			participant.Email,
+			participant.ExclusionGroup,
+			participant.Wishlist,
+			participant.JoinedAt.Format(time.RFC3339),
+		}
+		if export.IncludeAssignments {
+			record = append(record, participant.GifteeName)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func toAPIAuditEvent(event AuditEvent) APIAuditEvent {
+	details := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(event.Details), &details); err != nil {
+		logger.Error("Error decoding audit event details", "auditEventId", event.ID, "error", err)
+	}
+
+	return APIAuditEvent{
+		ID:        event.ID,
+		ActorType: event.ActorType,
+		Action:    event.Action,
+		IPHash:    event.IPHash,
+		Details:   details,
+		CreatedAt: event.CreatedAt,
+	}
+}
+
+func writeAuditEventsCSV(w io.Writer, events []AuditEvent) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write([]string{"id", "created_at", "actor_type", "action", "ip_hash", "details"}); err != nil {
+		return err
+	}
+	for _, event := range events {
+		record := []string{
+			strconv.Itoa(event.ID),
+			event.CreatedAt.Format(time.RFC3339),
+			event.ActorType,
+			event.Action,
+			event.IPHash,
+			event.Details,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func newLogger(out io.Writer, level int) *Logger {
+	return &Logger{sink: &logSink{out: out, level: level}}
+}
+
+func parseLogLevel(name string) (int, bool) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, true
+		}
+	}
+	return logLevelInfo, false
+}
+
+func (l *Logger) SetLevel(level int) {
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	l.sink.level = level
+}
+
+// With returns a logger that adds the key and value pairs to every line. A nil logger derives from the process-wide one.
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	if l == nil {
+		l = logger
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keyValues ...interface{}) { l.log(logLevelDebug, msg, keyValues) }
+func (l *Logger) Info(msg string, keyValues ...interface{})  { l.log(logLevelInfo, msg, keyValues) }
+func (l *Logger) Warn(msg string, keyValues ...interface{})  { l.log(logLevelWarn, msg, keyValues) }
+func (l *Logger) Error(msg string, keyValues ...interface{}) { l.log(logLevelError, msg, keyValues) }
+
+// Fatal logs at error level and exits, for startup failures.
+func (l *Logger) Fatal(msg string, keyValues ...interface{}) {
+	l.log(logLevelError, msg, keyValues)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level int, msg string, keyValues []interface{}) {
+	if l == nil {
+		l = logger
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	if level < l.sink.level {
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeLogValue(&b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeLogValue(&b, logLevelNames[level])
+	b.WriteString(`,"msg":`)
+	writeLogValue(&b, redactLogValue("msg", msg))
+
+	fields := append(append([]interface{}{}, l.fields...), keyValues...)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		b.WriteByte(',')
+		writeLogValue(&b, key)
+		b.WriteByte(':')
+		writeLogValue(&b, redactLogValue(key, value))
+	}
+	b.WriteString("}\n")
+
+	l.sink.out.Write(b.Bytes())
+}
+
+// redactLogValue drops values under sensitive keys and masks email addresses inside any text.
+func redactLogValue(key string, value interface{}) interface{} {
+	lowerKey := strings.ToLower(key)
+	for _, redacted := range redactedLogKeys {
+		if strings.Contains(lowerKey, redacted) {
+			return "[redacted]"
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return logEmailPattern.ReplaceAllString(v, "[redacted email]")
+	case error:
+		return logEmailPattern.ReplaceAllString(v.Error(), "[redacted email]")
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return logEmailPattern.ReplaceAllString(v.String(), "[redacted email]")
+	}
+	return value
+}
+
+func writeLogValue(b *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(encoded)
+}
+
+// logWriter routes output of the standard log package, e.g. from libraries, through the logger.
+type logWriter struct {
+	logger *Logger
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// requestLogger returns the logger for a request, tagged with its request ID.
+func requestLogger(c *fiber.Ctx) *Logger {
+	if c == nil {
+		return logger
+	}
+	// Copied, since the ID can point into request memory that fiber reuses while background work still logs
+	requestId, _ := c.Locals(requestIDContextKey).(string)
+	return logger.With("requestId", utils.CopyString(requestId))
+}
+
+// newRequestLogMiddleware logs one line per request. It logs the route pattern rather than the path so tokens in URLs stay out.
+func newRequestLogMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		started := time.Now()
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		requestLogger(c).Info("request",
+			"method", c.Method(),
+			"route", c.Route().Path,
+			"status", c.Response().StatusCode(),
+			"duration", time.Since(started),
+		)
+		return nil
+	}
+}
+
+// newRunID returns a random ID correlating the log lines of one scheduler run.
+func newRunID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (t *backgroundTasks) Go(fn func()) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		fn()
+	}()
+}
+
+// Wait blocks until every task has finished or ctx is done.
+func (t *backgroundTasks) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{values: map[string]map[string]float64{}}
+}
+
+// Add increases a metric by delta; labels are name and value pairs.
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	m.update(name, labels, func(value float64) float64 { return value + delta })
+}
+
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.update(name, labels, func(float64) float64 { return value })
+}
+
+func (m *Metrics) update(name string, labels []string, fn func(float64) float64) {
+	if m == nil {
+		return
+	}
+
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	key := ""
+	if len(pairs) > 0 {
+		key = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = map[string]float64{}
+	}
+	m.values[name][key] = fn(m.values[name][key])
+}
+
+// WriteTo writes every metric family that has a value, in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	for _, family := range metricFamilies {
+		series := m.values[family.Name]
+		if len(series) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family.Name, family.Help, family.Name, family.Type)
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s%s %s\n", family.Name, key, strconv.FormatFloat(series[key], 'g', -1, 64))
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+/*
+   ##### Commands
+*/
+type command struct {
+	Name        string
+	Usage       string
+	Description string
+	Run         func(args []string) error
+}
+
+func commands() []command {
+	return []command{
+		{"serve", "serve", "Run the web server and the scheduler (default)", runServe},
+		{"migrate", "migrate", "Create missing tables and columns", runMigrate},
+		{"list-rooms", "list-rooms", "List every room with its participant count", runListRooms},
+		{"show-room", "show-room --room ID", "Show a room and its participants", runShowRoom},
+		{"draw", "draw --room ID [--dry-run]", "Run the draw for a room now", runDraw},
+		{"resend", "resend --room ID --participant ID", "Resend a participant's assignment", runResend},
+		{"rotate-key", "rotate-key --new-key KEY", "Re-encrypt stored data with a new ENCRYPTION_KEY", runRotateKey},
+		{"export", "export --room ID [--format csv|json] [--output FILE]", "Export a room's participants", runExport},
+		{"purge", "purge --room ID [--confirm]", "Delete a room and all of its data", runPurge},
+		{"retention", "retention [--dry-run]", "Purge personal data from rooms past RETENTION_DAYS_AFTER_EXCHANGE", runRetention},
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: secret-santa [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands() {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.Usage, cmd.Description)
+	}
+	tw.Flush()
+}
+
+// findCommand picks the subcommand from the arguments, falling back to serve when none is given.
+func findCommand(args []string) (command, []string, error) {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, cmd := range commands() {
+		if cmd.Name == name {
+			return cmd, args, nil
+		}
+	}
+
+	return command{}, nil, fmt.Errorf("unknown command %q", name)
+}
+
+func connectDatabase(config Config) *sqlx.DB {
+	db, err := sqlx.Connect("postgres", config.DatabaseURL)
+	if err != nil {
+		logger.Fatal("Cannot connect to the database", "error", err)
+	}
+
+	return db
+}
+
+func parseRoomFlag(fs *flag.FlagSet, args []string, roomId *int) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *roomId <= 0 {
+		return errors.New("--room is required")
+	}
+
+	return nil
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config := cf.load(false)
+	db := connectDatabase(config)
+	defer db.Close()
+
+	schemaConfig := map[string]string{
+		"DefaultDeadline": config.DefaultDeadline,
+	}
+	if err := dbMigrateDatabaseSchema(db, schemaConfig); err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	indexed, err := dbRebuildEmailIndex(tx, config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	duplicates, err := dbAddParticipantEmailUniqueIndex(tx)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Database schema is up to date; indexed %d participant emails\n", indexed)
+	for _, duplicate := range duplicates {
+		fmt.Printf("Room %d: participants %v share an email address\n", duplicate.RoomID, duplicate.ParticipantIDs)
+	}
+	if len(duplicates) > 0 {
+		fmt.Println("Participant emails are not unique per room yet; erase or correct the participants above and run migrate again")
+	}
+	return nil
+}
+
+func runListRooms(args []string) error {
+	fs := flag.NewFlagSet("list-rooms", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config := cf.load(false)
+	db := connectDatabase(config)
+	defer db.Close()
 
-		roomId, err := dbCreateNewRoom(db, data)
-		if err != nil {
-			// Handle error appropriately
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error creating room: %s", err))
-		}
+	rooms, err := dbGetAllRooms(db)
+	if err != nil {
+		return err
+	}
 
-		log.Println("Created new room with ID:", roomId)
-		return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tVISIBILITY\tDEADLINE\tPARTICIPANTS\tDRAWN")
+	for _, room := range rooms {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%t\n", room.ID, room.Name, room.Visibility, room.Deadline.Format("2006-01-02 15:04"), room.ParticipantCount, room.DrawCompleted)
 	}
+
+	return tw.Flush()
 }
 
-func handleGetRoomDetails(db *sqlx.DB, store *session.Store) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		roomId, err := strconv.Atoi(c.Params("id"))
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
-		}
+func runShowRoom(args []string) error {
+	fs := flag.NewFlagSet("show-room", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	roomId := fs.Int("room", 0, "room ID")
+	if err := parseRoomFlag(fs, args, roomId); err != nil {
+		return err
+	}
 
-		sess, err := store.Get(c)
-		if err != nil || sess.Get("roomAccess") != roomId {
-			return c.Redirect("/")
-		}
+	config := cf.load(false)
+	db := connectDatabase(config)
+	defer db.Close()
+	encryptionKey := config.EncryptionKey
 
-		var room Room
-		room, err = dbGetOneRoom(db, roomId)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get room with ID: %d. %s", roomId, err))
-		}
+	room, err := dbGetOneRoom(db, *roomId)
+	if err != nil {
+		return err
+	}
 
-		var participants []Participant
-		participants, err = dbGetParticipantsForRoom(db, roomId)
-		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Cannot get participants for room ID: %d. %s", roomId, err))
-		}
+	participants, err := dbGetParticipantsForRoom(db, room.ID)
+	if err != nil {
+		return err
+	}
 
-		return c.Render("room-details", fiber.Map{
-			"Room":         room,
-			"Participants": participants,
-		})
+	fmt.Printf("Room %d: %s\n", room.ID, room.Name)
+	fmt.Printf("Visibility:    %s\n", room.Visibility)
+	fmt.Printf("Deadline:      %s\n", room.Deadline.Format("2006-01-02 15:04"))
+	if room.ExchangeDate.Valid {
+		fmt.Printf("Exchange date: %s\n", room.ExchangeDate.Time.Format("2006-01-02"))
 	}
-}
+	fmt.Printf("Draw done:     %t\n", room.DrawCompleted)
+	fmt.Printf("Approval:      %t\n", room.RequireApproval)
+	if room.MaxParticipants > 0 {
+		fmt.Printf("Capacity:      %d\n", room.MaxParticipants)
+	}
+	fmt.Println()
 
-func handlePostRoomDetails(db *sqlx.DB, store *session.Store) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		roomId, err := strconv.Atoi(c.Params("id"))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tEMAIL\tGROUP\tSTATUS\tJOINED")
+	for _, participant := range participants {
+		email, err := decryptAES(encryptionKey, participant.Email)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+			email = "(undecryptable)"
 		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", participant.ID, participant.Name, email, participant.ExclusionGroup, participant.Status, participant.CreatedAt.Format("2006-01-02 15:04"))
+	}
 
-		joinPassword := c.FormValue("joinPassword")
-		hashedJoinPassword, err := dbGetJoinPasswordForRoom(db, roomId) // Implement this function
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error joining room, roomId=%d, err=%s", roomId, err))
-		}
+	return tw.Flush()
+}
 
-		if checkStringHash(joinPassword, hashedJoinPassword) {
-			sess, _ := store.Get(c)
-			sess.Set("roomAccess", roomId)
-			sess.Save()
-			return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
-		} else {
-			return c.Redirect("/")
-		}
+func runDraw(args []string) error {
+	fs := flag.NewFlagSet("draw", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	roomId := fs.Int("room", 0, "room ID")
+	dryRun := fs.Bool("dry-run", false, "check that a draw is possible without saving or sending anything")
+	if err := parseRoomFlag(fs, args, roomId); err != nil {
+		return err
 	}
-}
 
-func handleGetJoinRoom() fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		roomId, err := strconv.Atoi(c.Params("id"))
+	config := cf.load(true)
+	db := connectDatabase(config)
+	defer db.Close()
+	encryptionKey := config.EncryptionKey
+
+	room, err := dbGetOneRoom(db, *roomId)
+	if err != nil {
+		return err
+	}
+	if room.DrawCompleted && *dryRun {
+		return fmt.Errorf("the draw for room %d is already completed", room.ID)
+	}
+
+	if room.DrawCompleted {
+		// Re-running a finished draw only sends the assignments that never went out
+		notifier := newNotifier(db, encryptionKey, config.Email, newWebhookDispatcher(db, encryptionKey))
+		sent, err := notifyAssignments(context.Background(), db, encryptionKey, notifier, logger, room)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+			return err
 		}
 
-		return c.Render("join-room", fiber.Map{
-			"Title":  "Join Room - Secret Santa App",
-			"roomId": roomId,
-		})
+		fmt.Printf("Draw for room %d was already completed; sent %d outstanding assignment(s)\n", room.ID, sent)
+		return nil
 	}
-}
 
-func handlePostJoinRoom(db *sqlx.DB, encryptionKey []byte) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		roomId, err := strconv.Atoi(c.Params("id"))
+	if *dryRun {
+		participants, err := dbGetApprovedParticipantsForRoom(db, room.ID)
 		if err != nil {
-			return c.Status(fiber.StatusBadRequest).SendString("Invalid room ID")
+			return err
 		}
 
-		var data CreateParticipantFormData
-		if err := c.BodyParser(&data); err != nil {
-			log.Println("Error parsing form:", err)
-			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Error parsing form data: %s", err))
-		}
-		// log.Println(data)
-		participantId, err := dbCreateNewParticipant(db, data, roomId, encryptionKey)
+		// Only the feasibility is reported so the dry run never reveals who drew whom
+		assignments, err := AssignSecretSanta(participants)
 		if err != nil {
-			// Handle error appropriately
-			return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Error adding participant: %s", err))
+			return fmt.Errorf("draw is not possible: %w", err)
 		}
 
-		log.Println("Created new participant with ID:", participantId, "for room with ID:", roomId)
-		return c.Redirect(fmt.Sprintf("/room-details/%d", roomId))
+		fmt.Printf("Draw is possible: %d assignments for room %d (nothing saved or sent)\n", len(assignments), room.ID)
+		return nil
 	}
-}
-
-/*
-   ##### Utils
-*/
-func AssignSecretSanta(participants []Participant) ([]Assignment, error) {
-    if len(participants) < 2 {
-        return nil, errors.New("a minimum of 2 participants is required")
-    }
-
-    // Create a list of Assignments
-    assignments := make([]Assignment, len(participants))
-    for i, p := range participants {
-        assignments[i] = Assignment{
-            Participant: p, 
-            GifteeName: p.Name, 
-        }
-    }
 
-    // Randomly shuffle the list.
-    mRand.Seed(time.Now().UnixNano())
-    mRand.Shuffle(len(assignments), func(i, j int) { 
-        assignments[i], assignments[j] = assignments[j], assignments[i] 
-    })
-
-    // Shift the giftees by one
-    for i := 0; i < len(assignments); i++ {
-        gifteeIdx := (i + 1) % len(assignments)
-        assignments[i].GifteeName = assignments[gifteeIdx].Participant.Name
-    }
+	notifier := newNotifier(db, encryptionKey, config.Email, newWebhookDispatcher(db, encryptionKey))
+	if err := runRoomDraw(context.Background(), db, encryptionKey, notifier, newAuditor(db, encryptionKey), logger, actorCLI, room); err != nil {
+		return err
+	}
 
-    return assignments, nil
+	fmt.Printf("Draw completed for room %d\n", room.ID)
+	return nil
 }
 
-func sendEmail(assignment Assignment) error {
-    // Sender and recipient information
-    from := mail.NewEmail("Raul", getEnvVar("SENDGRID_EMAIL_FROM"))
-    to := mail.NewEmail(assignment.Participant.Name, assignment.Participant.Email)
+func runResend(args []string) error {
+	fs := flag.NewFlagSet("resend", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	roomId := fs.Int("room", 0, "room ID")
+	participantId := fs.Int("participant", 0, "participant ID")
+	if err := parseRoomFlag(fs, args, roomId); err != nil {
+		return err
+	}
+	if *participantId <= 0 {
+		return errors.New("--participant is required")
+	}
 
-    // Create a new SendGrid message
-    message := mail.NewV3Mail()
+	config := cf.load(true)
+	db := connectDatabase(config)
+	defer db.Close()
+	encryptionKey := config.EncryptionKey
 
-    // Set the 'from' address
-    message.SetFrom(from)
+	room, err := dbGetOneRoom(db, *roomId)
+	if err != nil {
+		return err
+	}
 
-    // Create a personalization object
-    p := mail.NewPersonalization()
-    p.AddTos(to)
+	assignments, err := dbGetAssignmentsForRoom(db, room.ID)
+	if err != nil {
+		return err
+	}
 
-    // Set dynamic template data based on your template placeholders
-    p.SetDynamicTemplateData("Name", assignment.Participant.Name)
-    p.SetDynamicTemplateData("Giftee", assignment.GifteeName)
+	for _, assignment := range assignments {
+		if assignment.Participant.ID != *participantId {
+			continue
+		}
+		if assignment.Participant.ErasedAt.Valid {
+			return fmt.Errorf("participant %d has erased their data", *participantId)
+		}
 
-    // Add personalization to the message
-    message.AddPersonalizations(p)
+		email, err := decryptAES(encryptionKey, assignment.Participant.Email)
+		if err != nil {
+			return err
+		}
+		assignment.Participant.Email = email
 
-    // Set the Template ID from SendGrid
-    templateID := getEnvVar("SENDGRID_TEMPLATE_ID")
-    message.SetTemplateID(templateID)
+		notifier := newNotifier(db, encryptionKey, config.Email, nil)
+		if err := notifier.Assignment(logger, room, assignment); err != nil {
+			return err
+		}
 
-    // Create a SendGrid client and send the message
-    client := sendgrid.NewSendClient(getEnvVar("SENDGRID_API_KEY"))
-    response, err := client.Send(message)
-    if err != nil {
-        return err
-    }
+		newAuditor(db, encryptionKey).Record(nil, room.ID, actorCLI, "assignment.resent", map[string]interface{}{"participantId": *participantId})
+		fmt.Printf("Assignment resent to participant %d\n", *participantId)
+		return nil
+	}
 
-    log.Println("Email Sent to:", assignment.Participant.Name, "Status Code:", response.StatusCode)
-    return nil
+	return fmt.Errorf("participant %d has no assignment in room %d", *participantId, room.ID)
 }
 
-func startScheduler(db *sqlx.DB, encryptionKey []byte) {
-    c := cron.New()
-    // c.AddFunc("0 * * * *", func() {
-    c.AddFunc("@every 1m", func() {
-        now := time.Now().UTC().Add(time.Hour)
-		log.Println("Scheduler run:", now)
-        rooms, err := dbGetAllRooms(db)
-		log.Println("Lenrooms:", len(rooms))
-        if err != nil {
-            log.Printf("Error fetching rooms for draw: %s", err)
-            return
-        }
+func runRotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	newKey := fs.String("new-key", "", "new base64-encoded AES key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *newKey == "" {
+		return errors.New("--new-key is required")
+	}
 
-        for _, room := range rooms {
-			log.Println("Room:", room.Name, "Deadline:", room.Deadline, "Completed:", room.DrawCompleted)
-            if now.After(room.Deadline) && !room.DrawCompleted { 
-                log.Printf("Processing draw for room: %d", room.ID)
-                
-                // Fetch participants from database
-                participants, err := dbGetParticipantsForRoom(db, room.ID)
-                if err != nil {
-                    log.Printf("Error fetching participants for room %d: %s", room.ID, err)
-                    continue
-                }
-                log.Println("Fetched participants for the draw")
-
-                // Decrypt participant emails
-                for i := range participants {
-                    decryptedEmail, err := decryptAES(encryptionKey, participants[i].Email)
-                    if err != nil {
-                        log.Printf("Error decrypting email for participant %d: %s", participants[i].ID, err)
-                        continue
-                    }
-                    participants[i].Email = decryptedEmail
-                }
-                log.Println("Decrypted participant emails")
+	decodedNewKey, err := base64.StdEncoding.DecodeString(*newKey)
+	if err != nil {
+		return fmt.Errorf("decoding new key: %w", err)
+	}
+	if _, err := aes.NewCipher(decodedNewKey); err != nil {
+		return fmt.Errorf("invalid new key: %w", err)
+	}
 
-                // Assign Secret Santa
-                assignments, err := AssignSecretSanta(participants)
-                if err != nil {
-                    log.Printf("Error in assigning Secret Santa for room %d: %s", room.ID, err)
-                    continue
-                }
-                log.Println("Secret Santa assigned")
-
-                // Send emails
-                for _, assignment := range assignments {
-                    err := sendEmail(assignment)
-                    if err != nil {
-                        log.Printf("Failed to send email to %s: %s", assignment.Participant.Email, err)
-                    }
-                }
-                log.Println("Emails sent for the draw")
+	config := cf.load(false)
+	db := connectDatabase(config)
+	defer db.Close()
+	encryptionKey := config.EncryptionKey
 
-                // Update room to indicate draw is completed
-				err = dbSetRoomToDrawCompleted(db, room.ID)
-				if err != nil {
-					log.Printf("Error in setting room", room.ID, "status to completed")
-				}
-            }
-        }
-    })
-    c.Start()
+	rotated, err := dbRotateEncryptionKey(db, encryptionKey, decodedNewKey)
+	if err != nil {
+		return err
+	}
+	// Keyed with the new key, which is the one that will be in use from now on
+	newAuditor(db, decodedNewKey).Record(nil, 0, actorCLI, "encryption_key.rotated", map[string]interface{}{"values": rotated})
+
+	fmt.Printf("Re-encrypted %d values. Set ENCRYPTION_KEY to the new key before restarting the server.\n", rotated)
+	fmt.Println("Links signed with the old key no longer work: invites, set-password links, sign-in (magic) links, and admin invitation and password reset links.")
+	return nil
 }
 
-func getPort() string {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = ":3000"
-	} else {
-		port = ":" + port
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	roomId := fs.Int("room", 0, "room ID")
+	format := fs.String("format", "csv", "export format: csv or json")
+	output := fs.String("output", "", "file to write to (default stdout)")
+	if err := parseRoomFlag(fs, args, roomId); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unsupported format %q", *format)
 	}
 
-	return port
-}
+	config := cf.load(false)
+	db := connectDatabase(config)
+	defer db.Close()
+	encryptionKey := config.EncryptionKey
 
-func getEnvVar(name string) string {
-	envVar, ok := os.LookupEnv(name)
+	export, err := buildRoomExport(db, *roomId, encryptionKey, roomClockNow())
+	if err != nil {
+		return err
+	}
 
-	if !ok {
-		log.Fatalln("No such environment variable available: ", name)
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
 	}
 
-	return envVar
-}
+	if *format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(export)
+	} else {
+		err = writeRoomExportCSV(w, export)
+	}
+	if err != nil {
+		return err
+	}
 
-func hashString(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
-}
+	if err := dbCreateRoomExportRecord(db, *roomId, *format, export.IncludeAssignments); err != nil {
+		return err
+	}
 
-func checkStringHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	newAuditor(db, encryptionKey).Record(nil, *roomId, actorCLI, "room.exported", map[string]interface{}{"format": *format, "includeAssignments": export.IncludeAssignments})
+	return nil
 }
 
-func decodeEncryptionKey(encryptionKey string) []byte {
-	decodedKey, err := base64.StdEncoding.DecodeString(encryptionKey)
-	if err != nil {
-		log.Fatalln("Failed to decode encryption key:", err)
+func runPurge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	roomId := fs.Int("room", 0, "room ID")
+	confirm := fs.Bool("confirm", false, "actually delete the room")
+	if err := parseRoomFlag(fs, args, roomId); err != nil {
+		return err
 	}
 
-	return decodedKey
-}
+	config := cf.load(false)
+	db := connectDatabase(config)
+	defer db.Close()
 
-func encryptAES(key []byte, plaintext string) (string, error) {
-	block, err := aes.NewCipher(key)
+	room, err := dbGetOneRoom(db, *roomId)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
+	if !*confirm {
+		fmt.Printf("Would delete room %d (%s) with all participants, assignments, invites and webhooks. Re-run with --confirm.\n", room.ID, room.Name)
+		return nil
 	}
 
-	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
+	if err := dbPurgeRoom(db, room.ID); err != nil {
+		return err
 	}
+	newAuditor(db, config.EncryptionKey).Record(nil, room.ID, actorCLI, "room.purged", nil)
 
-	ciphertext := aesGCM.Seal(nonce, nonce, []byte(plaintext), nil)
-	return hex.EncodeToString(ciphertext), nil
+	fmt.Printf("Deleted room %d (%s)\n", room.ID, room.Name)
+	return nil
 }
 
-func decryptAES(key []byte, ciphertext string) (string, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
+func runRetention(args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "only report what would be purged")
+	if err := fs.Parse(args); err != nil {
+		return err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
+	config := cf.load(false)
+	if config.Retention.DaysAfterExchange == 0 {
+		return errors.New("retention is disabled, set RETENTION_DAYS_AFTER_EXCHANGE")
 	}
 
-	enc, err := hex.DecodeString(ciphertext)
+	db := connectDatabase(config)
+	defer db.Close()
+
+	now := time.Now().UTC()
+	candidates, err := purgeExpiredRooms(db, config.Retention, newAuditor(db, config.EncryptionKey), logger, actorCLI, now, *dryRun)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	nonceSize := aesGCM.NonceSize()
-	if len(enc) < nonceSize {
-		return "", err
+	verb := "Purged"
+	if *dryRun {
+		verb = "Would purge"
+	}
+	fmt.Printf("%s %d room(s) with an exchange before %s\n", verb, len(candidates), retentionCutoff(config.Retention, now).Format("2006-01-02 15:04"))
+	if len(candidates) == 0 {
+		return nil
 	}
 
-	nonce, ciphertextBytes := enc[:nonceSize], enc[nonceSize:]
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertextBytes, nil)
-	if err != nil {
-		return "", err
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tEXCHANGE\tPARTICIPANTS\tASSIGNMENTS\tINVITES")
+	for _, candidate := range candidates {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%d\n", candidate.ID, candidate.Name, candidate.ExchangeDate.Format("2006-01-02 15:04"), candidate.ParticipantCount, candidate.AssignmentCount, candidate.InviteCount)
 	}
 
-	return string(plaintext), nil
+	return tw.Flush()
 }
 
 /*
    ##### Main
 */
 func main() {
-	// Gen ENV vars
-	connStr := getEnvVar("DATABASE_URL")
-	encodedEncryptionKey := getEnvVar("ENCRYPTION_KEY")
-	defaultDeadline := getEnvVar("DEFAULT_DEADLINE")
+	// Anything still using the standard logger, e.g. libraries, goes through the JSON logger too
+	log.SetFlags(0)
+	log.SetOutput(logWriter{logger})
 
-	decodedEncryptionKey := decodeEncryptionKey(encodedEncryptionKey)
-
-	// Create config map
-	config := map[string]string{
-		"DefaultDeadline": defaultDeadline,
+	cmd, args, err := findCommand(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage(os.Stderr)
+		os.Exit(2)
 	}
 
-	// Connect to PostgreSQL
-	db, err := sqlx.Connect("postgres", connStr)
-	defer db.Close()
+	if err := cmd.Run(args); err != nil {
+		logger.Fatal("Command failed", "command", cmd.Name, "error", err)
+	}
+}
 
-	if err != nil {
-		log.Fatalln(err)
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cf := addConfigFlags(fs)
+	fs.Var(configOverride{cf.overrides, "PORT"}, "port", "port to listen on (overrides PORT)")
+	if err := fs.Parse(args); err != nil {
+		return err
 	}
 
+	// Load and validate the configuration up front
+	config := cf.load(true)
+	decodedEncryptionKey := config.EncryptionKey
+
+	// Connect to PostgreSQL; a shutdown that times out leaves it open, see below
+	db := connectDatabase(config)
+	closeDB := true
+	defer func() {
+		if closeDB {
+			db.Close()
+		}
+	}()
+
 	// Create initial DB schema
 	if doDevSetupDB {
-		dbSetupDatabaseSchema(db, config)
+		dbSetupDatabaseSchema(db, map[string]string{
+			"DefaultDeadline": config.DefaultDeadline,
+		})
 	}
 
+	metrics := newMetrics()
+	config.Email.metrics = metrics
+	notifier := newNotifier(db, decodedEncryptionKey, config.Email, newWebhookDispatcher(db, decodedEncryptionKey))
+	audit := newAuditor(db, decodedEncryptionKey)
+	guard := newPasswordGuard(db, decodedEncryptionKey, audit)
+
 	// Set up Fiber
 	engine := html.New("./views", ".html")
-	var store *session.Store
-	store = session.New()
-	app := fiber.New(fiber.Config{Views: engine})
+	store := newSessionStore(db, config.Session)
+	app := fiber.New(fiber.Config{
+		Views:              engine,
+		PassLocalsToViews:  true,
+		ProxyHeader:        config.ProxyHeader,
+		EnableIPValidation: true,
+	})
+
+	// Probes and scrapes are registered ahead of the middleware so they are not logged; scrapes get their own limit
+	app.Get("/healthz", handleGetHealthz())
+	app.Get("/readyz", handleGetReadyz(db))
+	if config.MetricsToken != "" {
+		app.Get("/metrics", limiter.New(limiter.Config{Max: 10, Expiration: time.Minute}), handleGetMetrics(db, metrics, config.MetricsToken))
+	}
 
-	app.Use(logger.New())
+	app.Use(requestid.New(requestid.Config{ContextKey: requestIDContextKey}))
+	app.Use(newRequestLogMiddleware())
 	app.Use(limiter.New(limiter.Config{
 		Max:        100,
 		Expiration: 30 * time.Second,
 	}))
+	app.Use(newCSRFMiddleware(store, config.Session))
 
 	// Set up routes
 	app.Get("/", handleGetIndex(db))
 
-	app.Get("/room-details/:id", handleGetRoomDetails(db, store))
-	app.Post("/room-details/:id", handlePostRoomDetails(db, store))
+	app.Get("/room-details/:id", handleGetRoomDetails(db, store, config.Email))
+	app.Post("/room-details/:id", handlePostRoomDetails(db, store, guard, audit))
+
+	app.Get("/create-room", handleGetCreateRoom(config.DefaultDeadline))
+	app.Post("/create-room", handlePostCreateRoom(db, decodedEncryptionKey, audit))
+
+	app.Get("/room-details/:id/join-room", handleGetJoinRoom(store, config.Email))
+	app.Post("/room-details/:id/join-room", handlePostJoinRoom(db, store, decodedEncryptionKey, config.Email, notifier, metrics, audit))
+
+	app.Get("/room-details/:id/me", handleGetMyData(db, store, decodedEncryptionKey, config.Email))
+	app.Post("/room-details/:id/me", handlePostMyData(db, store, guard, audit))
+	app.Get("/room-details/:id/me/export", handleGetExportMyData(db, store, decodedEncryptionKey, audit))
+	app.Post("/room-details/:id/me/erase", handlePostEraseMyData(db, store, decodedEncryptionKey, notifier, audit))
+	app.Post("/room-details/:id/me/profile", handlePostMyProfile(db, store, decodedEncryptionKey, audit))
+	app.Post("/room-details/:id/me/password", handlePostMyPassword(db, store, guard, audit))
+	app.Post("/room-details/:id/me/leave", handlePostLeaveRoom(db, store, notifier, audit))
+	app.Get("/room-details/:id/sign-in-link", handleGetMagicLink(db, store, config.Email))
+	app.Post("/room-details/:id/sign-in-link", handlePostMagicLink(db, store, decodedEncryptionKey, config.Email, audit))
+	app.Get("/magic-link/:token", handleGetMagicLinkSignIn(db, decodedEncryptionKey))
+	app.Post("/magic-link/:token", handlePostMagicLinkSignIn(db, store, decodedEncryptionKey, audit))
 
-	app.Get("/create-room", handleGetCreateRoom(defaultDeadline))
-	app.Post("/create-room", handlePostCreateRoom(db))
+	app.Get("/room-details/:id/admin", handleGetRoomAdmin(db, store, decodedEncryptionKey))
+	app.Post("/room-details/:id/admin", handlePostRoomAdmin(db, store, decodedEncryptionKey, guard, audit))
+	app.Get("/room-details/:id/admin/forgot-password", handleGetAdminForgotPassword(db, store))
+	app.Post("/room-details/:id/admin/forgot-password", handlePostAdminForgotPassword(db, store, decodedEncryptionKey, config.Email, audit))
+	app.Post("/room-details/:id/admin/admins", handlePostInviteRoomAdmin(db, store, decodedEncryptionKey, config.Email, audit))
+	app.Post("/room-details/:id/admin/visibility", handlePostRoomVisibility(db, store, audit))
+	app.Post("/room-details/:id/admin/registration", handlePostRoomRegistration(db, store, notifier, audit))
+	app.Post("/room-details/:id/admin/participants/:participantId/approve", handlePostReviewParticipant(db, store, notifier, audit, true))
+	app.Post("/room-details/:id/admin/participants/:participantId/reject", handlePostReviewParticipant(db, store, notifier, audit, false))
+	app.Post("/room-details/:id/admin/invites", handlePostCreateInvite(db, store, decodedEncryptionKey, audit))
+	app.Post("/room-details/:id/admin/invitations", handlePostSendInvitations(db, store, decodedEncryptionKey, config.Email, audit))
 
-	app.Get("/room-details/:id/join-room", handleGetJoinRoom())
-	app.Post("/room-details/:id/join-room", handlePostJoinRoom(db, decodedEncryptionKey))
+	app.Get("/room-details/:id/admin/import", handleGetImportParticipants(db, store))
+	app.Post("/room-details/:id/admin/import", handlePostImportParticipants(db, store, decodedEncryptionKey, config.Email, notifier, metrics, audit))
+
+	app.Post("/room-details/:id/admin/chat", handlePostChatSettings(db, store, decodedEncryptionKey, audit))
+	app.Post("/room-details/:id/admin/webhooks", handlePostCreateWebhook(db, store, decodedEncryptionKey, audit))
+	app.Post("/room-details/:id/admin/webhooks/:webhookId/delete", handlePostDeleteWebhook(db, store, audit))
+	app.Post("/room-details/:id/admin/export", handlePostExportRoom(db, store, decodedEncryptionKey, audit))
+	app.Get("/room-details/:id/admin/audit", handleGetExportAuditEvents(db, store, audit))
+
+	app.Get("/r/:slug", handleGetRoomLink(db, store))
+	app.Get("/invite/:token", handleGetInvite(db, store, decodedEncryptionKey))
+
+	registerAPIRoutes(app.Group("/api/v1"), apiOperations(db, store, decodedEncryptionKey, config.Email, notifier, metrics, guard, audit))
+
+	app.Get("/set-password/:token", handleGetSetPassword(db, decodedEncryptionKey))
+	app.Post("/set-password/:token", handlePostSetPassword(db, store, decodedEncryptionKey, audit))
+	app.Get("/admin-password/:token", handleGetAdminSetPassword(db, decodedEncryptionKey))
+	app.Post("/admin-password/:token", handlePostAdminSetPassword(db, store, decodedEncryptionKey, audit))
+
+	// SIGTERM from the orchestrator or Ctrl-C starts a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
 	// Start the scheduler
-    startScheduler(db, decodedEncryptionKey)
+	scheduler := startScheduler(ctx, db, config, notifier, audit, metrics)
 
 	// Run server
-	err = app.Listen(getPort())
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(":" + config.Port)
+	}()
+
+	select {
+	case err := <-listenErr:
+		<-scheduler.Stop().Done()
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("Shutting down", "timeout", config.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting requests and let in-flight ones finish
+	if err := app.ShutdownWithContext(shutdownCtx); err != nil {
+		logger.Error("Error shutting down the web server", "error", err)
+	}
+
+	// No new jobs start; wait for a running draw to finish or bail out before saving
+	select {
+	case <-scheduler.Stop().Done():
+	case <-shutdownCtx.Done():
+		logger.Warn("Scheduler jobs still running at shutdown timeout")
+		closeDB = false
+	}
+
+	if err := background.Wait(shutdownCtx); err != nil {
+		logger.Warn("Background tasks still running at shutdown timeout")
+		closeDB = false
+	}
+
+	// Closing the pool under a draw or delivery that is still running would fail it halfway through. Left open,
+	// the process exit drops the connections instead and Postgres rolls back any open transaction, so an unsaved
+	// draw is rerun by the next instance as usual.
+	if !closeDB {
+		logger.Warn("Exiting without closing the database")
 	}
+	logger.Info("Shutdown complete")
+	return nil
 }
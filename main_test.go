@@ -2,8 +2,33 @@ package main // or the name of your package
 
 import (
 	// "reflect"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestAssignSecretSantaWithLessThanTwoParticipants(t *testing.T) {
@@ -73,4 +98,2163 @@ func TestAssignSecretSanta(t *testing.T) {
             t.Errorf("Participant %s is gifted %d times, expected exactly 1", participant.Name, gifteeCount[participant.Name])
         }
     }
-}
\ No newline at end of file
+}
+func TestIsReminderDue(t *testing.T) {
+	target := time.Date(2023, 12, 20, 18, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		now        time.Time
+		daysBefore int
+		want       bool
+	}{
+		{"before window", target.Add(-72 * time.Hour), 2, false},
+		{"window start", target.Add(-48 * time.Hour), 2, true},
+		{"inside window", target.Add(-time.Hour), 2, true},
+		{"at target", target, 2, false},
+		{"after target", target.Add(time.Hour), 2, false},
+		{"disabled", target.Add(-time.Hour), 0, false},
+	}
+
+	for _, tt := range tests {
+		if got := isReminderDue(tt.now, target, tt.daysBefore); got != tt.want {
+			t.Errorf("%s: isReminderDue() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInviteTokenRoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	invite := Invite{ID: 7, RoomID: 3, ExpiresAt: now.Add(24 * time.Hour)}
+
+	token := inviteToken(secret, invite)
+
+	roomId, inviteId, err := parseInviteToken(secret, token, now)
+	if err != nil {
+		t.Fatalf("parseInviteToken() error = %v", err)
+	}
+	if roomId != 3 || inviteId != 7 {
+		t.Errorf("parseInviteToken() = (%d, %d), want (3, 7)", roomId, inviteId)
+	}
+
+	if _, _, err := parseInviteToken(secret, token, now.Add(48*time.Hour)); err == nil {
+		t.Errorf("parseInviteToken() should reject an expired token")
+	}
+
+	if _, _, err := parseInviteToken([]byte("another-secret"), token, now); err == nil {
+		t.Errorf("parseInviteToken() should reject a token signed with another secret")
+	}
+
+	if _, err := verifyToken(secret, "password-reset", signToken(secret, "invite", "3:7:0")); err == nil {
+		t.Errorf("verifyToken() should reject a token signed for another purpose")
+	}
+}
+
+func TestAdminPasswordTokenRoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	admin := RoomAdmin{ID: 5, RoomID: 3}
+
+	token := adminPasswordToken(secret, admin, now.Add(adminPasswordResetExpiry))
+
+	adminId, fingerprint, err := parseAdminPasswordToken(secret, token, now)
+	if err != nil {
+		t.Fatalf("parseAdminPasswordToken() error = %v", err)
+	}
+	if adminId != 5 || fingerprint != passwordFingerprint("") {
+		t.Errorf("parseAdminPasswordToken() = (%d, %q), want (5, %q)", adminId, fingerprint, passwordFingerprint(""))
+	}
+
+	if _, _, err := parseAdminPasswordToken(secret, token, now.Add(2*adminPasswordResetExpiry)); err == nil {
+		t.Errorf("parseAdminPasswordToken() should reject an expired token")
+	}
+
+	participantToken := setPasswordToken(secret, Participant{ID: 5}, now.Add(time.Hour))
+	if _, _, err := parseAdminPasswordToken(secret, participantToken, now); err == nil {
+		t.Errorf("parseAdminPasswordToken() should reject a participant set-password token")
+	}
+}
+
+func TestIsRegistrationOpen(t *testing.T) {
+	now := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		room Room
+		want bool
+	}{
+		{"before deadline", Room{Deadline: now.Add(time.Hour)}, true},
+		{"at deadline", Room{Deadline: now}, false},
+		{"after deadline", Room{Deadline: now.Add(-time.Hour)}, false},
+		{"drawn early", Room{Deadline: now.Add(time.Hour), DrawCompleted: true}, false},
+	}
+
+	for _, tt := range tests {
+		if got := isRegistrationOpen(tt.room, now); got != tt.want {
+			t.Errorf("isRegistrationOpen(%s) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	token, ipHash := deriveKey(key, "token"), deriveKey(key, "ip-hash")
+	if bytes.Equal(token, ipHash) || bytes.Equal(token, key) {
+		t.Errorf("deriveKey() should give each purpose its own subkey, distinct from the key")
+	}
+	if !bytes.Equal(token, deriveKey(key, "token")) {
+		t.Errorf("deriveKey() should be deterministic")
+	}
+	if bytes.Equal(token, deriveKey([]byte("another-key"), "token")) {
+		t.Errorf("deriveKey() should depend on the key")
+	}
+}
+
+func TestSessionHasGrant(t *testing.T) {
+	store := session.New()
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+
+		switch c.Query("case") {
+		case "password":
+			sess.Set("roomAccess", 3)
+			sess.Set("joinAccess", 3)
+		case "invite":
+			sess.Set("inviteAccess", 3)
+			sess.Set("inviteExpiresAt", time.Now().Add(time.Hour).Unix())
+		case "expired-invite":
+			sess.Set("inviteAccess", 3)
+			sess.Set("inviteExpiresAt", time.Now().Add(-time.Hour).Unix())
+		case "used-invite":
+			sess.Set("inviteAccess", 3)
+			sess.Set("inviteExpiresAt", time.Now().Add(time.Hour).Unix())
+			clearInvite(sess, 3, true)
+		}
+
+		return c.SendString(fmt.Sprintf("%t %t %t %t",
+			sessionHasGrant(sess, "roomAccess", 3),
+			sessionHasGrant(sess, "joinAccess", 3),
+			sessionHasGrant(sess, "joinAccess", 4),
+			sessionHasGrant(sess, "roomAdmin", 3)))
+	})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"password", "true true false false"},
+		{"invite", "true true false false"},
+		{"expired-invite", "false false false false"},
+		// Using an invite leaves the joiner able to see the room, not to join again
+		{"used-invite", "true false false false"},
+	}
+
+	for _, tt := range tests {
+		resp, err := app.Test(httptest.NewRequest("GET", "/?case="+tt.name, nil))
+		if err != nil {
+			t.Fatalf("app.Test(%s) error = %v", tt.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != tt.want {
+			t.Errorf("%s: grants = %q, want %q", tt.name, body, tt.want)
+		}
+	}
+}
+
+func TestRoomAccessRegeneratesSessionID(t *testing.T) {
+	joinPassword, err := bcrypt.GenerateFromPassword([]byte("letmein"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubDB{queries: []stubQuery{
+		{"FROM room WHERE room.id = $1", []string{"id", "name", "visibility", "join_password"}, [][]driver.Value{
+			{int64(1), "Office", roomVisibilityPublic, string(joinPassword)},
+		}},
+	}}
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	app := fiber.New()
+	app.Post("/rooms/:id/access", handleAPIPostRoomAccess(db, session.New(), nil, nil))
+
+	// A session ID planted before sign-in must not carry the new grants
+	req := httptest.NewRequest("POST", "/rooms/1/access", strings.NewReader(`{"joinPassword":"letmein"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", "session_id=planted")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, fiber.StatusNoContent)
+	}
+
+	cookie := resp.Header.Get("Set-Cookie")
+	if !strings.HasPrefix(cookie, "session_id=") || strings.HasPrefix(cookie, "session_id=planted;") {
+		t.Errorf("Set-Cookie = %q, want a new session ID", cookie)
+	}
+}
+
+func TestEmailIndex(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	if emailIndex(key, "Alice@Example.com ") != emailIndex(key, "alice@example.com") {
+		t.Errorf("emailIndex() should ignore case and surrounding space")
+	}
+	if emailIndex(key, "alice@example.com") == emailIndex(key, "bob@example.com") {
+		t.Errorf("emailIndex() should differ between addresses")
+	}
+	if emailIndex(key, "alice@example.com") == emailIndex([]byte("another-key"), "alice@example.com") {
+		t.Errorf("emailIndex() should depend on the key")
+	}
+	if got := emailIndex(key, ""); got != "" {
+		t.Errorf("emailIndex(\"\") = %q, want empty so blank emails never match", got)
+	}
+}
+
+func TestMagicLinkTokenRoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	participant := Participant{ID: 9, RoomID: 3, EmailHash: emailIndex(secret, "alice@example.com")}
+
+	token := magicLinkToken(secret, participant, now.Add(magicLinkExpiry))
+
+	participantId, fingerprint, err := parseMagicLinkToken(secret, token, now)
+	if err != nil {
+		t.Fatalf("parseMagicLinkToken() error = %v", err)
+	}
+	if participantId != 9 || fingerprint != magicLinkFingerprint(participant) {
+		t.Errorf("parseMagicLinkToken() = (%d, %q), want (9, %q)", participantId, fingerprint, magicLinkFingerprint(participant))
+	}
+
+	participant.EmailHash = emailIndex(secret, "new@example.com")
+	if fingerprint == magicLinkFingerprint(participant) {
+		t.Errorf("magicLinkFingerprint() should change with the email address")
+	}
+
+	participant.EmailHash = emailIndex(secret, "alice@example.com")
+	participant.MagicLinkUsedAt = sql.NullTime{Time: now, Valid: true}
+	if fingerprint == magicLinkFingerprint(participant) {
+		t.Errorf("magicLinkFingerprint() should change once a link is used")
+	}
+
+	if _, _, err := parseMagicLinkToken(secret, token, now.Add(magicLinkExpiry)); err == nil {
+		t.Errorf("parseMagicLinkToken() should reject an expired token")
+	}
+}
+
+func TestParseEmailList(t *testing.T) {
+	valid, invalid := parseEmailList("alice@example.com, bob@example.com\ncharlie@example.com;not-an-email")
+
+	if len(valid) != 3 {
+		t.Errorf("Expected 3 valid addresses, got %d: %v", len(valid), valid)
+	}
+	if len(invalid) != 1 || invalid[0] != "not-an-email" {
+		t.Errorf("Expected [not-an-email] to be invalid, got %v", invalid)
+	}
+}
+
+func TestAdminPageRoomHidesRoomsTheVisitorCannotSee(t *testing.T) {
+	for _, tt := range []struct {
+		visibility string
+		want       string
+	}{
+		{roomVisibilityPublic, "Office"},
+		{roomVisibilityUnlisted, ""},
+		{roomVisibilityPrivate, ""},
+	} {
+		room := Room{ID: 1, Name: "Office", Slug: "office-slug", Visibility: tt.visibility}
+		app := fiber.New()
+		app.Get("/", func(c *fiber.Ctx) error {
+			return c.SendString(adminPageRoom(c, session.New(), room).Name)
+		})
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != tt.want {
+			t.Errorf("%s: adminPageRoom() name = %q, want %q", tt.visibility, body, tt.want)
+		}
+	}
+}
+
+func TestIsValidRoomVisibility(t *testing.T) {
+	for _, visibility := range []string{"public", "unlisted", "private"} {
+		if !isValidRoomVisibility(visibility) {
+			t.Errorf("isValidRoomVisibility(%q) = false, want true", visibility)
+		}
+	}
+
+	for _, visibility := range []string{"", "hidden", "Public"} {
+		if isValidRoomVisibility(visibility) {
+			t.Errorf("isValidRoomVisibility(%q) = true, want false", visibility)
+		}
+	}
+}
+
+func TestEraseParticipantDeletesTheirInvites(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	encrypt := func(plaintext string) string {
+		ciphertext, err := encryptAES(key, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ciphertext
+	}
+
+	now := time.Now().UTC()
+	invites := []Invite{
+		{ID: 4, RoomID: 1, Email: encrypt(" Alice@Example.com")},
+		{ID: 5, RoomID: 1, Email: encrypt("bob@example.com")},
+		{ID: 6, RoomID: 1},
+	}
+	inviteIds, err := invitesSentTo(invites, "alice@example.com", key)
+	if err != nil || len(inviteIds) != 1 || inviteIds[0] != 4 {
+		t.Fatalf("invitesSentTo() = %v, %v, want [4]", inviteIds, err)
+	}
+
+	var inviteRows [][]driver.Value
+	for _, invite := range invites {
+		inviteRows = append(inviteRows, []driver.Value{int64(invite.ID), int64(invite.RoomID), invite.Email, int64(1), int64(0), now})
+	}
+	participant := Participant{ID: 2, RoomID: 1, Email: encrypt("alice@example.com"), Status: participantStatusPending}
+
+	tests := []struct {
+		drawn bool
+		want  []string
+	}{
+		{false, []string{
+			"DELETE FROM invite WHERE id = ANY($1)",
+			"DELETE FROM webhook_delivery WHERE webhook_id IN (SELECT id FROM webhook WHERE room_id = $1) AND payload::jsonb -> 'data' ->> 'participantId' = $2",
+			"DELETE FROM sent_reminder WHERE room_id = $1 AND participant_id = $2",
+			"DELETE FROM participant WHERE id = $1",
+		}},
+		{true, []string{
+			"DELETE FROM invite WHERE id = ANY($1)",
+			"DELETE FROM webhook_delivery WHERE webhook_id IN (SELECT id FROM webhook WHERE room_id = $1) AND payload::jsonb -> 'data' ->> 'participantId' = $2",
+			"UPDATE participant SET email = $2, email_hash = '', name = $3, participant_password = '', exclusion_group = '', wishlist = '', erased_at = $4 WHERE id = $1",
+		}},
+	}
+
+	for _, tt := range tests {
+		stub := &stubDB{queries: []stubQuery{
+			{"FROM invite WHERE room_id = $1", []string{"id", "room_id", "email", "max_uses", "uses", "expires_at"}, inviteRows},
+			{"SELECT room_id FROM participant WHERE id = $1 FOR UPDATE", []string{"room_id"}, [][]driver.Value{{int64(1)}}},
+			{"SELECT EXISTS", []string{"exists"}, [][]driver.Value{{tt.drawn}}},
+		}}
+		db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+
+		app := fiber.New()
+		app.Delete("/", func(c *fiber.Ctx) error {
+			anonymized, err := eraseParticipant(db, participant, key, nil, nil, c)
+			if err != nil || anonymized != tt.drawn {
+				t.Errorf("eraseParticipant() after draw %v = %v, %v", tt.drawn, anonymized, err)
+			}
+			return nil
+		})
+		if _, err := app.Test(httptest.NewRequest("DELETE", "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		if strings.Join(stub.execs, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("eraseParticipant() after draw %v wrote %q, want %q", tt.drawn, stub.execs, tt.want)
+		}
+	}
+}
+
+func TestPrepareParticipantWithoutPassword(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	prepared, err := prepareParticipant(CreateParticipantFormData{Name: "Alice", Email: "alice@example.com"}, key)
+	if err != nil {
+		t.Fatalf("prepareParticipant() error = %v", err)
+	}
+	if prepared.HashedPassword != "" {
+		t.Errorf("prepareParticipant() hashed an empty password: %q", prepared.HashedPassword)
+	}
+	if checkStringHash("", prepared.HashedPassword) {
+		t.Errorf("An empty stored hash should not accept any password")
+	}
+	if email, err := decryptAES(key, prepared.EncryptedEmail); err != nil || email != "alice@example.com" {
+		t.Errorf("prepareParticipant() email = (%q, %v), want it encrypted", email, err)
+	}
+	if prepared.EmailHash != emailIndex(key, "alice@example.com") {
+		t.Errorf("prepareParticipant() should index the email")
+	}
+}
+
+func TestRoomSlug(t *testing.T) {
+	slug, err := generateRoomSlug()
+	if err != nil {
+		t.Fatalf("generateRoomSlug() error = %v", err)
+	}
+	other, _ := generateRoomSlug()
+	if len(slug) != 24 || slug == other {
+		t.Errorf("generateRoomSlug() = %q, %q, want distinct 24 character slugs", slug, other)
+	}
+
+	room := Room{ID: 1, Slug: slug}
+	if !hasRoomSlug(room, slug) {
+		t.Errorf("hasRoomSlug() should accept the room's own slug")
+	}
+	if hasRoomSlug(room, other) || hasRoomSlug(room, "") {
+		t.Errorf("hasRoomSlug() should reject other and empty slugs")
+	}
+	if hasRoomSlug(Room{ID: 2}, "") {
+		t.Errorf("hasRoomSlug() should reject rooms that have no slug yet")
+	}
+}
+
+func TestAssignSecretSantaRespectsExclusionGroups(t *testing.T) {
+	participants := []Participant{
+		{ID: 1, Name: "Alice", ExclusionGroup: "family"},
+		{ID: 2, Name: "Bob", ExclusionGroup: "family"},
+		{ID: 3, Name: "Charlie"},
+		{ID: 4, Name: "Dean", ExclusionGroup: "team"},
+		{ID: 5, Name: "Earl", ExclusionGroup: "team"},
+	}
+	groups := make(map[string]string)
+	for _, p := range participants {
+		groups[p.Name] = p.ExclusionGroup
+	}
+
+	for run := 0; run < 20; run++ {
+		assignments, err := AssignSecretSanta(participants)
+		if err != nil {
+			t.Fatalf("AssignSecretSanta() error = %v", err)
+		}
+
+		for _, assignment := range assignments {
+			group := assignment.Participant.ExclusionGroup
+			if group != "" && groups[assignment.GifteeName] == group {
+				t.Errorf("%s drew %s from their own exclusion group %q", assignment.Participant.Name, assignment.GifteeName, group)
+			}
+		}
+	}
+}
+
+func TestAssignSecretSantaWithImpossibleExclusionGroups(t *testing.T) {
+	participants := []Participant{
+		{ID: 1, Name: "Alice", ExclusionGroup: "family"},
+		{ID: 2, Name: "Bob", ExclusionGroup: "family"},
+		{ID: 3, Name: "Charlie"},
+	}
+
+	if _, err := AssignSecretSanta(participants); err == nil {
+		t.Errorf("AssignSecretSanta() should error out when exclusion groups cannot be satisfied")
+	}
+}
+
+func TestParseParticipantCSV(t *testing.T) {
+	text := "name,email,exclusion group,wishlist\n" +
+		"Alice,alice@example.com,family,Books\n" +
+		"Bob,bob@example.com\n" +
+		"alice,alice2@example.com\n" +
+		"Charlie,not-an-email\n" +
+		"Dean,bob@example.com\n" +
+		"Earl,earl@example.com\n"
+
+	rows, err := parseParticipantCSV(text, map[string]bool{"earl": true}, map[string]bool{})
+	if err != nil {
+		t.Fatalf("parseParticipantCSV() error = %v", err)
+	}
+
+	if len(rows) != 6 {
+		t.Fatalf("Expected 6 rows, got %d", len(rows))
+	}
+
+	if rows[0].Name != "Alice" || rows[0].ExclusionGroup != "family" || rows[0].Wishlist != "Books" || len(rows[0].Errors) != 0 {
+		t.Errorf("Unexpected first row: %+v", rows[0])
+	}
+	if len(rows[1].Errors) != 0 {
+		t.Errorf("Expected row without optional columns to be valid, got %v", rows[1].Errors)
+	}
+
+	for _, i := range []int{2, 3, 4, 5} {
+		if len(rows[i].Errors) != 1 {
+			t.Errorf("Expected exactly one error on line %d, got %v", rows[i].Line, rows[i].Errors)
+		}
+	}
+}
+
+func TestWriteRoomExportCSV(t *testing.T) {
+	joinedAt := time.Date(2023, 11, 1, 10, 0, 0, 0, time.UTC)
+	export := RoomExport{
+		RoomName:           "Office",
+		IncludeAssignments: true,
+		Participants: []ExportedParticipant{
+			{Name: "Alice", Email: "alice@example.com", Wishlist: "Books, socks", JoinedAt: joinedAt, GifteeName: "Bob"},
+			{Name: "Bob", Email: "bob@example.com", JoinedAt: joinedAt, GifteeName: "Alice"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeRoomExportCSV(&buf, export); err != nil {
+		t.Fatalf("writeRoomExportCSV() error = %v", err)
+	}
+
+	want := "name,email,exclusion_group,wishlist,joined_at,giftee\n" +
+		"Alice,alice@example.com,,\"Books, socks\",2023-11-01T10:00:00Z,Bob\n" +
+		"Bob,bob@example.com,,,2023-11-01T10:00:00Z,Alice\n"
+	if buf.String() != want {
+		t.Errorf("writeRoomExportCSV() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestAPIErrorResponses(t *testing.T) {
+	store := session.New()
+	app := fiber.New()
+	app.Get("/api/v1/rooms/:id/participants", handleAPIGetParticipants(nil, store))
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"/api/v1/rooms/abc/participants", fiber.StatusBadRequest, "invalid_room_id"},
+		{"/api/v1/rooms/1/participants", fiber.StatusUnauthorized, "unauthorized"},
+	}
+
+	for _, tt := range tests {
+		resp, err := app.Test(httptest.NewRequest("GET", tt.path, nil))
+		if err != nil {
+			t.Fatalf("app.Test(%s) error = %v", tt.path, err)
+		}
+
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("GET %s status = %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+		}
+
+		var body APIErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("GET %s returned invalid JSON: %v", tt.path, err)
+		}
+		if body.Error.Code != tt.wantCode {
+			t.Errorf("GET %s error code = %q, want %q", tt.path, body.Error.Code, tt.wantCode)
+		}
+	}
+}
+
+// validateOpenAPIValue checks a decoded JSON value against an OpenAPI schema, returning every mismatch.
+func validateOpenAPIValue(spec map[string]interface{}, schema map[string]interface{}, value interface{}, path string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		resolved, ok := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: unresolvable $ref %s", path, ref)}
+		}
+		return validateOpenAPIValue(spec, resolved, value, path)
+	}
+
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: unexpected null", path)}
+	}
+
+	var problems []string
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected object, got %T", path, value)}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required property %q", path, name))
+			}
+		}
+		for name, propertyValue := range object {
+			if properties == nil {
+				continue
+			}
+			propertySchema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: undocumented property %q", path, name))
+				continue
+			}
+			problems = append(problems, validateOpenAPIValue(spec, propertySchema, propertyValue, path+"."+name)...)
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected array, got %T", path, value)}
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			problems = append(problems, validateOpenAPIValue(spec, items, item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected string, got %T", path, value))
+		}
+	case "integer", "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected number, got %T", path, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected boolean, got %T", path, value))
+		}
+	}
+
+	return problems
+}
+
+// openAPIResponseSchema returns the documented response schema for an operation and status, falling back to default.
+func openAPIResponseSchema(t *testing.T, spec map[string]interface{}, method string, path string, status int) map[string]interface{} {
+	operation, ok := spec["paths"].(map[string]interface{})[path].(map[string]interface{})[strings.ToLower(method)].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%s %s is not documented", method, path)
+	}
+
+	responses := operation["responses"].(map[string]interface{})
+	response, ok := responses[strconv.Itoa(status)].(map[string]interface{})
+	if !ok {
+		response = responses["default"].(map[string]interface{})
+	}
+
+	return response["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+}
+
+func newOpenAPITestApp(t *testing.T) (*fiber.App, map[string]interface{}) {
+	app := fiber.New()
+	registerAPIRoutes(app.Group("/api/v1"), apiOperations(nil, session.New(), []byte("0123456789abcdef0123456789abcdef"), EmailConfig{}, nil, nil, nil, nil))
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	if err != nil {
+		t.Fatalf("GET /api/v1/openapi.json error = %v", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("GET /api/v1/openapi.json status = %d", resp.StatusCode)
+	}
+
+	var spec map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&spec); err != nil {
+		t.Fatalf("OpenAPI document is not valid JSON: %v", err)
+	}
+
+	return app, spec
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	app, spec := newOpenAPITestApp(t)
+	paths := spec["paths"].(map[string]interface{})
+
+	for _, route := range app.GetRoutes(true) {
+		if route.Method == fiber.MethodHead || !strings.HasPrefix(route.Path, "/api/v1/") {
+			continue
+		}
+
+		path := strings.TrimPrefix(route.Path, "/api/v1")
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				segments[i] = "{" + strings.TrimPrefix(segment, ":") + "}"
+			}
+		}
+		path = strings.Join(segments, "/")
+		pathItem, ok := paths[path].(map[string]interface{})
+		if !ok {
+			t.Errorf("route %s %s has no OpenAPI path %s", route.Method, route.Path, path)
+			continue
+		}
+		if _, ok := pathItem[strings.ToLower(route.Method)]; !ok {
+			t.Errorf("route %s %s has no OpenAPI operation", route.Method, route.Path)
+		}
+	}
+}
+
+func TestOpenAPIValidatesHandlerResponses(t *testing.T) {
+	app, spec := newOpenAPITestApp(t)
+
+	tests := []struct {
+		method   string
+		url      string
+		specPath string
+		body     string
+	}{
+		{"GET", "/api/v1/rooms/abc", "/rooms/{id}", ""},
+		{"GET", "/api/v1/rooms/1", "/rooms/{id}", ""},
+		{"GET", "/api/v1/rooms/1/participants", "/rooms/{id}/participants", ""},
+		{"POST", "/api/v1/rooms/1/participants", "/rooms/{id}/participants", `{"name":"Alice"}`},
+		{"GET", "/api/v1/rooms/1/my-assignment", "/rooms/{id}/my-assignment", ""},
+		{"GET", "/api/v1/rooms/1/me/data", "/rooms/{id}/me/data", ""},
+		{"DELETE", "/api/v1/rooms/1/me", "/rooms/{id}/me", ""},
+		{"PUT", "/api/v1/rooms/1/me", "/rooms/{id}/me", `{"name":"Alice","email":"alice@example.com"}`},
+		{"PUT", "/api/v1/rooms/1/me/password", "/rooms/{id}/me/password", `{"currentPassword":"a","newPassword":"b"}`},
+		{"POST", "/api/v1/rooms/1/me/leave", "/rooms/{id}/me/leave", ""},
+		{"PUT", "/api/v1/rooms/1/visibility", "/rooms/{id}/visibility", `{"visibility":"private"}`},
+		{"PUT", "/api/v1/rooms/1/registration", "/rooms/{id}/registration", `{"requireApproval":true,"maxParticipants":10}`},
+		{"GET", "/api/v1/rooms/1/join-requests", "/rooms/{id}/join-requests", ""},
+		{"POST", "/api/v1/rooms/1/participants/2/approve", "/rooms/{id}/participants/{participantId}/approve", ""},
+		{"POST", "/api/v1/rooms/1/participants/2/reject", "/rooms/{id}/participants/{participantId}/reject", ""},
+		{"GET", "/api/v1/rooms/1/admins", "/rooms/{id}/admins", ""},
+		{"POST", "/api/v1/rooms/1/admins", "/rooms/{id}/admins", `{"email":"co@example.com"}`},
+		{"POST", "/api/v1/rooms/1/admin-password-reset", "/rooms/{id}/admin-password-reset", `{"email":"not an address"}`},
+		{"POST", "/api/v1/rooms/1/admin-password-reset", "/rooms/{id}/admin-password-reset", `{"email":"admin@example.com"}`},
+		{"POST", "/api/v1/rooms/1/magic-link", "/rooms/{id}/magic-link", `{"email":"alice@example.com"}`},
+		{"POST", "/api/v1/rooms/1/magic-link-session", "/rooms/{id}/magic-link-session", `{"token":"forged"}`},
+		{"GET", "/api/v1/rooms/1/invites", "/rooms/{id}/invites", ""},
+		{"POST", "/api/v1/rooms/1/invitations", "/rooms/{id}/invitations", `{"emails":[]}`},
+		{"POST", "/api/v1/rooms/1/export", "/rooms/{id}/export", ""},
+		{"POST", "/api/v1/rooms", "/rooms", `{"roomName":""}`},
+		{"POST", "/api/v1/rooms", "/rooms", `not json`},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s %s error = %v", tt.method, tt.url, err)
+		}
+
+		var body interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Errorf("%s %s returned invalid JSON: %v", tt.method, tt.url, err)
+			continue
+		}
+
+		schema := openAPIResponseSchema(t, spec, tt.method, tt.specPath, resp.StatusCode)
+		for _, problem := range validateOpenAPIValue(spec, schema, body, "response") {
+			t.Errorf("%s %s (%d): %s", tt.method, tt.url, resp.StatusCode, problem)
+		}
+	}
+}
+
+// stubQuery is a canned result for every query whose whitespace-collapsed SQL contains match.
+type stubQuery struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+}
+
+// stubDB answers queries from canned results, so handlers can run their success paths without Postgres.
+// The first matching stubQuery wins; a query nothing matches fails the request. Writes succeed and are
+// kept in execs. A statement containing a key of errs fails with its error instead.
+type stubDB struct {
+	queries []stubQuery
+	execs   []string
+	errs    map[string]error
+}
+
+func (d *stubDB) errFor(query string) error {
+	for match, err := range d.errs {
+		if strings.Contains(query, match) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *stubDB) Connect(context.Context) (driver.Conn, error) { return d, nil }
+func (d *stubDB) Driver() driver.Driver                        { return nil }
+func (d *stubDB) Prepare(query string) (driver.Stmt, error)   { return &stubStmt{db: d, query: query}, nil }
+func (d *stubDB) Close() error                                { return nil }
+func (d *stubDB) Begin() (driver.Tx, error)                   { return d, nil }
+func (d *stubDB) Commit() error                               { return nil }
+func (d *stubDB) Rollback() error                             { return nil }
+
+type stubStmt struct {
+	db    *stubDB
+	query string
+}
+
+func (s *stubStmt) Close() error  { return nil }
+func (s *stubStmt) NumInput() int { return -1 }
+
+func (s *stubStmt) Exec([]driver.Value) (driver.Result, error) {
+	query := strings.Join(strings.Fields(s.query), " ")
+	if err := s.db.errFor(query); err != nil {
+		return nil, err
+	}
+	s.db.execs = append(s.db.execs, query)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *stubStmt) Query([]driver.Value) (driver.Rows, error) {
+	query := strings.Join(strings.Fields(s.query), " ")
+	if err := s.db.errFor(query); err != nil {
+		return nil, err
+	}
+	for _, q := range s.db.queries {
+		if strings.Contains(query, q.match) {
+			return &stubRows{query: q}, nil
+		}
+	}
+	return nil, fmt.Errorf("stubDB has no result for: %s", query)
+}
+
+type stubRows struct {
+	query stubQuery
+	next  int
+}
+
+func (r *stubRows) Columns() []string { return r.query.columns }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if r.next == len(r.query.rows) {
+		return io.EOF
+	}
+	copy(dest, r.query.rows[r.next])
+	r.next++
+	return nil
+}
+
+func TestOpenAPIValidatesHandlerSuccessResponses(t *testing.T) {
+	now := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	roomColumns := []string{"id", "name", "visibility", "slug", "require_approval", "max_participants", "draw_completed", "deadline", "exchange_date", "created_at"}
+	participantColumns := []string{"id", "room_id", "name", "wishlist", "status", "erased_at", "created_at"}
+	stub := &stubDB{queries: []stubQuery{
+		{"COUNT(p.id) as participant_count", append(roomColumns, "participant_count"), [][]driver.Value{
+			{int64(1), "Office", "public", "abc", false, int64(0), false, now, now, now, int64(2)},
+			{int64(2), "Family", "public", "def", true, int64(10), false, now, nil, now, int64(0)},
+		}},
+		{"SELECT COUNT(*) FROM room WHERE visibility = $1", []string{"count"}, [][]driver.Value{{int64(2)}}},
+		{"FROM room WHERE room.id = $1", roomColumns, [][]driver.Value{
+			{int64(1), "Office", "public", "abc", false, int64(0), true, now, now, now},
+		}},
+		{"participant.status = 'approved'", participantColumns, [][]driver.Value{
+			{int64(1), int64(1), "Alice", "Books", participantStatusApproved, nil, now},
+			{int64(2), int64(1), "Bob", "", participantStatusApproved, nil, now},
+		}},
+		{"participant.status IN ('pending', 'waitlisted')", participantColumns, [][]driver.Value{
+			{int64(3), int64(1), "Carol", "", participantStatusPending, nil, now},
+		}},
+		{"FROM participant WHERE participant.room_id = $1", participantColumns, [][]driver.Value{
+			{int64(1), int64(1), "Alice", "Books", participantStatusApproved, nil, now},
+			{int64(2), int64(1), "Bob", "", participantStatusApproved, nil, now},
+		}},
+		{"FROM participant WHERE id = $1", participantColumns, [][]driver.Value{
+			{int64(1), int64(1), "Alice", "Books", participantStatusApproved, nil, now},
+		}},
+		{"FROM assignment WHERE room_id = $1", []string{"participant_id", "giftee_id", "notified_at"}, [][]driver.Value{
+			{int64(1), int64(2), now},
+			{int64(2), int64(1), now},
+		}},
+	}}
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	store := session.New()
+	app := fiber.New()
+	app.Get("/test/sign-in", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("roomAccess", 1)
+		sess.Set("roomAdmin", 1)
+		sess.Set("participantId", 1)
+		return sess.Save()
+	})
+	registerAPIRoutes(app.Group("/api/v1"), apiOperations(db, store, []byte("0123456789abcdef0123456789abcdef"), EmailConfig{}, nil, nil, nil, nil))
+	_, spec := newOpenAPITestApp(t)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/test/sign-in", nil))
+	if err != nil {
+		t.Fatalf("sign in error = %v", err)
+	}
+	cookie := resp.Header.Get("Set-Cookie")
+
+	tests := []struct {
+		url      string
+		specPath string
+	}{
+		{"/api/v1/rooms", "/rooms"},
+		{"/api/v1/rooms/1", "/rooms/{id}"},
+		{"/api/v1/rooms/1/participants", "/rooms/{id}/participants"},
+		{"/api/v1/rooms/1/join-requests", "/rooms/{id}/join-requests"},
+		{"/api/v1/rooms/1/my-assignment", "/rooms/{id}/my-assignment"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Cookie", cookie)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("GET %s error = %v", tt.url, err)
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			respBody, _ := io.ReadAll(resp.Body)
+			t.Errorf("GET %s status = %d, want 200: %s", tt.url, resp.StatusCode, respBody)
+			continue
+		}
+
+		var body interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Errorf("GET %s returned invalid JSON: %v", tt.url, err)
+			continue
+		}
+
+		schema := openAPIResponseSchema(t, spec, "GET", tt.specPath, resp.StatusCode)
+		for _, problem := range validateOpenAPIValue(spec, schema, body, "response") {
+			t.Errorf("GET %s: %s", tt.url, problem)
+		}
+	}
+}
+
+func TestOpenAPIValidatesResponseEncoders(t *testing.T) {
+	_, spec := newOpenAPITestApp(t)
+	now := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+
+	room := Room{ID: 1, Name: "Office", Visibility: "public", Deadline: now}
+	room.ExchangeDate.Time, room.ExchangeDate.Valid = now, true
+
+	tests := []struct {
+		method   string
+		specPath string
+		status   int
+		value    interface{}
+	}{
+		{"GET", "/rooms", fiber.StatusOK, APIRoomList{Rooms: []APIRoom{toAPIRoom(room, 3)}, Page: 1}},
+		{"GET", "/rooms/{id}", fiber.StatusOK, toAPIRoom(Room{ID: 2, Name: "No exchange date", Deadline: now}, 0)},
+		{"GET", "/rooms/{id}/join-requests", fiber.StatusOK, []APIParticipant{toAPIParticipant(Participant{ID: 3, Name: "Carol", Status: participantStatusWaitlisted, CreatedAt: now})}},
+		{"GET", "/rooms/{id}/invites", fiber.StatusOK, []APIInvite{toAPIInvite(InviteWithURL{Invite: Invite{ID: 1, MaxUses: 5, ExpiresAt: now}, URL: "http://localhost/invite/x"})}},
+		{"GET", "/rooms/{id}/my-assignment", fiber.StatusOK, APIAssignment{GifteeName: "Bob"}},
+		{"POST", "/rooms/{id}/export", fiber.StatusOK, RoomExport{RoomName: "Office", Participants: []ExportedParticipant{{Name: "Alice", Email: "alice@example.com"}}}},
+		{"GET", "/rooms/{id}/audit-events", fiber.StatusOK, []APIAuditEvent{toAPIAuditEvent(AuditEvent{ID: 1, RoomID: 1, ActorType: actorAdmin, Action: "room.exported", Details: "{}", CreatedAt: now})}},
+		{"GET", "/rooms/{id}/me/data", fiber.StatusOK, ParticipantDataExport{RoomName: "Office", Name: "Alice", Email: "alice@example.com", JoinedAt: now, RemindersSent: []ParticipantReminder{{Kind: reminderKindGiverExchange, SentAt: now}}, Activity: []APIAuditEvent{}, ExportedAt: now}},
+		{"DELETE", "/rooms/{id}/me", fiber.StatusOK, APIErasureResponse{Anonymized: true}},
+	}
+
+	for _, tt := range tests {
+		encoded, err := json.Marshal(tt.value)
+		if err != nil {
+			t.Fatalf("json.Marshal() error = %v", err)
+		}
+
+		var body interface{}
+		if err := json.Unmarshal(encoded, &body); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+
+		schema := openAPIResponseSchema(t, spec, tt.method, tt.specPath, tt.status)
+		for _, problem := range validateOpenAPIValue(spec, schema, body, "response") {
+			t.Errorf("%s %s: %s", tt.method, tt.specPath, problem)
+		}
+	}
+}
+
+// webhookTestReceiver is a local stand-in for a webhook endpoint that verifies signatures and records events.
+type webhookTestReceiver struct {
+	*httptest.Server
+	mu        sync.Mutex
+	secret    string
+	failFirst int
+	requests  int
+	events    []WebhookEvent
+	problems  []string
+}
+
+func newWebhookTestReceiver(secret string, failFirst int) *webhookTestReceiver {
+	receiver := &webhookTestReceiver{secret: secret, failFirst: failFirst}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+
+		receiver.requests++
+		if receiver.requests <= receiver.failFirst {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(receiver.secret))
+		mac.Write(body)
+		if r.Header.Get("X-SecretSanta-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			receiver.problems = append(receiver.problems, "signature mismatch")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			receiver.problems = append(receiver.problems, fmt.Sprintf("invalid payload: %v", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("X-SecretSanta-Event") != event.Event {
+			receiver.problems = append(receiver.problems, "event header does not match payload")
+		}
+
+		receiver.events = append(receiver.events, event)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return receiver
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	receiver := newWebhookTestReceiver("webhook-secret", 1)
+	defer receiver.Close()
+
+	payload, _ := json.Marshal(WebhookEvent{
+		Event:  webhookEventParticipantJoined,
+		RoomID: 4,
+		Data:   map[string]interface{}{"name": "Alice"},
+	})
+	delivery := WebhookDelivery{ID: 1, Event: webhookEventParticipantJoined, Payload: string(payload)}
+	client := &http.Client{Timeout: time.Second}
+
+	statusCode, err := deliverWebhook(client, receiver.URL, "webhook-secret", delivery)
+	if err == nil || statusCode != http.StatusServiceUnavailable {
+		t.Errorf("First delivery = (%d, %v), want a 503 failure", statusCode, err)
+	}
+
+	statusCode, err = deliverWebhook(client, receiver.URL, "webhook-secret", delivery)
+	if err != nil || statusCode != http.StatusNoContent {
+		t.Errorf("Retried delivery = (%d, %v), want 204", statusCode, err)
+	}
+
+	if _, err := deliverWebhook(client, receiver.URL, "wrong-secret", delivery); err == nil {
+		t.Errorf("Delivery signed with the wrong secret should be rejected")
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.events) != 1 || receiver.events[0].RoomID != 4 || receiver.events[0].Data["name"] != "Alice" {
+		t.Errorf("Receiver recorded unexpected events: %+v", receiver.events)
+	}
+	if len(receiver.problems) != 1 || receiver.problems[0] != "signature mismatch" {
+		t.Errorf("Receiver recorded unexpected problems: %v", receiver.problems)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}
+	for i, delay := range want {
+		if got := webhookRetryDelay(i + 1); got != delay {
+			t.Errorf("webhookRetryDelay(%d) = %s, want %s", i+1, got, delay)
+		}
+	}
+}
+
+func TestIsValidWebhookURL(t *testing.T) {
+	tests := map[string]bool{
+		"https://203.0.113.7/hook":                 true,
+		"http://localhost:8080/hook":               false,
+		"http://127.0.0.1/hook":                    false,
+		"http://10.1.2.3/hook":                     false,
+		"http://169.254.169.254/latest/meta-data/": false,
+		"http://[::1]/hook":                        false,
+		"http://[::ffff:192.168.0.1]/hook":         false,
+		"ftp://example.com/hook":                   false,
+		"/relative/hook":                           false,
+		"https://":                                 false,
+	}
+
+	for rawURL, want := range tests {
+		if got := isValidWebhookURL(rawURL); got != want {
+			t.Errorf("isValidWebhookURL(%q) = %v, want %v", rawURL, got, want)
+		}
+	}
+}
+
+func TestOutboundClientRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request reached %s", r.URL)
+	}))
+	defer server.Close()
+
+	_, err := newOutboundClient().Get(server.URL)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("Get(%s) error = %v, want %v", server.URL, err, errBlockedAddress)
+	}
+	if got := webhookFailureReason(0, err); got != errBlockedAddress.Error() {
+		t.Errorf("webhookFailureReason() = %q, want %q", got, errBlockedAddress.Error())
+	}
+	if got := webhookFailureReason(500, errors.New("unexpected status code 500")); got != "unexpected status code 500" {
+		t.Errorf("webhookFailureReason(500) = %q", got)
+	}
+}
+
+func TestPostChatMessage(t *testing.T) {
+	var received []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		received = append(received, payload)
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Timeout: time.Second}
+
+	if err := postChatMessage(client, chatPlatformSlack, server.URL+"/slack", "hello"); err != nil {
+		t.Errorf("postChatMessage(slack) error = %v", err)
+	}
+	if err := postChatMessage(client, chatPlatformDiscord, server.URL+"/discord", "hello"); err != nil {
+		t.Errorf("postChatMessage(discord) error = %v", err)
+	}
+	if err := postChatMessage(client, chatPlatformMattermost, server.URL+"/broken", "hello"); err == nil {
+		t.Errorf("postChatMessage() should fail on a non-2xx response")
+	}
+
+	if len(received) != 3 || received[0]["text"] != "hello" || received[1]["content"] != "hello" {
+		t.Errorf("Unexpected chat payloads: %v", received)
+	}
+}
+
+func TestSendSlackDirectMessage(t *testing.T) {
+	var postedTo, postedText string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			fmt.Fprint(w, `{"ok":false,"error":"invalid_auth"}`)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/users.lookupByEmail":
+			if r.URL.Query().Get("email") != "alice@example.com" {
+				fmt.Fprint(w, `{"ok":false,"error":"users_not_found"}`)
+				return
+			}
+			fmt.Fprint(w, `{"ok":true,"user":{"id":"U123"}}`)
+		case "/chat.postMessage":
+			var payload map[string]string
+			json.NewDecoder(r.Body).Decode(&payload)
+			postedTo, postedText = payload["channel"], payload["text"]
+			fmt.Fprint(w, `{"ok":true}`)
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Timeout: time.Second}
+
+	if err := sendSlackDirectMessage(client, server.URL, "xoxb-test", "alice@example.com", "You are gifting Bob"); err != nil {
+		t.Fatalf("sendSlackDirectMessage() error = %v", err)
+	}
+	if postedTo != "U123" || postedText != "You are gifting Bob" {
+		t.Errorf("Posted %q to %q, want %q to %q", postedText, postedTo, "You are gifting Bob", "U123")
+	}
+
+	if err := sendSlackDirectMessage(client, server.URL, "xoxb-test", "nobody@example.com", "hi"); err == nil || !strings.Contains(err.Error(), "users_not_found") {
+		t.Errorf("sendSlackDirectMessage() error = %v, want users_not_found", err)
+	}
+	if err := sendSlackDirectMessage(client, server.URL, "wrong", "alice@example.com", "hi"); err == nil {
+		t.Errorf("sendSlackDirectMessage() should fail with an invalid token")
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		wantName string
+		wantArgs []string
+		wantErr  bool
+	}{
+		{args: nil, wantName: "serve", wantArgs: nil},
+		{args: []string{"list-rooms"}, wantName: "list-rooms", wantArgs: []string{}},
+		{args: []string{"draw", "--room", "3", "--dry-run"}, wantName: "draw", wantArgs: []string{"--room", "3", "--dry-run"}},
+		{args: []string{"--help"}, wantName: "serve", wantArgs: []string{"--help"}},
+		{args: []string{"frobnicate"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		cmd, args, err := findCommand(tt.args)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("findCommand(%v) returned no error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("findCommand(%v) returned error: %s", tt.args, err)
+			continue
+		}
+		if cmd.Name != tt.wantName || fmt.Sprint(args) != fmt.Sprint(tt.wantArgs) {
+			t.Errorf("findCommand(%v) = %s %v, want %s %v", tt.args, cmd.Name, args, tt.wantName, tt.wantArgs)
+		}
+	}
+}
+
+func TestParseConfigReportsEveryProblem(t *testing.T) {
+	_, err := parseConfig(map[string]string{
+		"ENCRYPTION_KEY":                      "not base64!",
+		"DEFAULT_DEADLINE":                    "next friday",
+		"PORT":                                "http",
+		"REMINDER_ADMIN_DAYS_BEFORE_DEADLINE": "-1",
+		"SENDGRID_EMAIL_FROM":                 "santa",
+		"SENDGRID_TEMPLTE_ID":                 "d-123",
+		"SESSION_STORAGE":                     "redis",
+		"SESSION_COOKIE_SECURE":               "sometimes",
+		"LOG_LEVEL":                           "verbose",
+	}, true)
+
+	configErr, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("expected a ConfigError, got %v", err)
+	}
+
+	for _, want := range []string{
+		"SENDGRID_TEMPLTE_ID is not a known setting",
+		"DATABASE_URL is required",
+		"REMINDER_ADMIN_DAYS_BEFORE_DEADLINE must be a non-negative integer",
+		"PORT must be a port number",
+		"ENCRYPTION_KEY must be base64 encoded",
+		"DEFAULT_DEADLINE must look like",
+		"SENDGRID_API_KEY is required",
+		"SENDGRID_TEMPLATE_ID is required",
+		"SENDGRID_EMAIL_FROM must be an email address",
+		"SESSION_STORAGE must be",
+		"SESSION_COOKIE_SECURE must be true or false",
+		"LOG_LEVEL must be one of",
+	} {
+		if !strings.Contains(configErr.Error(), want) {
+			t.Errorf("expected %q in error:\n%s", want, configErr)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := parseConfig(map[string]string{
+		"DATABASE_URL":                        "postgres://localhost/santa",
+		"ENCRYPTION_KEY":                      "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		"DEFAULT_DEADLINE":                    "2023-12-10T18:00",
+		"REMINDER_GIVER_DAYS_BEFORE_EXCHANGE": "5",
+	}, false)
+	if err != nil {
+		t.Fatalf("parseConfig returned error: %s", err)
+	}
+
+	if config.Port != "3000" || len(config.EncryptionKey) != 32 || config.Reminders.AdminDaysBeforeDeadline != 2 || config.Reminders.GiverDaysBeforeExchange != 5 {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if config.Session != (SessionConfig{Storage: sessionStoragePostgres, Expiration: 24 * time.Hour, CookieSecure: true}) {
+		t.Errorf("unexpected session config: %+v", config.Session)
+	}
+	if config.ShutdownTimeout != 30*time.Second {
+		t.Errorf("ShutdownTimeout = %s, want 30s", config.ShutdownTimeout)
+	}
+	if config.Retention.DaysAfterExchange != 0 {
+		t.Errorf("retention should be off by default, got %+v", config.Retention)
+	}
+}
+
+func TestRetentionCutoff(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	got := retentionCutoff(RetentionConfig{DaysAfterExchange: 60}, now)
+	if want := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("retentionCutoff() = %s, want %s", got, want)
+	}
+
+	candidates, err := purgeExpiredRooms(nil, RetentionConfig{}, nil, nil, actorScheduler, now, false)
+	if err != nil || candidates != nil {
+		t.Errorf("purgeExpiredRooms() with retention off = %v, %v; want nothing", candidates, err)
+	}
+}
+
+func TestPurgeRoomPersonalDataDeletesWebhookDeliveries(t *testing.T) {
+	stub := &stubDB{}
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	if err := dbPurgeRoomPersonalData(db, 1, time.Now().UTC()); err != nil {
+		t.Fatalf("dbPurgeRoomPersonalData() = %v", err)
+	}
+
+	// Payloads of participant.joined and participant.left name the participant
+	for _, want := range []string{"DELETE FROM webhook_delivery WHERE webhook_id IN", "DELETE FROM participant WHERE room_id = $1"} {
+		if countExecs(stub.execs, want) != 1 {
+			t.Errorf("purge did not run %q: %v", want, stub.execs)
+		}
+	}
+	if countExecs(stub.execs, "DELETE FROM webhook WHERE") != 0 {
+		t.Errorf("purge deleted the room's webhooks: %v", stub.execs)
+	}
+}
+
+func TestNewSessionStoreSetsSecureCookie(t *testing.T) {
+	store := newSessionStore(nil, SessionConfig{Storage: sessionStorageMemory, Expiration: time.Hour, CookieSecure: true})
+
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		sess.Set("roomAccess", 1)
+		return sess.Save()
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := resp.Header.Get("Set-Cookie")
+	for _, want := range []string{"session_id=", "secure", "HttpOnly", "SameSite=Lax", "max-age=3600"} {
+		if !strings.Contains(cookie, want) {
+			t.Errorf("expected %q in Set-Cookie %q", want, cookie)
+		}
+	}
+}
+
+func TestLoadConfigLayersFileAndOverrides(t *testing.T) {
+	if _, ok := os.LookupEnv("PORT"); ok {
+		t.Skip("PORT is set in the environment")
+	}
+
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	contents := `{"DATABASE_URL": "postgres://file/santa", "ENCRYPTION_KEY": "MDEyMzQ1Njc4OWFiY2RlZg==", "DEFAULT_DEADLINE": "2023-12-10T18:00", "PORT": "8080"}`
+	if err := os.WriteFile(configFile, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(configFile, map[string]string{"DATABASE_URL": "postgres://flag/santa"}, false)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %s", err)
+	}
+
+	if config.DatabaseURL != "postgres://flag/santa" {
+		t.Errorf("expected the flag to override the file, got %q", config.DatabaseURL)
+	}
+	if config.Port != "8080" {
+		t.Errorf("expected the port from the file, got %q", config.Port)
+	}
+}
+
+func newCSRFTestApp() *fiber.App {
+	sessionConfig := SessionConfig{Storage: sessionStorageMemory, Expiration: time.Hour}
+	store := newSessionStore(nil, sessionConfig)
+
+	app := fiber.New()
+	app.Use(newCSRFMiddleware(store, sessionConfig))
+	app.Get("/create-room", func(c *fiber.Ctx) error {
+		return c.SendString(fmt.Sprint(c.Locals(csrfContextKey)))
+	})
+	app.Post("/create-room", func(c *fiber.Ctx) error {
+		return c.SendString("created")
+	})
+	app.Post("/api/v1/rooms", func(c *fiber.Ctx) error {
+		return c.SendString("created")
+	})
+	app.Delete("/api/v1/rooms/:id/me", func(c *fiber.Ctx) error {
+		return c.SendString("erased")
+	})
+	return app
+}
+
+func TestCSRFRejectsCrossSitePosts(t *testing.T) {
+	app := newCSRFTestApp()
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/create-room", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	token := string(body)
+	var cookies []string
+	for _, cookie := range resp.Cookies() {
+		cookies = append(cookies, cookie.Name+"="+cookie.Value)
+	}
+	if token == "" || len(cookies) == 0 {
+		t.Fatalf("expected a CSRF token and cookies, got token %q cookies %v", token, cookies)
+	}
+
+	send := func(method string, path string, contentType string, body string, fetchSite string, withCookies bool) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if fetchSite != "" {
+			req.Header.Set("Sec-Fetch-Site", fetchSite)
+		}
+		if withCookies {
+			req.Header.Set("Cookie", strings.Join(cookies, "; "))
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	const form = "application/x-www-form-urlencoded"
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		fetchSite   string
+		withCookies bool
+		wantStatus  int
+	}{
+		{"cross-site post without token", http.MethodPost, "/create-room", form, "roomName=evil", "", true, fiber.StatusForbidden},
+		{"cross-site post with guessed token", http.MethodPost, "/create-room", form, "roomName=evil&_csrf=guess", "", true, fiber.StatusForbidden},
+		{"token without the matching cookie", http.MethodPost, "/create-room", form, "roomName=evil&_csrf=" + token, "", false, fiber.StatusForbidden},
+		{"cross-site form post to the API", http.MethodPost, "/api/v1/rooms", form, "roomName=evil", "cross-site", true, fiber.StatusForbidden},
+		{"same-site form post", http.MethodPost, "/create-room", form, "roomName=ok&_csrf=" + token, "", true, fiber.StatusOK},
+		{"JSON API call", http.MethodPost, "/api/v1/rooms", "application/json", `{"roomName":"ok"}`, "", false, fiber.StatusOK},
+		{"body-less API call", http.MethodDelete, "/api/v1/rooms/1/me", "", "", "", true, fiber.StatusOK},
+		{"same-origin body-less API call", http.MethodDelete, "/api/v1/rooms/1/me", "", "", "same-origin", true, fiber.StatusOK},
+		{"cross-site body-less API call", http.MethodDelete, "/api/v1/rooms/1/me", "", "", "cross-site", true, fiber.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		if status := send(tt.method, tt.path, tt.contentType, tt.body, tt.fetchSite, tt.withCookies); status != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.wantStatus, status)
+		}
+	}
+}
+
+func TestIsCrossSiteRequest(t *testing.T) {
+	tests := []struct {
+		fetchSite string
+		origin    string
+		want      bool
+	}{
+		{"", "", false},
+		{"same-origin", "", false},
+		{"none", "", false},
+		{"same-site", "", true},
+		{"cross-site", "", true},
+		{"", "http://example.com", false},
+		{"", "https://evil.example", true},
+		{"", "null", true},
+	}
+
+	for _, tt := range tests {
+		app := fiber.New()
+		app.Delete("/", func(c *fiber.Ctx) error {
+			return c.SendString(strconv.FormatBool(isCrossSiteRequest(c)))
+		})
+
+		req := httptest.NewRequest(http.MethodDelete, "http://example.com/", nil)
+		if tt.fetchSite != "" {
+			req.Header.Set("Sec-Fetch-Site", tt.fetchSite)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if got := string(body) == "true"; got != tt.want {
+			t.Errorf("isCrossSiteRequest(Sec-Fetch-Site %q, Origin %q) = %v, want %v", tt.fetchSite, tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestEveryPostFormHasCSRFToken(t *testing.T) {
+	paths, err := filepath.Glob("views/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		forms := strings.Split(string(contents), "<form")[1:]
+		for i, form := range forms {
+			form = form[:strings.Index(form, "</form>")]
+			if strings.Contains(form, `method="post"`) && !strings.Contains(form, `name="_csrf"`) {
+				t.Errorf("%s: POST form %d has no _csrf field", path, i+1)
+			}
+		}
+	}
+}
+
+func TestBruteForceDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{9, 64 * time.Second},
+		{10, bruteForceLockoutDuration},
+		{25, bruteForceLockoutDuration},
+	}
+
+	for _, tt := range tests {
+		if got := bruteForceDelay(tt.failures); got != tt.want {
+			t.Errorf("bruteForceDelay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestBruteForceWait(t *testing.T) {
+	now := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ago time.Duration) sql.NullTime {
+		return sql.NullTime{Time: now.Add(-ago), Valid: true}
+	}
+
+	tests := []struct {
+		name  string
+		stats PasswordFailureStats
+		want  time.Duration
+	}{
+		{"no failures", PasswordFailureStats{}, 0},
+		{"a couple of typos", PasswordFailureStats{IPFailures: 2, IPLatest: at(0)}, 0},
+		{"progressive delay", PasswordFailureStats{IPFailures: 5, IPLatest: at(time.Second)}, 3 * time.Second},
+		{"delay already served", PasswordFailureStats{IPFailures: 5, IPLatest: at(time.Minute)}, 0},
+		{"client locked out", PasswordFailureStats{IPFailures: 10, IPLatest: at(5 * time.Minute)}, 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := bruteForceWait(tt.stats, now); got != tt.want {
+			t.Errorf("%s: bruteForceWait = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPasswordGuardRecordsAttemptsBeforeVerifying(t *testing.T) {
+	newGuard := func(failures int64, latest time.Time) (*PasswordGuard, *stubDB) {
+		stub := &stubDB{queries: []stubQuery{
+			{"INSERT INTO password_failure", []string{"id"}, [][]driver.Value{{int64(7)}}},
+			{"FROM password_failure", []string{"ip_failures", "ip_latest"}, [][]driver.Value{{failures, latest}}},
+		}}
+		return newPasswordGuard(sqlx.NewDb(sql.OpenDB(stub), "postgres"), []byte("0123456789abcdef0123456789abcdef"), nil), stub
+	}
+
+	guard, stub := newGuard(9, time.Now().UTC())
+	verified := false
+	err := guard.Check(1, passwordScopeJoin, "192.0.2.1", func() error {
+		verified = true
+		return nil
+	})
+	var lockout *LockoutError
+	if !errors.As(err, &lockout) || verified {
+		t.Fatalf("Check() with a locked out client = %v, verified = %v", err, verified)
+	}
+	if len(stub.execs) != 1 || !strings.HasPrefix(stub.execs[0], "DELETE FROM password_failure WHERE id = $1") {
+		t.Errorf("a throttled attempt should be forgotten, got writes %q", stub.execs)
+	}
+
+	guard, stub = newGuard(2, time.Now().UTC().Add(-time.Minute))
+	if err := guard.Check(1, passwordScopeJoin, "192.0.2.1", func() error { return errInvalidPassword }); err != errInvalidPassword {
+		t.Fatalf("Check() with a wrong password = %v", err)
+	}
+	if len(stub.execs) != 0 {
+		t.Errorf("a wrong password should stay recorded, got writes %q", stub.execs)
+	}
+}
+
+func TestWriteAuditEventsCSV(t *testing.T) {
+	events := []AuditEvent{
+		{ID: 2, ActorType: actorScheduler, Action: "draw.completed", Details: `{"assignments":3}`, CreatedAt: time.Date(2023, 12, 10, 18, 0, 0, 0, time.UTC)},
+		{ID: 1, ActorType: actorVisitor, Action: "participant.joined", IPHash: "abcd", Details: `{"inviteId":0,"participantId":7}`, CreatedAt: time.Date(2023, 12, 1, 9, 30, 0, 0, time.UTC)},
+	}
+
+	var buf bytes.Buffer
+	if err := writeAuditEventsCSV(&buf, events); err != nil {
+		t.Fatalf("writeAuditEventsCSV returned error: %s", err)
+	}
+
+	want := "id,created_at,actor_type,action,ip_hash,details\n" +
+		"2,2023-12-10T18:00:00Z,scheduler,draw.completed,,\"{\"\"assignments\"\":3}\"\n" +
+		"1,2023-12-01T09:30:00Z,visitor,participant.joined,abcd,\"{\"\"inviteId\"\":0,\"\"participantId\"\":7}\"\n"
+	if buf.String() != want {
+		t.Errorf("unexpected CSV:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	apiEvent := toAPIAuditEvent(events[0])
+	if apiEvent.Details["assignments"] != float64(3) {
+		t.Errorf("expected decoded details, got %v", apiEvent.Details)
+	}
+}
+
+func TestHashIP(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	if hashIP(key, "203.0.113.7") != hashIP(key, "203.0.113.7") {
+		t.Error("expected the same IP to hash the same way")
+	}
+	if hashIP(key, "203.0.113.7") == hashIP(key, "203.0.113.8") {
+		t.Error("expected different IPs to hash differently")
+	}
+	if hashIP(key, "203.0.113.7") == hashIP([]byte("fedcba9876543210fedcba9876543210"), "203.0.113.7") {
+		t.Error("expected the hash to depend on the key")
+	}
+	if strings.Contains(hashIP(key, "203.0.113.7"), "203.0.113.7") {
+		t.Error("expected the IP not to appear in its hash")
+	}
+}
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := newMetrics()
+	m.Inc("secret_santa_emails_total", "provider", "sendgrid", "result", "sent")
+	m.Inc("secret_santa_emails_total", "provider", "sendgrid", "result", "sent")
+	m.Inc("secret_santa_emails_total", "provider", "sendgrid", "result", "failed")
+	m.Add("secret_santa_participants_joined_total", 3)
+	m.Set("secret_santa_scheduler_run_duration_seconds", 0.25)
+
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	want := `# HELP secret_santa_participants_joined_total Participants who joined or were imported.
+# TYPE secret_santa_participants_joined_total counter
+secret_santa_participants_joined_total 3
+# HELP secret_santa_emails_total Emails handed to the provider, by result.
+# TYPE secret_santa_emails_total counter
+secret_santa_emails_total{provider="sendgrid",result="failed"} 1
+secret_santa_emails_total{provider="sendgrid",result="sent"} 2
+# HELP secret_santa_scheduler_run_duration_seconds Duration of the latest scheduler run.
+# TYPE secret_santa_scheduler_run_duration_seconds gauge
+secret_santa_scheduler_run_duration_seconds 0.25
+`
+	if b.String() != want {
+		t.Errorf("WriteTo() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestGetMetricsRequiresTokenAndCachesRoomCounts(t *testing.T) {
+	stub := &stubDB{queries: []stubQuery{
+		{"GROUP BY state", []string{"state", "count"}, [][]driver.Value{{"open", int64(2)}}},
+	}}
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	app := fiber.New()
+	app.Get("/metrics", handleGetMetrics(db, newMetrics(), "scrape-token"))
+
+	scrape := func(authorization string) (int, string) {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := scrape(""); status != fiber.StatusUnauthorized {
+		t.Errorf("scrape without a token: status = %d, want 401", status)
+	}
+	if status, _ := scrape("Bearer wrong"); status != fiber.StatusUnauthorized {
+		t.Errorf("scrape with a wrong token: status = %d, want 401", status)
+	}
+
+	status, body := scrape("Bearer scrape-token")
+	if status != fiber.StatusOK || !strings.Contains(body, `secret_santa_rooms{state="open"} 2`) {
+		t.Fatalf("scrape = %d %q, want the open room count", status, body)
+	}
+
+	// A second scrape within the interval reuses the count instead of querying again
+	stub.queries[0].rows[0][1] = int64(5)
+	if _, body := scrape("Bearer scrape-token"); !strings.Contains(body, `secret_santa_rooms{state="open"} 2`) {
+		t.Errorf("second scrape = %q, want the cached count", body)
+	}
+}
+
+func TestGetMetricsDoesNotRetryAFailedRoomCountWithinTheInterval(t *testing.T) {
+	stub := &stubDB{
+		queries: []stubQuery{{"GROUP BY state", []string{"state", "count"}, [][]driver.Value{{"open", int64(2)}}}},
+		errs:    map[string]error{"GROUP BY state": errors.New("connection refused")},
+	}
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	app := fiber.New()
+	app.Get("/metrics", handleGetMetrics(db, newMetrics(), "scrape-token"))
+
+	for _, scrape := range []string{"failed", "throttled"} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer scrape-token")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != fiber.StatusOK || strings.Contains(string(body), "secret_santa_rooms") {
+			t.Errorf("%s scrape = %d %q, want no room counts", scrape, resp.StatusCode, body)
+		}
+		// Had the failure not been cached, the next scrape would query again and now succeed
+		stub.errs = nil
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	app := fiber.New()
+	app.Get("/healthz", handleGetHealthz())
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/healthz", nil))
+	if err != nil {
+		t.Fatalf("GET /healthz error = %v", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("GET /healthz status = %d, want %d", resp.StatusCode, fiber.StatusOK)
+	}
+}
+
+func TestLoggerRedactsPII(t *testing.T) {
+	var b bytes.Buffer
+	l := newLogger(&b, logLevelInfo).With("requestId", "req-1")
+
+	l.Debug("not written")
+	l.Error("Failed to send email to alice@example.com",
+		"participantId", 7,
+		"email", "alice@example.com",
+		"participantPassword", "hunter2",
+		"gifteeName", "Bob",
+		"error", errors.New("rejected bob@example.org"),
+	)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line above the level threshold, got %d:\n%s", len(lines), b.String())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v\n%s", err, lines[0])
+	}
+
+	for _, secret := range []string{"alice@example.com", "bob@example.org", "hunter2", "Bob"} {
+		if strings.Contains(lines[0], secret) {
+			t.Errorf("log line leaks %q: %s", secret, lines[0])
+		}
+	}
+	if entry["level"] != "error" || entry["requestId"] != "req-1" || entry["participantId"] != float64(7) {
+		t.Errorf("unexpected log entry: %v", entry)
+	}
+	if entry["msg"] != "Failed to send email to [redacted email]" {
+		t.Errorf("msg = %v", entry["msg"])
+	}
+}
+
+func TestBackgroundTasksWait(t *testing.T) {
+	var tasks backgroundTasks
+	release := make(chan struct{})
+	tasks.Go(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tasks.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() with a running task = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(release)
+	if err := tasks.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() after the task finished = %v", err)
+	}
+}
+
+func TestAssignmentNeedsSending(t *testing.T) {
+	now := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	at := func(t time.Time) sql.NullTime { return sql.NullTime{Time: t, Valid: true} }
+
+	tests := []struct {
+		name       string
+		assignment Assignment
+		want       bool
+	}{
+		{"never claimed", Assignment{}, true},
+		{"claimed and sent", Assignment{NotifiedAt: at(now.Add(-time.Hour)), SentAt: at(now.Add(-time.Hour))}, false},
+		{"send in progress", Assignment{NotifiedAt: at(now.Add(-time.Minute))}, false},
+		{"claim cut short", Assignment{NotifiedAt: at(now.Add(-assignmentClaimTimeout - time.Second))}, true},
+		{"erased", Assignment{Participant: Participant{ErasedAt: at(now)}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := assignmentNeedsSending(tt.assignment, now); got != tt.want {
+			t.Errorf("%s: assignmentNeedsSending() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// assignmentTestDB stubs a drawn room whose assignments are in every notification state.
+func assignmentTestDB(t *testing.T, key []byte, pending bool) *stubDB {
+	now := time.Now().UTC()
+	participantColumns := []string{"id", "room_id", "name", "email", "status", "erased_at", "created_at"}
+	var participants [][]driver.Value
+	for i, name := range []string{"Alice", "Bob", "Carol", "Dave", "Erin"} {
+		email, err := encryptAES(key, strings.ToLower(name)+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		participants = append(participants, []driver.Value{int64(i + 1), int64(1), name, email, participantStatusApproved, nil, now})
+	}
+
+	return &stubDB{queries: []stubQuery{
+		{"SELECT EXISTS", []string{"exists"}, [][]driver.Value{{pending}}},
+		{"FROM participant WHERE participant.room_id = $1", participantColumns, participants},
+		{"FROM assignment WHERE room_id = $1", []string{"participant_id", "giftee_id", "notified_at", "sent_at"}, [][]driver.Value{
+			{int64(1), int64(2), nil, nil},
+			{int64(2), int64(3), now.Add(-time.Hour), nil},
+			{int64(3), int64(4), now.Add(-time.Minute), nil},
+			{int64(4), int64(5), now.Add(-time.Hour), now.Add(-time.Hour)},
+			{int64(5), int64(1), nil, nil},
+		}},
+	}}
+}
+
+func countExecs(execs []string, match string) int {
+	count := 0
+	for _, exec := range execs {
+		if strings.Contains(exec, match) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRunRoomDrawFailureIsClaimedForTheScheduler(t *testing.T) {
+	for _, tt := range []struct {
+		actorType  string
+		wantClaims int
+	}{
+		{actorScheduler, 2},
+		{actorAdmin, 1},
+	} {
+		stub := &stubDB{queries: []stubQuery{
+			{"FROM participant WHERE participant.room_id = $1", []string{"id"}, nil},
+		}}
+		db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+
+		err := runRoomDraw(context.Background(), db, nil, nil, newAuditor(db, nil), nil, tt.actorType, Room{ID: 1})
+		if err == nil {
+			t.Errorf("%s: runRoomDraw() without participants returned no error", tt.actorType)
+		}
+		// registration_closed is always claimed; draw_failed only guards the scheduler's retries
+		if got := countExecs(stub.execs, "INSERT INTO sent_reminder"); got != tt.wantClaims {
+			t.Errorf("%s: runRoomDraw() claimed %d reminders, want %d", tt.actorType, got, tt.wantClaims)
+		}
+		if got := countExecs(stub.execs, "INSERT INTO audit_event"); got != 2 {
+			t.Errorf("%s: runRoomDraw() recorded %d audit events, want 2", tt.actorType, got)
+		}
+		db.Close()
+	}
+}
+
+func TestNotifyAssignmentsClaimsConfirmsAndReleases(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	stub := assignmentTestDB(t, key, true)
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	var attempted []string
+	notifier := &Notifier{sendAssignmentEmail: func(_ EmailConfig, assignment Assignment) error {
+		attempted = append(attempted, assignment.Participant.Email+" gifts "+assignment.GifteeName)
+		if assignment.Participant.Name == "Erin" {
+			return errors.New("provider unavailable")
+		}
+		return nil
+	}}
+
+	sent, err := notifyAssignments(context.Background(), db, key, notifier, nil, Room{ID: 1})
+	if err == nil {
+		t.Error("notifyAssignments() with a failed send returned no error")
+	}
+	if sent != 2 {
+		t.Errorf("sent = %d, want 2", sent)
+	}
+
+	// Alice was never claimed, Bob's claim was cut short by a crash; Carol's send is in progress and Dave's is done
+	want := []string{"alice@example.com gifts Bob", "bob@example.com gifts Carol", "erin@example.com gifts Alice"}
+	if strings.Join(attempted, ", ") != strings.Join(want, ", ") {
+		t.Errorf("attempted %v, want %v", attempted, want)
+	}
+
+	for _, tt := range []struct {
+		match string
+		want  int
+	}{
+		{"SET notified_at = $3, sent_at = NULL", 3},
+		{"SET sent_at = $3", 2},
+		{"SET notified_at = NULL", 1},
+	} {
+		if got := countExecs(stub.execs, tt.match); got != tt.want {
+			t.Errorf("%d execs matching %q, want %d: %v", got, tt.match, tt.want, stub.execs)
+		}
+	}
+}
+
+func TestResumeAssignmentsOnlySendsWhenSomeArePending(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, pending := range []bool{false, true} {
+		stub := assignmentTestDB(t, key, pending)
+		db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+
+		attempts := 0
+		notifier := &Notifier{sendAssignmentEmail: func(EmailConfig, Assignment) error {
+			attempts++
+			return nil
+		}}
+
+		if err := resumeAssignments(context.Background(), db, key, notifier, nil, Room{ID: 1}); err != nil {
+			t.Errorf("pending=%v: resumeAssignments() = %v", pending, err)
+		}
+		db.Close()
+
+		wantAttempts := 0
+		if pending {
+			wantAttempts = 3
+		}
+		if attempts != wantAttempts {
+			t.Errorf("pending=%v: %d sends attempted, want %d", pending, attempts, wantAttempts)
+		}
+	}
+}
+
+func TestAssignmentSucceedsWhenAnyChannelDelivers(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	botToken, err := encryptAES(key, "xoxb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slackOK := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slackOK {
+			w.Write([]byte(`{"ok":false,"error":"users_not_found"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"user":{"id":"U1"}}`))
+	}))
+	defer server.Close()
+
+	room := Room{ID: 1, Name: "Office", ChatPlatform: chatPlatformSlack, ChatBotToken: botToken}
+	assignment := Assignment{Participant: Participant{ID: 1, Email: "alice@example.com"}, GifteeName: "Bob"}
+
+	tests := []struct {
+		name      string
+		emailErr  error
+		slackOK   bool
+		room      Room
+		wantError bool
+	}{
+		{"both delivered", nil, true, room, false},
+		{"email failed, chat delivered", errors.New("provider unavailable"), true, room, false},
+		{"email delivered, chat failed", nil, false, room, false},
+		{"both failed", errors.New("provider unavailable"), false, room, true},
+		{"email failed without chat", errors.New("provider unavailable"), true, Room{ID: 1}, true},
+	}
+
+	for _, tt := range tests {
+		slackOK = tt.slackOK
+		notifier := &Notifier{
+			encryptionKey:       key,
+			client:              server.Client(),
+			slackAPIURL:         server.URL,
+			sendAssignmentEmail: func(EmailConfig, Assignment) error { return tt.emailErr },
+		}
+		err := notifier.Assignment(nil, tt.room, assignment)
+		if (err != nil) != tt.wantError {
+			t.Errorf("%s: Assignment() = %v, want error %v", tt.name, err, tt.wantError)
+		}
+	}
+}
+
+func TestVerifyAdminPasswordRequiresEmailOfAdminsWhoHaveOne(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	hash := func(password string) string {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(hashed)
+	}
+	email, err := encryptAES(key, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	stub := &stubDB{queries: []stubQuery{
+		{"FROM room_admin WHERE room_id = $1", []string{"id", "room_id", "email", "admin_password", "created_at"}, [][]driver.Value{
+			{int64(1), int64(1), "", hash("shared"), now},
+			{int64(2), int64(1), email, hash("alice's"), now},
+		}},
+	}}
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	tests := []struct {
+		email    string
+		password string
+		wantId   int
+	}{
+		{"", "shared", 1},
+		{"", "alice's", 0},
+		{"Alice@Example.com ", "alice's", 2},
+		{"alice@example.com", "shared", 0},
+		{"bob@example.com", "alice's", 0},
+	}
+
+	for _, tt := range tests {
+		admin, err := verifyAdminPassword(db, key, 1, tt.email, tt.password)
+		if tt.wantId == 0 {
+			if err != errInvalidPassword {
+				t.Errorf("verifyAdminPassword(%q, %q) = %v, want %v", tt.email, tt.password, err, errInvalidPassword)
+			}
+			continue
+		}
+		if err != nil || admin.ID != tt.wantId {
+			t.Errorf("verifyAdminPassword(%q, %q) = admin %d, %v, want admin %d", tt.email, tt.password, admin.ID, err, tt.wantId)
+		}
+	}
+}
+
+func TestParticipantEmailUniqueViolationIsEmailTaken(t *testing.T) {
+	for _, tt := range []struct {
+		constraint string
+		want       bool
+	}{
+		{participantEmailUniqueIndex, true},
+		{participantNameUniqueConstraint, false},
+	} {
+		violation := &pq.Error{Code: "23505", Constraint: tt.constraint}
+		stub := &stubDB{errs: map[string]error{
+			"INSERT INTO participant":     violation,
+			"UPDATE participant SET name": violation,
+		}}
+		db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+
+		_, err := dbInsertParticipant(db, preparedParticipant{}, 1, participantStatusApproved)
+		if (err == errEmailTaken) != tt.want {
+			t.Errorf("%s: dbInsertParticipant() = %v, want errEmailTaken %v", tt.constraint, err, tt.want)
+		}
+		err = dbUpdateParticipantProfile(db, 1, "Alice", "encrypted", "hash")
+		if (err == errEmailTaken) != tt.want {
+			t.Errorf("%s: dbUpdateParticipantProfile() = %v, want errEmailTaken %v", tt.constraint, err, tt.want)
+		}
+		db.Close()
+	}
+}
+
+func TestParticipantNameUniqueViolationIsNameTaken(t *testing.T) {
+	stub := &stubDB{errs: map[string]error{
+		"INSERT INTO participant": &pq.Error{Code: "23505", Constraint: participantNameUniqueConstraint},
+	}}
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	if _, err := dbInsertParticipant(db, preparedParticipant{}, 1, participantStatusApproved); err != errNameTaken {
+		t.Errorf("dbInsertParticipant() = %v, want errNameTaken", err)
+	}
+}
+
+func TestParticipantNameUniqueViolationOnUpdateIsNameTaken(t *testing.T) {
+	stub := &stubDB{errs: map[string]error{
+		"UPDATE participant SET name": &pq.Error{Code: "23505", Constraint: participantNameUniqueConstraint},
+	}}
+	db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+	defer db.Close()
+
+	if err := dbUpdateParticipantProfile(db, 1, "Alice", "encrypted", "hash"); err != errNameTaken {
+		t.Errorf("dbUpdateParticipantProfile() = %v, want errNameTaken", err)
+	}
+}
+
+func TestUpdateParticipantProfileChecksEmailsByIndex(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	email, err := encryptAES(key, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	participant := Participant{ID: 1, RoomID: 1, Name: "Alice", Email: email}
+
+	for _, tt := range []struct {
+		owners      [][]driver.Value
+		want        error
+		wantUpdates int
+	}{
+		// Other participants' addresses are never decrypted, so one that cannot be is no obstacle
+		{[][]driver.Value{{int64(2), "not encrypted"}}, errEmailTaken, 0},
+		{[][]driver.Value{{int64(1), email}}, nil, 1},
+		{nil, nil, 1},
+	} {
+		stub := &stubDB{queries: []stubQuery{
+			{"FROM room WHERE room.id = $1", []string{"id", "draw_completed"}, [][]driver.Value{{int64(1), false}}},
+			{"email_hash = $2", []string{"id", "email"}, tt.owners},
+		}}
+		db := sqlx.NewDb(sql.OpenDB(stub), "postgres")
+
+		err := updateParticipantProfile(db, participant, "Alice", "bob@example.com", key, nil, nil)
+		if err != tt.want {
+			t.Errorf("updateParticipantProfile() with owners %v = %v, want %v", tt.owners, err, tt.want)
+		}
+		if got := countExecs(stub.execs, "UPDATE participant SET name"); got != tt.wantUpdates {
+			t.Errorf("updateParticipantProfile() with owners %v ran %d updates, want %d", tt.owners, got, tt.wantUpdates)
+		}
+		db.Close()
+	}
+}
+
+func TestJoinStatus(t *testing.T) {
+	tests := []struct {
+		name            string
+		requireApproval bool
+		maxParticipants int
+		approved        int
+		waitlisted      int
+		want            string
+	}{
+		{"open room", false, 0, 40, 0, participantStatusApproved},
+		{"room with free places", false, 10, 9, 0, participantStatusApproved},
+		{"full room", false, 10, 10, 0, participantStatusWaitlisted},
+		{"free place with a waitlist", false, 10, 9, 2, participantStatusWaitlisted},
+		{"approval required", true, 0, 0, 0, participantStatusPending},
+		{"approval required in a full room", true, 10, 10, 3, participantStatusPending},
+	}
+
+	for _, tt := range tests {
+		if got := joinStatus(tt.requireApproval, tt.maxParticipants, tt.approved, tt.waitlisted); got != tt.want {
+			t.Errorf("%s: joinStatus() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWaitlistToPromote(t *testing.T) {
+	base := time.Date(2023, 12, 1, 12, 0, 0, 0, time.UTC)
+	// Listed out of joining order; 4 and 2 joined at the same moment
+	waitlisted := []Participant{
+		{ID: 5, CreatedAt: base.Add(3 * time.Minute)},
+		{ID: 4, CreatedAt: base.Add(time.Minute)},
+		{ID: 1, CreatedAt: base.Add(2 * time.Minute)},
+		{ID: 2, CreatedAt: base.Add(time.Minute)},
+	}
+
+	tests := []struct {
+		name            string
+		maxParticipants int
+		approved        int
+		want            []int
+	}{
+		{"no limit", 0, 40, []int{2, 4, 1, 5}},
+		{"two free places", 10, 8, []int{2, 4}},
+		{"more places than waiting", 10, 2, []int{2, 4, 1, 5}},
+		{"full", 10, 10, nil},
+		{"over the limit after lowering it", 10, 12, nil},
+	}
+
+	for _, tt := range tests {
+		got := waitlistToPromote(waitlisted, tt.maxParticipants, tt.approved)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: waitlistToPromote() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if waitlisted[0].ID != 5 {
+		t.Errorf("waitlistToPromote() reordered its argument")
+	}
+}